@@ -10,14 +10,15 @@ require (
 	github.com/neilotoole/jsoncolor v0.7.1
 	github.com/valkey-io/valkey-go v1.0.55
 	github.com/valkey-io/valkey-go/valkeycompat v1.0.55
+	golang.org/x/net v0.35.0
+	golang.org/x/sys v0.30.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	golang.org/x/mod v0.23.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/term v0.29.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
 )
@@ -0,0 +1,77 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"sync"
+	"time"
+)
+
+// Opens after a number of consecutive failures within a window and rejects attempts
+// until the cooldown has passed. Then it is half-open and lets one attempt probe, which
+// closes it on success and opens it again on failure.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	failures     uint32
+	firstFailure time.Time
+	openUntil    time.Time // zero while closed
+	cooldown     time.Duration
+}
+
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Only this caller probes, the others are rejected until its outcome is recorded,
+	// or another cooldown has passed in case it never is
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Records a failure, returns true if the breaker has just been opened
+func (b *circuitBreaker) Failure(threshold uint32, window time.Duration, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.cooldown = cooldown
+	if !b.openUntil.IsZero() {
+		// The probe of a half-open breaker failed, open it again right away
+		b.openUntil = now.Add(cooldown)
+		return false
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures < threshold {
+		return false
+	}
+	b.failures = 0
+	b.openUntil = now.Add(cooldown)
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Whether the breaker holds no state worth keeping anymore
+func (b *circuitBreaker) Idle(window time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	return !now.Before(b.openUntil) && (b.failures == 0 || now.Sub(b.firstFailure) > window)
+}
@@ -0,0 +1,84 @@
+package tlspol
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < 2; i++ {
+		if b.Failure(3, time.Minute, time.Minute) {
+			t.Fatalf("Breaker opened after %d failures, expected 3", i+1)
+		}
+	}
+	if !b.Allow() {
+		t.Fatal("Breaker should still allow attempts below the threshold")
+	}
+	if !b.Failure(3, time.Minute, time.Minute) {
+		t.Fatal("Breaker should open after 3 failures")
+	}
+	if b.Allow() {
+		t.Fatal("Open breaker should reject attempts")
+	}
+	b.Success()
+	if !b.Allow() {
+		t.Fatal("Breaker should allow attempts after a success")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := &circuitBreaker{}
+	b.Failure(2, time.Millisecond, time.Minute)
+	time.Sleep(5 * time.Millisecond)
+	if b.Failure(2, time.Millisecond, time.Minute) {
+		t.Fatal("Failures outside the window should not be counted")
+	}
+	if !b.Failure(2, time.Minute, 10*time.Millisecond) {
+		t.Fatal("Breaker should open after consecutive failures within the window")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Breaker should allow attempts after the cooldown")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := &circuitBreaker{}
+	b.Failure(1, time.Minute, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// Only one of the concurrent callers may probe
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.Allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := allowed.Load(); n != 1 {
+		t.Fatalf("Expected a single probe, got %d", n)
+	}
+
+	if b.Failure(3, time.Minute, 10*time.Millisecond) {
+		t.Error("A failed probe should not count as opening the breaker anew")
+	}
+	if b.Allow() {
+		t.Fatal("Breaker should open again right away after a failed probe")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Breaker should allow a probe after the cooldown")
+	}
+	b.Success()
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("Breaker should allow all attempts after a successful probe")
+	}
+}
@@ -0,0 +1,461 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+	"github.com/valkey-io/valkey-go/valkeycompat"
+)
+
+// Decoded cache entry with its precomputed socketmap replies
+type cacheEntry struct {
+	raw          string
+	data         CacheStruct
+	reply        []byte
+	replyWithRpt []byte
+}
+
+const DECODED_MAX_ENTRIES = 4096
+
+// TTLs of cached verdicts by outcome, the constants apply where cache.*_ttl is unset
+func cacheNotFoundTtl() uint32 {
+	config := getConfig()
+	return cmp.Or(config.Cache.NotFoundTtl, CACHE_NOTFOUND_TTL)
+}
+
+func cacheTempTtl() uint32 {
+	config := getConfig()
+	return cmp.Or(config.Cache.TempTtl, CACHE_TEMP_TTL)
+}
+
+func cacheMinTtl() uint32 {
+	config := getConfig()
+	return cmp.Or(config.Cache.MinTtl, CACHE_MIN_TTL)
+}
+
+// Most queries are cache hits of the same entries, so keep them decoded as long as they are unchanged
+var decodedEntries = struct {
+	sync.Mutex
+	m map[string]*cacheEntry
+}{m: make(map[string]*cacheEntry)}
+
+func newCacheEntry(raw string, data CacheStruct) *cacheEntry {
+	e := &cacheEntry{raw: raw, data: data}
+	if isUsablePolicy(data.Result) {
+		e.reply = netstring.Marshal("OK " + data.Result)
+		e.replyWithRpt = netstring.Marshal("OK " + data.Result + " " + data.Report)
+	}
+	return e
+}
+
+// Decodes a raw cache entry, upgrading it if it is from an older schema
+func decodeCacheEntry(cacheKey *string, raw string) (*cacheEntry, bool, error) {
+	decodedEntries.Lock()
+	e, ok := decodedEntries.m[*cacheKey]
+	decodedEntries.Unlock()
+	if ok && e.raw == raw {
+		return e, false, nil
+	}
+
+	var data CacheStruct
+	err := json.Unmarshal([]byte(raw), &data)
+	if err != nil {
+		return nil, false, err
+	}
+	migrated := false
+	if data.Schema != DB_SCHEMA {
+		// Entry from an older schema, upgrade it lazily
+		data, err = migrateEntry([]byte(raw))
+		if err != nil {
+			return nil, false, err
+		}
+		data.Schema = DB_SCHEMA
+		migrated = true
+	}
+
+	e = newCacheEntry(raw, data)
+	decodedEntries.Lock()
+	if len(decodedEntries.m) >= DECODED_MAX_ENTRIES {
+		clear(decodedEntries.m)
+	}
+	decodedEntries.m[*cacheKey] = e
+	decodedEntries.Unlock()
+	return e, migrated, nil
+}
+
+// Pauses Valkey after consecutive errors, the memory cache and live lookups take over meanwhile
+var (
+	valkeyBreaker circuitBreaker
+	valkeyDown    atomic.Bool
+)
+
+// Whether Valkey may be queried, false while its circuit breaker is open
+func valkeyAvailable() bool {
+	config := getConfig()
+	return config.Redis.BreakerThreshold == 0 || valkeyBreaker.Allow()
+}
+
+// Feeds the outcome of a Valkey command to its circuit breaker, replies like nil or WRONGTYPE count as success
+func valkeyResult(err error) {
+	config := getConfig()
+	if config.Redis.BreakerThreshold == 0 {
+		return
+	}
+	var reply *valkey.ValkeyError
+	if err == nil || errors.As(err, &reply) {
+		if valkeyDown.CompareAndSwap(true, false) {
+			log.Info("Valkey is reachable again")
+		}
+		valkeyBreaker.Success()
+		return
+	}
+	threshold := config.Redis.BreakerThreshold
+	window := time.Duration(config.Redis.BreakerWindow) * time.Second
+	cooldown := time.Duration(config.Redis.BreakerCooldown) * time.Second
+	if valkeyBreaker.Failure(threshold, window, cooldown) && !valkeyDown.Swap(true) {
+		log.Warnf("Valkey failed %d times in a row (%v), using the memory cache for %ds", threshold, err, config.Redis.BreakerCooldown)
+	}
+}
+
+func cacheEntryGet(cacheKey *string) (*cacheEntry, uint32, error) {
+	config := getConfig()
+	db := getDbClient()
+	if config.Redis.Disable || db == nil || !valkeyAvailable() {
+		return memCacheEntryGet(cacheKey)
+	}
+	jsonData, err := db.Cache(CACHE_MIN_TTL*time.Second).Get(bgCtx, *cacheKey).Result()
+	valkeyResult(err)
+	if err != nil {
+		// Fall back to the memory cache while Valkey is unreachable
+		if err != valkey.Nil {
+			if e, ttl, err := memCacheEntryGet(cacheKey); err == nil {
+				return e, ttl, nil
+			}
+		}
+		return nil, 0, err
+	}
+
+	ttl, err := db.Cache(CACHE_MIN_TTL*time.Second).TTL(bgCtx, *cacheKey).Result()
+	valkeyResult(err)
+	if err != nil {
+		log.Warnf("Error getting TTL: %v", err)
+		return nil, 0, err
+	}
+
+	e, migrated, err := decodeCacheEntry(cacheKey, jsonData)
+	if err != nil {
+		return nil, 0, err
+	}
+	if migrated {
+		if data, err := json.Marshal(e.data); err == nil {
+			db.Set(bgCtx, *cacheKey, data, valkeycompat.KeepTTL)
+		}
+	}
+
+	return e, uint32(ttl.Seconds()), nil
+}
+
+// Prefix of all cache keys, led by redis.namespace so that instances sharing a DB never see each other's keys
+func cacheKeyPrefix() string {
+	config := getConfig()
+	if len(config.Redis.Namespace) == 0 {
+		return CACHE_KEY_PREFIX
+	}
+	return config.Redis.Namespace + ":" + CACHE_KEY_PREFIX
+}
+
+func cacheJsonGet(cacheKey *string) (CacheStruct, uint32, error) {
+	e, ttl, err := cacheEntryGet(cacheKey)
+	if err != nil {
+		return CacheStruct{}, 0, err
+	}
+	return e.data, ttl, nil
+}
+
+// Stores a cache entry, the expiry of policies that get prefetched is spread a little
+// while short-lived ones (e.g. TEMP) are kept for exactly their TTL
+func cacheJsonSet(cacheKey *string, data *CacheStruct) error {
+	var jitter uint32
+	if data.Ttl >= PREFETCH_MARGIN {
+		jitter = rand.Uint32N(60)
+	}
+	return cacheJsonSetTtl(cacheKey, data, time.Duration(data.Ttl+PREFETCH_MARGIN-jitter)*time.Second)
+}
+
+// Stores a cache entry that expires after ttl instead of the TTL of its policy
+func cacheJsonSetTtl(cacheKey *string, data *CacheStruct, ttl time.Duration) error {
+	config := getConfig()
+	db := getDbClient()
+	data.Schema = DB_SCHEMA
+	jsonData, err := json.Marshal(*data)
+	if err != nil {
+		return fmt.Errorf("Error marshaling JSON: %v", err)
+	}
+
+	if config.Redis.Disable || db == nil || !valkeyAvailable() {
+		memCacheEntrySet(cacheKey, data, ttl)
+		return nil
+	}
+	err = db.Set(bgCtx, *cacheKey, jsonData, ttl).Err()
+	valkeyResult(err)
+	if err != nil {
+		memCacheEntrySet(cacheKey, data, ttl)
+	}
+	return err
+}
+
+// Nothing prefetches the memory cache, so its entries expire with their policy instead of
+// PREFETCH_MARGIN later, but their TTL is reported like the one of Valkey entries
+func memCacheEntryGet(cacheKey *string) (*cacheEntry, uint32, error) {
+	e, ttl, ok := memCacheGet(*cacheKey)
+	if !ok {
+		return nil, 0, valkey.Nil
+	}
+	return e, ttl + PREFETCH_MARGIN, nil
+}
+
+func memCacheEntrySet(cacheKey *string, data *CacheStruct, ttl time.Duration) {
+	if ttl -= PREFETCH_MARGIN * time.Second; ttl > 0 {
+		memCacheSet(*cacheKey, *data, ttl)
+	}
+}
+
+// Keys of all cache entries in Valkey, without the schema version
+func cacheKeys() ([]string, error) {
+	db := getDbClient()
+	keys, err := db.Keys(bgCtx, cacheKeyPrefix()+"*").Result()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(keys, func(key string) bool {
+		return key == cacheKeyPrefix()+"schema"
+	}), nil
+}
+
+// Cached policies by kind of result (dane, dane-only, secure, TEMP, NOTFOUND, ...)
+type CacheStats struct {
+	Entries int            `json:"entries"`
+	Results map[string]int `json:"results"`
+	Schema  string         `json:"schema"`
+}
+
+func (s *CacheStats) add(result string) {
+	kind, _, _ := strings.Cut(result, " ")
+	if len(kind) == 0 {
+		kind = "NOTFOUND"
+	}
+	s.Entries++
+	s.Results[kind]++
+}
+
+// Counts the cached policies, in Valkey or in memory if Valkey is disabled
+func getCacheStats() (CacheStats, error) {
+	config := getConfig()
+	db := getDbClient()
+	stats := CacheStats{Results: make(map[string]int), Schema: DB_SCHEMA}
+	if config.Redis.Disable || db == nil {
+		for _, data := range memCacheEntries() {
+			stats.add(data.Result)
+		}
+		return stats, nil
+	}
+	schema, err := db.Get(bgCtx, cacheKeyPrefix()+"schema").Result()
+	if err != nil && err != valkey.Nil {
+		return stats, fmt.Errorf("Error getting schema: %v", err)
+	}
+	stats.Schema = schema
+	keys, err := cacheKeys()
+	if err != nil {
+		return stats, fmt.Errorf("Error fetching keys: %v", err)
+	}
+	for _, key := range keys {
+		// Entries may expire while counting
+		if data, _, err := cacheJsonGet(&key); err == nil {
+			stats.add(data.Result)
+		}
+	}
+	return stats, nil
+}
+
+// Removes the cached policies of a domain of all maps, returns whether any was cached
+func purgeDomain(domain string) (bool, error) {
+	config := getConfig()
+	db := getDbClient()
+	mtaStsCache.Lock()
+	delete(mtaStsCache.m, domain)
+	mtaStsCache.Unlock()
+	httpCacheDelete(domain)
+	purgeDnsCache(domain)
+	keys := []string{getMapCacheKey(&domain, MapCombined), getMapCacheKey(&domain, MapDane), getMapCacheKey(&domain, MapMtaSts)}
+	purged := false
+	for _, key := range keys {
+		if memCacheDelete(key) {
+			purged = true
+		}
+	}
+	if config.Redis.Disable || db == nil {
+		return purged, nil
+	}
+	n, err := db.Del(bgCtx, keys...).Result()
+	if err != nil {
+		return purged, fmt.Errorf("Error deleting keys: %v", err)
+	}
+	return purged || n != 0, nil
+}
+
+func purgeDatabase() error {
+	config := getConfig()
+	db := getDbClient()
+	if config.Redis.Disable {
+		return fmt.Errorf("Cache disabled")
+	}
+	keys, err := cacheKeys()
+	if err != nil {
+		return fmt.Errorf("Error fetching keys: %v", err)
+	}
+	for _, key := range keys {
+		db.Del(bgCtx, key).Err()
+	}
+	return db.Set(bgCtx, cacheKeyPrefix()+"schema", DB_SCHEMA, 0).Err()
+}
+
+// Line of a cache export, the remaining TTL is counted from Time
+type exportedEntry struct {
+	// Only informative, the import derives the key from the domain and map of the policy
+	Key  string      `json:"key"`
+	Ttl  uint32      `json:"ttl"`
+	Time int64       `json:"time"`
+	Data CacheStruct `json:"data"`
+}
+
+// Writes the cached policies as newline-delimited JSON, returns the number of entries
+func exportCache(w io.Writer) (int, error) {
+	config := getConfig()
+	db := getDbClient()
+	var keys []string
+	if config.Redis.Disable || db == nil {
+		keys = memCacheKeys()
+	} else {
+		var err error
+		if keys, err = cacheKeys(); err != nil {
+			return 0, fmt.Errorf("Error fetching keys: %v", err)
+		}
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	for _, key := range keys {
+		// Entries may expire while exporting
+		data, ttl, err := cacheJsonGet(&key)
+		if err != nil || ttl == 0 {
+			continue
+		}
+		if err := enc.Encode(exportedEntry{Key: key, Ttl: ttl, Time: time.Now().Unix(), Data: data}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Restores the cached policies of an export, keeping their expiry, returns the number of entries
+func importCache(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var e exportedEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("Invalid entry %d: %v", n+1, err)
+		}
+		if len(e.Data.Domain) == 0 {
+			return n, fmt.Errorf("Invalid entry %d without a domain", n+1)
+		}
+		// Time has passed since the export, skip entries that have expired meanwhile
+		remaining := int64(e.Ttl) - max(time.Now().Unix()-e.Time, 0)
+		if remaining <= 0 {
+			continue
+		}
+		// The export may come from another namespace or version, so the key is computed anew
+		key := getMapCacheKey(&e.Data.Domain, e.Data.Map)
+		if err := cacheJsonSetTtl(&key, &e.Data, time.Duration(remaining)*time.Second); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Exports the cache to a file for -export-cache
+func exportCacheFile(path string) error {
+	config := getConfig()
+	if config.Redis.Disable {
+		return fmt.Errorf("Cache disabled")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := exportCache(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		log.Infof("Exported %d cache entries to %s", n, path)
+	}
+	return err
+}
+
+// Imports the cache from a file written by -export-cache
+func importCacheFile(path string) error {
+	config := getConfig()
+	if config.Redis.Disable {
+		return fmt.Errorf("Cache disabled")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := importCache(f)
+	if err == nil {
+		log.Infof("Imported %d cache entries from %s", n, path)
+	}
+	return err
+}
+
+func updateDatabase() error {
+	db := getDbClient()
+	currentSchema, err := db.Get(bgCtx, cacheKeyPrefix()+"schema").Result()
+	if err != nil && err != valkey.Nil {
+		return fmt.Errorf("Error getting schema from Valkey (Redis): %v", err)
+	}
+
+	// Check if the schema matches, else migrate or clear the database
+	if currentSchema != DB_SCHEMA {
+		if len(currentSchema) != 0 && canMigrate(currentSchema) {
+			log.Infof("Upgrading cache schema from %s to %s, entries are migrated on access", currentSchema, DB_SCHEMA)
+			return db.Set(bgCtx, cacheKeyPrefix()+"schema", DB_SCHEMA, 0).Err()
+		}
+		return purgeDatabase()
+	}
+
+	return nil
+}
@@ -6,7 +6,17 @@
 package tlspol
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
 	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
 	"gopkg.in/yaml.v3"
@@ -15,9 +25,24 @@ import (
 var defaultConfig = Config{}
 
 type ServerConfig struct {
-	Address  string `yaml:"address"`
-	TlsRpt   bool   `yaml:"tlsrpt"`
-	Prefetch bool   `yaml:"prefetch"`
+	Address         string `yaml:"address"`
+	TlsRpt          bool   `yaml:"tlsrpt"`
+	Prefetch        bool   `yaml:"prefetch"`
+	VerboseVerdicts bool   `yaml:"verbose_verdicts"`
+	MemoizeWindow   uint32 `yaml:"memoize_window"`
+	ListenBacklog   uint32 `yaml:"listen_backlog"`
+	ReuseAddr       bool   `yaml:"reuse_addr"`
+	ReusePort       bool   `yaml:"reuse_port"`
+	MaxConcurrent   uint32 `yaml:"max_concurrent"`
+	MapName         string `yaml:"map_name"`
+	Network         string `yaml:"network"`
+	AnnotateSource  bool   `yaml:"annotate_source"`
+	MaxReplySize    uint32 `yaml:"max_reply_size"`
+	RateLimit       uint32 `yaml:"rate_limit"`
+	SocketMode      string `yaml:"socket_mode"`
+	SocketOwner     string `yaml:"socket_owner"`
+	SocketGroup     string `yaml:"socket_group"`
+	ConnTimeout     uint32 `yaml:"conn_timeout"`
 }
 
 func (c *ServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -25,6 +50,21 @@ func (c *ServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	c.Address = defaultConfig.Server.Address
 	c.TlsRpt = defaultConfig.Server.TlsRpt
 	c.Prefetch = defaultConfig.Server.Prefetch
+	c.VerboseVerdicts = defaultConfig.Server.VerboseVerdicts
+	c.MemoizeWindow = defaultConfig.Server.MemoizeWindow
+	c.ListenBacklog = defaultConfig.Server.ListenBacklog
+	c.ReuseAddr = defaultConfig.Server.ReuseAddr
+	c.ReusePort = defaultConfig.Server.ReusePort
+	c.MaxConcurrent = defaultConfig.Server.MaxConcurrent
+	c.MapName = defaultConfig.Server.MapName
+	c.Network = defaultConfig.Server.Network
+	c.AnnotateSource = defaultConfig.Server.AnnotateSource
+	c.MaxReplySize = defaultConfig.Server.MaxReplySize
+	c.RateLimit = defaultConfig.Server.RateLimit
+	c.SocketMode = defaultConfig.Server.SocketMode
+	c.SocketOwner = defaultConfig.Server.SocketOwner
+	c.SocketGroup = defaultConfig.Server.SocketGroup
+	c.ConnTimeout = defaultConfig.Server.ConnTimeout
 	type alias ServerConfig
 	if err := unmarshal((*alias)(c)); err != nil {
 		return err
@@ -33,12 +73,26 @@ func (c *ServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type DnsConfig struct {
-	Address string `yaml:"address"`
+	Address       string   `yaml:"address"`
+	Addresses     []string `yaml:"addresses"`
+	Protocol      string   `yaml:"protocol"`
+	TlsServerName string   `yaml:"tls_server_name"`
+	CacheSize     uint32   `yaml:"cache_size"`
+	RequireDnssec bool     `yaml:"require_dnssec"`
+	EdnsBuffer    uint16   `yaml:"edns_buffer"`
+	Retries       uint32   `yaml:"retries"`
 }
 
 func (c *DnsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// Set default values
 	c.Address = defaultConfig.Dns.Address
+	c.Addresses = slices.Clone(defaultConfig.Dns.Addresses)
+	c.Protocol = defaultConfig.Dns.Protocol
+	c.TlsServerName = defaultConfig.Dns.TlsServerName
+	c.CacheSize = defaultConfig.Dns.CacheSize
+	c.RequireDnssec = defaultConfig.Dns.RequireDnssec
+	c.EdnsBuffer = defaultConfig.Dns.EdnsBuffer
+	c.Retries = defaultConfig.Dns.Retries
 	type alias DnsConfig
 	if err := unmarshal((*alias)(c)); err != nil {
 		return err
@@ -46,11 +100,233 @@ func (c *DnsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+type DaneConfig struct {
+	Enable              bool    `yaml:"enable"`
+	VerifyMxAddressable bool    `yaml:"verify_mx_addressable"`
+	AddressFamily       string  `yaml:"address_family"`
+	Mode                string  `yaml:"mode"`
+	Port                uint16  `yaml:"port"`
+	TlsaConcurrency     uint32  `yaml:"tlsa_concurrency"`
+	VerifyLive          bool    `yaml:"verify_live"`
+	MatchingTypes       []uint8 `yaml:"matching_types"`
+}
+
+func (c *DaneConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Enable = defaultConfig.Dane.Enable
+	c.VerifyMxAddressable = defaultConfig.Dane.VerifyMxAddressable
+	c.AddressFamily = defaultConfig.Dane.AddressFamily
+	c.Mode = defaultConfig.Dane.Mode
+	c.Port = defaultConfig.Dane.Port
+	c.TlsaConcurrency = defaultConfig.Dane.TlsaConcurrency
+	c.VerifyLive = defaultConfig.Dane.VerifyLive
+	c.MatchingTypes = slices.Clone(defaultConfig.Dane.MatchingTypes)
+	type alias DaneConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type MtaStsConfig struct {
+	Enable           bool   `yaml:"enable"`
+	BreakerThreshold uint32 `yaml:"breaker_threshold"`
+	BreakerWindow    uint32 `yaml:"breaker_window"`
+	BreakerCooldown  uint32 `yaml:"breaker_cooldown"`
+	MaxBodyBytes     uint32 `yaml:"max_body_bytes"`
+	HonorTesting     bool   `yaml:"honor_testing"`
+	MaxAgeCap        uint32 `yaml:"max_age_cap"`
+	FetchTimeout     uint32 `yaml:"fetch_timeout"`
+}
+
+func (c *MtaStsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Enable = defaultConfig.MtaSts.Enable
+	c.BreakerThreshold = defaultConfig.MtaSts.BreakerThreshold
+	c.BreakerWindow = defaultConfig.MtaSts.BreakerWindow
+	c.BreakerCooldown = defaultConfig.MtaSts.BreakerCooldown
+	c.MaxBodyBytes = defaultConfig.MtaSts.MaxBodyBytes
+	c.HonorTesting = defaultConfig.MtaSts.HonorTesting
+	c.MaxAgeCap = defaultConfig.MtaSts.MaxAgeCap
+	c.FetchTimeout = defaultConfig.MtaSts.FetchTimeout
+	type alias MtaStsConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type TlsRptConfig struct {
+	MaxTtl       uint32 `yaml:"max_ttl"`
+	Endpoint     string `yaml:"endpoint"`
+	Interval     uint32 `yaml:"interval"`
+	Organization string `yaml:"organization"`
+	Contact      string `yaml:"contact"`
+}
+
+func (c *TlsRptConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.MaxTtl = defaultConfig.TlsRpt.MaxTtl
+	c.Endpoint = defaultConfig.TlsRpt.Endpoint
+	c.Interval = defaultConfig.TlsRpt.Interval
+	c.Organization = defaultConfig.TlsRpt.Organization
+	c.Contact = defaultConfig.TlsRpt.Contact
+	type alias TlsRptConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type PolicyConfig struct {
+	ListsFile   string            `yaml:"lists_file"`
+	Overrides   map[string]string `yaml:"overrides"`
+	Allowlist   []string          `yaml:"allowlist"`
+	Denylist    []string          `yaml:"denylist"`
+	Prefer      string            `yaml:"prefer"`
+	SpecialTlds []string          `yaml:"special_tlds"`
+}
+
+func (c *PolicyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.ListsFile = defaultConfig.Policy.ListsFile
+	c.Overrides = maps.Clone(defaultConfig.Policy.Overrides)
+	c.Allowlist = slices.Clone(defaultConfig.Policy.Allowlist)
+	c.Denylist = slices.Clone(defaultConfig.Policy.Denylist)
+	c.Prefer = defaultConfig.Policy.Prefer
+	c.SpecialTlds = slices.Clone(defaultConfig.Policy.SpecialTlds)
+	type alias PolicyConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type MetricsConfig struct {
+	Address string `yaml:"address"`
+}
+
+func (c *MetricsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Address = defaultConfig.Metrics.Address
+	type alias MetricsConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type HttpConfig struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+}
+
+func (c *HttpConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Address = defaultConfig.Http.Address
+	c.Token = defaultConfig.Http.Token
+	type alias HttpConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+func (c *LogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Level = defaultConfig.Log.Level
+	c.Format = defaultConfig.Log.Format
+	type alias LogConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type CacheConfig struct {
+	MemoryEntries uint32 `yaml:"memory_entries"`
+	NotFoundTtl   uint32 `yaml:"notfound_ttl"`
+	TempTtl       uint32 `yaml:"temp_ttl"`
+	MinTtl        uint32 `yaml:"min_ttl"`
+}
+
+func (c *CacheConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.MemoryEntries = defaultConfig.Cache.MemoryEntries
+	c.NotFoundTtl = defaultConfig.Cache.NotFoundTtl
+	c.TempTtl = defaultConfig.Cache.TempTtl
+	c.MinTtl = defaultConfig.Cache.MinTtl
+	type alias CacheConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type PrefetchConfig struct {
+	Concurrency   uint32   `yaml:"concurrency"`
+	Interval      uint32   `yaml:"interval"`
+	Rate          uint32   `yaml:"rate"`
+	StartupJitter uint32   `yaml:"startup_jitter"`
+	Exclude       []string `yaml:"exclude"`
+}
+
+func (c *PrefetchConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.Concurrency = defaultConfig.Prefetch.Concurrency
+	c.Interval = defaultConfig.Prefetch.Interval
+	c.Rate = defaultConfig.Prefetch.Rate
+	c.StartupJitter = defaultConfig.Prefetch.StartupJitter
+	c.Exclude = slices.Clone(defaultConfig.Prefetch.Exclude)
+	type alias PrefetchConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type StartupConfig struct {
+	SelfTest         bool   `yaml:"selftest"`
+	SelfTestDomain   string `yaml:"selftest_domain"`
+	SelfTestRequired bool   `yaml:"selftest_required"`
+}
+
+func (c *StartupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Set default values
+	c.SelfTest = defaultConfig.Startup.SelfTest
+	c.SelfTestDomain = defaultConfig.Startup.SelfTestDomain
+	c.SelfTestRequired = defaultConfig.Startup.SelfTestRequired
+	type alias StartupConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	return nil
+}
+
 type RedisConfig struct {
 	Disable  bool   `yaml:"disable"`
 	Address  string `yaml:"address"`
 	Password string `yaml:"password"`
 	DB       int    `yaml:"db"`
+
+	Namespace string `yaml:"namespace"`
+
+	SentinelMaster string `yaml:"sentinel_master"`
+
+	Tls           bool   `yaml:"tls"`
+	TlsSkipVerify bool   `yaml:"tls_skip_verify"`
+	TlsCa         string `yaml:"tls_ca"`
+	TlsCert       string `yaml:"tls_cert"`
+	TlsKey        string `yaml:"tls_key"`
+
+	BreakerThreshold uint32 `yaml:"breaker_threshold"`
+	BreakerWindow    uint32 `yaml:"breaker_window"`
+	BreakerCooldown  uint32 `yaml:"breaker_cooldown"`
 }
 
 func (c *RedisConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -59,6 +335,16 @@ func (c *RedisConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	c.Address = defaultConfig.Redis.Address
 	c.Password = defaultConfig.Redis.Password
 	c.DB = defaultConfig.Redis.DB
+	c.Namespace = defaultConfig.Redis.Namespace
+	c.SentinelMaster = defaultConfig.Redis.SentinelMaster
+	c.Tls = defaultConfig.Redis.Tls
+	c.TlsSkipVerify = defaultConfig.Redis.TlsSkipVerify
+	c.TlsCa = defaultConfig.Redis.TlsCa
+	c.TlsCert = defaultConfig.Redis.TlsCert
+	c.TlsKey = defaultConfig.Redis.TlsKey
+	c.BreakerThreshold = defaultConfig.Redis.BreakerThreshold
+	c.BreakerWindow = defaultConfig.Redis.BreakerWindow
+	c.BreakerCooldown = defaultConfig.Redis.BreakerCooldown
 	type alias RedisConfig
 	if err := unmarshal((*alias)(c)); err != nil {
 		return err
@@ -67,9 +353,19 @@ func (c *RedisConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type Config struct {
-	Server ServerConfig `yaml:"server"`
-	Dns    DnsConfig    `yaml:"dns"`
-	Redis  RedisConfig  `yaml:"redis"`
+	Server   ServerConfig   `yaml:"server"`
+	Dns      DnsConfig      `yaml:"dns"`
+	Dane     DaneConfig     `yaml:"dane"`
+	MtaSts   MtaStsConfig   `yaml:"mtasts"`
+	TlsRpt   TlsRptConfig   `yaml:"tlsrpt"`
+	Policy   PolicyConfig   `yaml:"policy"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Http     HttpConfig     `yaml:"http"`
+	Log      LogConfig      `yaml:"log"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Prefetch PrefetchConfig `yaml:"prefetch"`
+	Startup  StartupConfig  `yaml:"startup"`
+	Redis    RedisConfig    `yaml:"redis"`
 }
 
 func SetDefaultConfig(data *[]byte) {
@@ -78,13 +374,225 @@ func SetDefaultConfig(data *[]byte) {
 	}
 }
 
+// Copies c without sharing its slices and maps, so that changes to the copy leave c alone
+func cloneConfig(c *Config) Config {
+	clone := *c
+	clone.Dns.Addresses = slices.Clone(c.Dns.Addresses)
+	clone.Dane.MatchingTypes = slices.Clone(c.Dane.MatchingTypes)
+	clone.Policy.Overrides = maps.Clone(c.Policy.Overrides)
+	clone.Policy.Allowlist = slices.Clone(c.Policy.Allowlist)
+	clone.Policy.Denylist = slices.Clone(c.Policy.Denylist)
+	clone.Policy.SpecialTlds = slices.Clone(c.Policy.SpecialTlds)
+	clone.Prefetch.Exclude = slices.Clone(c.Prefetch.Exclude)
+	return clone
+}
+
+// Reads the config.yaml, or starts from the defaults if it does not exist, then applies
+// the environment variables on top
 func loadConfig(filename string) (Config, error) {
+	var config Config
 	data, err := os.ReadFile(filename)
-	if err != nil {
-		config := defaultConfig
+	if errors.Is(err, fs.ErrNotExist) {
+		config = cloneConfig(&defaultConfig)
+	} else if err != nil {
+		return cloneConfig(&defaultConfig), err
+	} else if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	if err := applyEnvOverrides(&config); err != nil {
 		return config, err
 	}
+	config.Dns.Address = withDefaultPort(config.Dns.Address, "53")
+	for i, addr := range config.Dns.Addresses {
+		config.Dns.Addresses[i] = withDefaultPort(addr, "53")
+	}
+	if addr := config.Server.Address; len(addr) != 0 && !strings.HasPrefix(addr, "unix:") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return config, fmt.Errorf("Invalid server.address %q, expected host:port or unix:path", addr)
+		}
+	}
+	return config, nil
+}
 
-	var config Config
-	return config, yaml.Unmarshal(data, &config)
+// Sets each setting from TLSPOL_<SECTION>_<KEY> if present, e. g. TLSPOL_DNS_ADDRESS for
+// dns.address. Lists are separated by commas, maps are given in YAML flow style.
+func applyEnvOverrides(c *Config) error {
+	if env, ok := os.LookupEnv("TLSPOL_PREFETCH"); ok {
+		c.Server.Prefetch = env == "1"
+	}
+	if env, ok := os.LookupEnv("TLSPOL_TLSRPT"); ok {
+		c.Server.TlsRpt = env == "1"
+	}
+	if env, ok := os.LookupEnv("TLSPOL_LOGLEVEL"); ok {
+		c.Log.Level = env
+	}
+
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			key := section.Type().Field(j).Tag.Get("yaml")
+			name := "TLSPOL_" + strings.ToUpper(sectionName+"_"+key)
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setFromEnv(section.Field(j), env); err != nil {
+				return fmt.Errorf("Invalid %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setFromEnv(field reflect.Value, env string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(env, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		n, err := strconv.ParseUint(env, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		list := reflect.Zero(field.Type())
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				elem := reflect.New(field.Type().Elem()).Elem()
+				if err := setFromEnv(elem, item); err != nil {
+					return err
+				}
+				list = reflect.Append(list, elem)
+			}
+		}
+		field.Set(list)
+	default:
+		// Replaced rather than merged with the map of config.yaml
+		v := reflect.New(field.Type())
+		if err := yaml.Unmarshal([]byte(env), v.Interface()); err != nil {
+			return err
+		}
+		field.Set(v.Elem())
+	}
+	return nil
+}
+
+// Appends port to an address without one, as the DNS client needs host:port
+func withDefaultPort(addr string, port string) string {
+	if len(addr) == 0 {
+		return addr
+	}
+	if net.ParseIP(addr) != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil && strings.Contains(err.Error(), "missing port") {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+// Rejects values that would otherwise silently fall back to defaults
+func validateConfig(c *Config) error {
+	if len(c.Dns.Address) == 0 && len(c.Dns.Addresses) == 0 {
+		return errors.New("dns.address is empty")
+	}
+	checks := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"server.network", c.Server.Network, []string{"", "tcp", "tcp4", "tcp6"}},
+		{"dns.protocol", c.Dns.Protocol, []string{"", "udp", "tcp", "tcp-tls"}},
+		{"dane.address_family", c.Dane.AddressFamily, []string{"", "any", "ipv4", "ipv6"}},
+		{"dane.mode", c.Dane.Mode, []string{"", "strict", "partial"}},
+		{"policy.prefer", c.Policy.Prefer, []string{"", "dane", "mtasts"}},
+		{"log.level", strings.ToLower(c.Log.Level), []string{"", "debug", "info", "warn", "warning", "error"}},
+		{"log.format", c.Log.Format, []string{"", "text", "json"}},
+	}
+	for _, check := range checks {
+		if !slices.Contains(check.allowed, check.value) {
+			return fmt.Errorf("Invalid %s: %q", check.name, check.value)
+		}
+	}
+	if _, err := compilePolicyLists(&PolicyListsFile{Overrides: c.Policy.Overrides, Allowlist: c.Policy.Allowlist, Denylist: c.Policy.Denylist}); err != nil {
+		return fmt.Errorf("Invalid policy.%v", err)
+	}
+	for _, t := range c.Dane.MatchingTypes {
+		if t > 2 {
+			return fmt.Errorf("Invalid dane.matching_types entry %d, expected 0, 1 or 2", t)
+		}
+	}
+	if domain := c.Startup.SelfTestDomain; len(domain) != 0 && !isValidDomain(strings.ToLower(strings.TrimSuffix(domain, "."))) {
+		return fmt.Errorf("Invalid startup.selftest_domain %q", domain)
+	}
+	for _, tld := range c.Policy.SpecialTlds {
+		if !isValidDomain(strings.ToLower(strings.TrimPrefix(tld, "."))) {
+			return fmt.Errorf("Invalid policy.special_tlds entry %q", tld)
+		}
+	}
+	// Used in KEYS patterns, so no glob characters
+	if strings.ContainsFunc(c.Redis.Namespace, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+	}) {
+		return fmt.Errorf("Invalid redis.namespace %q, only letters, digits, '-', '_' and '.' are allowed", c.Redis.Namespace)
+	}
+	if strings.ContainsFunc(c.Server.MapName, unicode.IsSpace) {
+		return fmt.Errorf("Invalid server.map_name %q, must be a single word", c.Server.MapName)
+	}
+	if _, err := parseSocketMode(c.Server.SocketMode); err != nil {
+		return err
+	}
+	type address struct{ name, value string }
+	addresses := []address{{"dns.address", c.Dns.Address}, {"metrics.address", c.Metrics.Address}, {"http.address", c.Http.Address}}
+	for _, addr := range c.Dns.Addresses {
+		addresses = append(addresses, address{"dns.addresses", addr})
+	}
+	if !strings.HasPrefix(c.Server.Address, "unix:") {
+		addresses = append(addresses, address{"server.address", c.Server.Address})
+	}
+	for _, addr := range addresses {
+		if len(addr.value) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr.value); err != nil {
+			return fmt.Errorf("Invalid %s %q, expected host:port", addr.name, addr.value)
+		}
+	}
+	return nil
+}
+
+// Loads and validates a configuration like the daemon would, including the connection to Valkey
+func checkConfig(filename string) error {
+	c, err := loadConfig(filename)
+	if err != nil {
+		return err
+	}
+	if len(c.Server.Address) == 0 {
+		return errors.New("server.address is empty")
+	}
+	if err := validateConfig(&c); err != nil {
+		return err
+	}
+	if !c.Redis.Disable {
+		client, err := newValkeyClient(&c.Redis)
+		if err != nil {
+			return fmt.Errorf("Could not connect to Valkey (Redis): %v", err)
+		}
+		client.Close()
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package tlspol
 
 import (
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 )
 
@@ -10,3 +13,145 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("File configs/config.example.yaml is not parseable: %v", err)
 	}
 }
+
+func TestNegativeTtl(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(filename, []byte("cache:\n  min_ttl: -5\n"), 0o600)
+	if _, err := loadConfig(filename); err == nil {
+		t.Error("Expected a negative cache.min_ttl to be rejected")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"valid", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", true},
+		{"unix socket", "server:\n  address: unix:/run/tlspol.sock\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", true},
+		{"socket mode", "server:\n  address: unix:/run/tlspol.sock\n  socket_mode: \"0660\"\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", true},
+		{"bad socket mode", "server:\n  address: unix:/run/tlspol.sock\n  socket_mode: \"0999\"\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", false},
+		{"matching types", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\ndane:\n  matching_types: [1, 2]\nredis:\n  disable: true\n", true},
+		{"bad matching type", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\ndane:\n  matching_types: [3]\nredis:\n  disable: true\n", false},
+		{"selftest domain", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\nstartup:\n  selftest: true\n  selftest_domain: \"not a domain\"\nredis:\n  disable: true\n", false},
+		{"namespace", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n  namespace: prod-1\n", true},
+		{"bad namespace", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n  namespace: \"dev*\"\n", false},
+		{"missing server address", "dns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", false},
+		{"bad server address", "server:\n  address: localhost\ndns:\n  address: 127.0.0.53:53\nredis:\n  disable: true\n", false},
+		{"bad dns address", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53:53\nredis:\n  disable: true\n", false},
+		{"bad dns addresses", "server:\n  address: 127.0.0.1:8642\ndns:\n  addresses: [127.0.0.53:53, 9.9.9.9:53:53]\nredis:\n  disable: true\n", false},
+		{"bad protocol", "server:\n  address: 127.0.0.1:8642\ndns:\n  address: 127.0.0.53:53\n  protocol: carrier-pigeon\nredis:\n  disable: true\n", false},
+		{"unparseable", "server: [\n", false},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "config.yaml")
+		os.WriteFile(filename, []byte(tt.yaml), 0o600)
+		err := checkConfig(filename)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected a valid configuration, got %v", tt.name, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("%s: expected the configuration to be rejected", tt.name)
+		}
+	}
+	if err := checkConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected a missing file without environment variables to be rejected")
+	}
+}
+
+func TestDnsAddressPort(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(filename, []byte("dns:\n  address: 1.1.1.1\n  addresses: [\"9.9.9.9\", \"2620:fe::fe\", \"dns.quad9.net\", \"[2620:fe::9]:853\"]\n"), 0o600)
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dns.Address != "1.1.1.1:53" {
+		t.Errorf("Expected :53 to be appended to dns.address, got %q", c.Dns.Address)
+	}
+	expected := []string{"9.9.9.9:53", "[2620:fe::fe]:53", "dns.quad9.net:53", "[2620:fe::9]:853"}
+	if !slices.Equal(c.Dns.Addresses, expected) {
+		t.Errorf("Expected dns.addresses %v, got %v", expected, c.Dns.Addresses)
+	}
+
+	os.WriteFile(filename, []byte("server:\n  address: localhost\n"), 0o600)
+	if _, err := loadConfig(filename); err == nil {
+		t.Error("Expected server.address without a port to be rejected")
+	}
+}
+
+func TestDefaultConfigUnchanged(t *testing.T) {
+	prev := defaultConfig
+	defer func() { defaultConfig = prev }()
+	defaultConfig.Dns.Addresses = []string{"9.9.9.9"}
+	defaultConfig.Policy.Overrides = map[string]string{"default.example": "dane"}
+
+	c, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.Dns.Addresses, []string{"9.9.9.9:53"}) {
+		t.Errorf("Unexpected dns.addresses %v", c.Dns.Addresses)
+	}
+
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(filename, []byte("dns:\n  address: 1.1.1.1\npolicy:\n  overrides:\n    file.example: dane-only\n"), 0o600)
+	if c, err = loadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if c.Policy.Overrides["file.example"] != "dane-only" || !slices.Equal(c.Dns.Addresses, []string{"9.9.9.9:53"}) {
+		t.Errorf("Unexpected settings: %+v %+v", c.Dns, c.Policy)
+	}
+	if !slices.Equal(defaultConfig.Dns.Addresses, []string{"9.9.9.9"}) || len(defaultConfig.Policy.Overrides) != 1 {
+		t.Errorf("Expected the defaults to be left alone, got %v %v", defaultConfig.Dns.Addresses, defaultConfig.Policy.Overrides)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("TLSPOL_SERVER_ADDRESS", "0.0.0.0:8642")
+	t.Setenv("TLSPOL_DNS_ADDRESS", "9.9.9.9")
+	t.Setenv("TLSPOL_DNS_ADDRESSES", "1.1.1.1:53, 8.8.8.8")
+	t.Setenv("TLSPOL_DNS_REQUIRE_DNSSEC", "true")
+	t.Setenv("TLSPOL_DANE_PORT", "587")
+	t.Setenv("TLSPOL_DANE_MATCHING_TYPES", "1, 2")
+	t.Setenv("TLSPOL_POLICY_OVERRIDES", "{example.com: dane}")
+	t.Setenv("TLSPOL_REDIS_ADDRESS", "valkey:6379")
+	t.Setenv("TLSPOL_REDIS_DB", "2")
+	t.Setenv("TLSPOL_PREFETCH", "1")
+	t.Setenv("TLSPOL_MTASTS_ENABLE", "false")
+
+	c, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatalf("Expected the configuration to be read from the environment, got %v", err)
+	}
+	if c.Server.Address != "0.0.0.0:8642" || c.Dns.Address != "9.9.9.9:53" || !c.Dns.RequireDnssec {
+		t.Errorf("Unexpected server or dns settings: %+v %+v", c.Server, c.Dns)
+	}
+	if !slices.Equal(c.Dns.Addresses, []string{"1.1.1.1:53", "8.8.8.8:53"}) {
+		t.Errorf("Unexpected dns.addresses %v", c.Dns.Addresses)
+	}
+	if c.Dane.Port != 587 || !slices.Equal(c.Dane.MatchingTypes, []uint8{1, 2}) || c.Policy.Overrides["example.com"] != "dane" || !c.Server.Prefetch {
+		t.Errorf("Unexpected settings: %+v %+v %+v", c.Dane, c.Policy, c.Server)
+	}
+	if c.Redis.Address != "valkey:6379" || c.Redis.DB != 2 {
+		t.Errorf("Unexpected redis settings: %+v", c.Redis)
+	}
+	if c.MtaSts.Enable {
+		t.Error("Expected TLSPOL_MTASTS_ENABLE to disable MTA-STS")
+	}
+
+	// The environment takes precedence over the file
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(filename, []byte("server:\n  address: 127.0.0.1:1\ndns:\n  address: 127.0.0.53:53\n  cache_size: 10\n"), 0o600)
+	if c, err = loadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Address != "0.0.0.0:8642" || c.Dns.Address != "9.9.9.9:53" || c.Dns.CacheSize != 10 {
+		t.Errorf("Expected the environment to override the file, got %+v %+v", c.Server, c.Dns)
+	}
+
+	t.Setenv("TLSPOL_DANE_PORT", "smtp")
+	if _, err := loadConfig(filename); err == nil {
+		t.Error("Expected an invalid TLSPOL_DANE_PORT to be rejected")
+	}
+}
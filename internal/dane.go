@@ -6,12 +6,17 @@
 package tlspol
 
 import (
+	"cmp"
 	"context"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net"
 	"slices"
+	"strconv"
+	"strings"
 
 	valid "github.com/asaskevich/govalidator/v11"
 	"github.com/miekg/dns"
@@ -21,82 +26,247 @@ type ResultWithTtl struct {
 	Result string
 	Ttl    uint32
 	Err    error
+	Host   string
 }
 
-func getMxRecords(ctx *context.Context, domain *string) ([]string, uint32, error, bool) {
+var errDnssecNotValidated = errors.New("signed answer without AD bit, is the resolver validating DNSSEC?")
+
+// Whether a response can be trusted, signed answers without the AD bit mean the resolver does not validate
+func isValidated(r *dns.Msg) (bool, error) {
+	config := getConfig()
+	if r.MsgHdr.AuthenticatedData || !config.Dns.RequireDnssec {
+		return true, nil
+	}
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return false, errDnssecNotValidated
+		}
+	}
+	return false, nil
+}
+
+// Outcome of an MX lookup, telling apart why no MX hosts were found
+const (
+	MxFound    uint8 = iota // MX records exist, though all hosts may have been skipped
+	MxNone                  // the domain exists without MX records, so it is its own implicit MX
+	MxNxDomain              // the domain does not exist
+	MxNull                  // null MX, the domain accepts no mail
+)
+
+// Used when dane.port is unset
+const DANE_PORT = 25
+
+// Used when dane.tlsa_concurrency is unset
+const DANE_TLSA_CONCURRENCY = 8
+
+// Number of MX hosts whose TLSA records are looked up at once
+func tlsaConcurrency() int {
+	config := getConfig()
+	if config.Dane.TlsaConcurrency == 0 {
+		return DANE_TLSA_CONCURRENCY
+	}
+	return int(config.Dane.TlsaConcurrency)
+}
+
+type danePortKey struct{}
+
+// Looks up TLSA records for another port than dane.port, 0 keeps dane.port
+func withDanePort(ctx context.Context, port uint16) context.Context {
+	return context.WithValue(ctx, danePortKey{}, port)
+}
+
+// Port of the TLSA records to look up (see [RFC 7672, 2.2.3])
+func danePort(ctx *context.Context) uint16 {
+	config := getConfig()
+	if port, _ := (*ctx).Value(danePortKey{}).(uint16); port != 0 {
+		return port
+	}
+	return cmp.Or(config.Dane.Port, DANE_PORT)
+}
+
+// Splits a query of the form domain:port, the port is 0 if none is given
+func splitDanePort(query string) (string, uint16, bool) {
+	domain, p, found := strings.Cut(query, ":")
+	if !found {
+		return query, 0, true
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil || port == 0 {
+		return domain, 0, false
+	}
+	return domain, uint16(port), true
+}
+
+// MX host with the canonical name its TLSA records are looked up at first, empty if it is no alias
+type mxHost struct {
+	Name   string
+	Target string
+}
+
+// Names of the MX hosts, in the order of their preference
+func mxNames(hosts []mxHost) []string {
+	names := make([]string, len(hosts))
+	for i, host := range hosts {
+		names[i] = host.Name
+	}
+	return names
+}
+
+// Queries the MX records of a domain, sorted by their preference. A nonexistent domain is no error.
+func exchangeMx(ctx *context.Context, domain *string) (*dns.Msg, []*dns.MX, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(*domain), dns.TypeMX)
-	m.SetEdns0(1232, true)
+	setEdns0(m, true)
+
+	r, err := cachedExchange(ctx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, nil, errors.New(dns.RcodeToString[r.Rcode])
+	}
+	var mxs []*dns.MX
+	for _, answer := range r.Answer {
+		if mx, ok := answer.(*dns.MX); ok {
+			mxs = append(mxs, mx)
+		}
+	}
+	slices.SortStableFunc(mxs, func(a, b *dns.MX) int {
+		return int(a.Preference) - int(b.Preference)
+	})
+	return r, mxs, nil
+}
 
-	r, _, err := client.ExchangeContext(*ctx, m, config.Dns.Address)
+func getMxRecords(ctx *context.Context, domain *string) ([]mxHost, uint32, uint8, error, bool) {
+	r, mxs, err := exchangeMx(ctx, domain)
 	if err != nil {
-		return nil, 0, err, false
+		return nil, 0, MxFound, err, false
 	}
+	ev := getEvaluation(ctx)
 	incompl := false
-	switch r.Rcode {
-	case dns.RcodeSuccess, dns.RcodeNameError:
-		if !r.MsgHdr.AuthenticatedData {
-			incompl = true
+	secure, err := isValidated(r)
+	if err != nil {
+		return nil, 0, MxFound, err, false
+	}
+	if !secure {
+		incompl = true
+		ev.explainDane("MX records of %s are not DNSSEC-signed", *domain)
+	}
+
+	if len(mxs) == 0 {
+		ttl, _ := negativeTtl(r)
+		if r.Rcode == dns.RcodeNameError {
+			ev.explainDane("%s does not exist", *domain)
+			return nil, ttl, MxNxDomain, nil, incompl
 		}
-	default:
-		return nil, 0, errors.New(dns.RcodeToString[r.Rcode]), false
+		return nil, ttl, MxNone, nil, incompl
+	}
+	// Null MX, the domain does not accept mail (see [RFC 7505, 3])
+	if len(mxs) == 1 && mxs[0].Mx == "." {
+		log.Debugf("Domain %q has a null MX, skipping DANE", *domain)
+		ev.explainDane("%s has a null MX and accepts no mail", *domain)
+		return nil, mxs[0].Hdr.Ttl, MxNull, nil, false
 	}
 
-	var mxRecords []string
+	var mxRecords []mxHost
 	var ttls []uint32
-	for _, answer := range r.Answer {
-		if mx, ok := answer.(*dns.MX); ok {
-			if checkMx(ctx, &mx.Mx) != MxOk {
-				incompl = true
-				continue
-			}
-			mxRecords = append(mxRecords, mx.Mx)
-			ttls = append(ttls, mx.Hdr.Ttl)
+	for _, mx := range mxs {
+		if mx.Mx == "." {
+			continue
+		}
+		// A failed address lookup defers delivery, like any other DNS error (see [RFC 7672, 2.2.2])
+		ips, _, target, err := lookupMxAddresses(ctx, &mx.Mx)
+		if err != nil {
+			return nil, 0, MxFound, fmt.Errorf("%w at MX host %s", err, mx.Mx), false
+		}
+		if len(ips) == 0 {
+			incompl = true
+			ev.explainDane("MX host %s has no DNSSEC-signed address, it is skipped", mx.Mx)
+			continue
 		}
+		mxRecords = append(mxRecords, mxHost{Name: mx.Mx, Target: target})
+		ttls = append(ttls, mx.Hdr.Ttl)
 	}
 
-	return mxRecords, findMin(&ttls), nil, incompl
+	return mxRecords, findMin(&ttls), MxFound, nil, incompl
 }
 
-const (
-	MxOk uint8 = iota
-	MxFail
-	MxNotSec
-)
+func hasAnswer(r *dns.Msg, qtype uint16) bool {
+	for _, answer := range r.Answer {
+		if answer.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
 
-// Checks whether a specific MX record has DNSSEC-signed A/AAAA records
-func checkMx(ctx *context.Context, mx *string) uint8 {
+// Resolves the A and AAAA records of an MX host, or only those of types, failing on DNS errors and
+// CNAME loops. Only DNSSEC-validated addresses are returned, with the lowest TTL among them and the
+// canonical name they were found at, as TLSA records are only looked up at a securely expanded alias.
+func lookupMxAddresses(ctx *context.Context, mx *string, types ...uint16) ([]net.IP, uint32, string, error) {
 	if !valid.IsDNSName(*mx) {
-		return MxFail
+		return nil, 0, "", nil
+	}
+	if len(types) == 0 {
+		types = []uint16{dns.TypeA, dns.TypeAAAA}
 	}
-	types := []uint16{dns.TypeA, dns.TypeAAAA}
-	hasRecord := false
-ipCheck:
+	var ips []net.IP
+	var ttls []uint32
+	target := ""
 	for _, t := range types {
 		m := new(dns.Msg)
 		m.SetQuestion(dns.Fqdn(*mx), t)
-		m.SetEdns0(1232, true)
+		setEdns0(m, true)
 
-		r, _, err := client.ExchangeContext(*ctx, m, config.Dns.Address)
+		r, err := cachedExchange(ctx, m)
 		if err != nil {
-			return MxFail
+			return nil, 0, "", err
 		}
 		switch r.Rcode {
-		case dns.RcodeSuccess:
-			if r.MsgHdr.AuthenticatedData {
-				hasRecord = true
-				break ipCheck
-			}
+		case dns.RcodeSuccess, dns.RcodeNameError:
 		default:
+			return nil, 0, "", errors.New(dns.RcodeToString[r.Rcode])
+		}
+		name, err := followCnames(r, dns.Fqdn(*mx))
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if secure, _ := isValidated(r); !secure {
+			continue
+		}
+		if len(target) == 0 && hasAnswer(r, t) {
+			target = name
+		}
+		for _, answer := range r.Answer {
+			switch rr := answer.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+				ttls = append(ttls, rr.Hdr.Ttl)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+				ttls = append(ttls, rr.Hdr.Ttl)
+			}
 		}
 	}
-	if hasRecord {
-		return MxOk
+	return ips, findMin(&ttls), target, nil
+}
+
+// Checks whether an MX host has a DNSSEC-signed address in the configured family
+func isMxAddressable(ctx *context.Context, mx *string) (bool, error) {
+	config := getConfig()
+	var types []uint16
+	switch config.Dane.AddressFamily {
+	case "ipv4":
+		types = []uint16{dns.TypeA}
+	case "ipv6":
+		types = []uint16{dns.TypeAAAA}
 	}
-	return MxNotSec
+	ips, _, _, err := lookupMxAddresses(ctx, mx, types...)
+	return len(ips) != 0, err
 }
 
 func isTlsaUsable(r *dns.TLSA) bool {
+	config := getConfig()
 	if r.Usage != 3 && r.Usage != 2 {
 		return false
 	}
@@ -105,6 +275,10 @@ func isTlsaUsable(r *dns.TLSA) bool {
 		return false
 	}
 
+	if len(config.Dane.MatchingTypes) != 0 && !slices.Contains(config.Dane.MatchingTypes, r.MatchingType) {
+		return false
+	}
+
 	switch r.MatchingType {
 	case 1: // SHA-256
 		if !valid.IsSHA256(r.Certificate) {
@@ -130,24 +304,72 @@ func isTlsaUsable(r *dns.TLSA) bool {
 	return true
 }
 
-func checkTlsa(ctx *context.Context, mx *string) ResultWithTtl {
+// Longest CNAME chain of an MX host that is followed
+const MAX_CNAME_CHAIN = 8
+
+var errCnameLoop = errors.New("CNAME loop")
+
+// Follows the CNAMEs of name within an answer, DNAME redirections included as the CNAMEs
+// synthesized from them, returning errCnameLoop if the chain loops or is longer than MAX_CNAME_CHAIN
+func followCnames(r *dns.Msg, name string) (string, error) {
+	seen := []string{strings.ToLower(name)}
+	for {
+		i := slices.IndexFunc(r.Answer, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeCNAME && strings.EqualFold(rr.Header().Name, name)
+		})
+		if i < 0 {
+			return name, nil
+		}
+		name = r.Answer[i].(*dns.CNAME).Target
+		if slices.Contains(seen, strings.ToLower(name)) || len(seen) > MAX_CNAME_CHAIN {
+			return "", errCnameLoop
+		}
+		seen = append(seen, strings.ToLower(name))
+	}
+}
+
+func checkTlsa(ctx *context.Context, mx *mxHost) ResultWithTtl {
+	// TLSA records of an MX host that is an alias are looked up at its canonical name first,
+	// then at the name of the MX record (see [RFC 7672, 2.2.2])
+	if len(mx.Target) != 0 && !strings.EqualFold(mx.Target, dns.Fqdn(mx.Name)) {
+		res := lookupTlsa(ctx, &mx.Target)
+		if len(res.Result) != 0 || res.Err != nil {
+			return res
+		}
+	}
+	return lookupTlsa(ctx, &mx.Name)
+}
+
+// Looks up the TLSA records of a host, given by the MX record or its canonical name
+func lookupTlsa(ctx *context.Context, mx *string) ResultWithTtl {
+	config := getConfig()
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn("_25._tcp."+(*mx)), dns.TypeTLSA)
-	m.SetEdns0(1232, true)
+	m.SetQuestion(dns.Fqdn("_"+strconv.Itoa(int(danePort(ctx)))+"._tcp."+(*mx)), dns.TypeTLSA)
+	setEdns0(m, true)
 
-	r, _, err := client.ExchangeContext(*ctx, m, config.Dns.Address)
+	ev := getEvaluation(ctx)
+	r, err := cachedExchange(ctx, m)
 	if err != nil {
+		ev.failDane("TLSA lookup for MX host %s failed: %s", *mx, describeDnsError(err))
 		return ResultWithTtl{Result: "", Ttl: 0, Err: err}
 	}
 	switch r.Rcode {
 	case dns.RcodeSuccess, dns.RcodeNameError:
-		if !r.MsgHdr.AuthenticatedData {
+		secure, err := isValidated(r)
+		if err != nil {
+			ev.failDane("TLSA lookup for MX host %s failed: %s", *mx, describeDnsError(err))
+			return ResultWithTtl{Result: "", Ttl: 0, Err: err}
+		}
+		if !secure {
+			ev.explainDane("TLSA records of MX host %s are not DNSSEC-signed", *mx)
 			return ResultWithTtl{Result: "", Ttl: 0}
 		}
 	default:
+		ev.failDane("TLSA lookup for MX host %s failed: %s from resolver", *mx, dns.RcodeToString[r.Rcode])
 		return ResultWithTtl{Result: "", Ttl: 0, Err: errors.New(dns.RcodeToString[r.Rcode])}
 	}
 	if len(r.Answer) == 0 {
+		ev.explainDane("TLSA records are missing on MX host %s", *mx)
 		return ResultWithTtl{Result: "", Ttl: 0}
 	}
 
@@ -156,7 +378,15 @@ func checkTlsa(ctx *context.Context, mx *string) ResultWithTtl {
 	for _, answer := range r.Answer {
 		if tlsa, ok := answer.(*dns.TLSA); ok {
 			if isTlsaUsable(tlsa) {
+				if config.Dane.VerifyLive {
+					if err := verifyTlsaLive(ctx, mx, r.Answer); err != nil {
+						ev.failDane("Live verification of MX host %s failed: %s", *mx, describeDnsError(err))
+						return ResultWithTtl{Result: "", Ttl: 0, Err: err}
+					}
+					ev.explainDane("Certificate of MX host %s matches its TLSA records", *mx)
+				}
 				// TLSA records are usable, enforce DANE, return directly
+				ev.explainDane("MX host %s has usable TLSA records", *mx)
 				return ResultWithTtl{Result: "dane-only", Ttl: tlsa.Hdr.Ttl}
 			} else {
 				// let Postfix decide if DANE is possible, it downgrades to "encrypt" if not; continue searching
@@ -166,6 +396,11 @@ func checkTlsa(ctx *context.Context, mx *string) ResultWithTtl {
 		}
 	}
 
+	if len(result) != 0 {
+		ev.explainDane("TLSA records of MX host %s are unusable, Postfix decides whether DANE is possible", *mx)
+	} else {
+		ev.explainDane("TLSA records are missing on MX host %s", *mx)
+	}
 	return ResultWithTtl{Result: result, Ttl: findMin(&ttls)}
 }
 
@@ -175,24 +410,88 @@ const (
 	DaneOnly
 )
 
-func checkDane(ctx *context.Context, domain *string) (string, uint32) {
-	mxRecords, ttl, err, incompl := getMxRecords(ctx, domain)
+// Evaluates the DANE policy of a domain. Without a policy, the TTL is only set for a
+// negative MX answer, to cache it as long as the zone allows.
+func checkDane(ctx *context.Context, domain *string) (string, uint32, error) {
+	config := getConfig()
+	ev := getEvaluation(ctx)
+	mxRecords, ttl, mxStatus, err, incompl := getMxRecords(ctx, domain)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
-			log.Warnf("DNS error during MX lookup for %q: %v", *domain, err)
+			log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("DNS error during MX lookup for %q: %v", *domain, err)
+		}
+		ev.failDane("MX lookup failed: %s", describeDnsError(err))
+		return "TEMP", 0, err
+	}
+	// Without MX records, the domain itself is the mail host (see [RFC 7672, 2.2.1])
+	if mxStatus == MxNone && !incompl {
+		implicitMx := dns.Fqdn(*domain)
+		addrs, addrTtl, target, err := lookupMxAddresses(ctx, &implicitMx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("DNS error during address lookup for %q: %v", *domain, err)
+			}
+			ev.failDane("Address lookup of the implicit MX host %s failed: %s", *domain, describeDnsError(err))
+			return "TEMP", 0, err
+		}
+		if len(addrs) != 0 {
+			ev.explainDane("%s has no MX records, using the domain itself as implicit MX host", *domain)
+			mxRecords = []mxHost{{Name: implicitMx, Target: target}}
+			// The policy lasts only as long as the addresses of the implicit MX host
+			ttl = findMin(&[]uint32{ttl, addrTtl})
 		}
-		return "TEMP", 0
 	}
 	numRecords := len(mxRecords)
 	if numRecords == 0 {
-		return "", 0
+		ev.explainDane("No DNSSEC-signed MX host with a DNSSEC-signed address, DANE does not apply")
+		if mxStatus == MxNxDomain || mxStatus == MxNone {
+			return "", ttl, nil
+		}
+		return "", 0, nil
 	}
+	ev.setMxHosts(mxNames(mxRecords))
 
-	tlsaResults := make(chan ResultWithTtl)
+	if config.Dane.VerifyMxAddressable {
+		addressable := false
+		var lastErr error
+		for _, mx := range mxRecords {
+			ok, err := isMxAddressable(ctx, &mx.Name)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if ok {
+				addressable = true
+				break
+			}
+		}
+		if !addressable {
+			if lastErr != nil {
+				log.With(log.Fields{"domain": *domain, "error": lastErr.Error()}).Warnf("DNS error while checking MX addresses for %q: %v", *domain, lastErr)
+				ev.failDane("Address lookup of the MX hosts failed: %s", describeDnsError(lastErr))
+				return "TEMP", 0, lastErr
+			}
+			log.With(log.Fields{"domain": *domain}).Infof("No MX host of %q has an address in family %q, skipping DANE", *domain, config.Dane.AddressFamily)
+			ev.explainDane("No MX host has an address in family %s, DANE does not apply", config.Dane.AddressFamily)
+			return "", 0, nil
+		}
+	}
+
+	// Buffered, so the workers finish even if an error ends the aggregation early
+	tlsaResults := make(chan ResultWithTtl, numRecords)
+	hosts := make(chan mxHost, numRecords)
 	for _, mx := range mxRecords {
-		go func(mx string) {
-			tlsaResults <- checkTlsa(ctx, &mx)
-		}(mx)
+		hosts <- mx
+	}
+	close(hosts)
+	for range min(tlsaConcurrency(), numRecords) {
+		go func() {
+			for mx := range hosts {
+				res := checkTlsa(ctx, &mx)
+				res.Host = mx.Name
+				tlsaResults <- res
+			}
+		}()
 	}
 
 	var ttls []uint32
@@ -202,6 +501,7 @@ func checkDane(ctx *context.Context, domain *string) (string, uint32) {
 	if incompl {
 		pols = append(pols, NoDane)
 	}
+	var missing []string
 	for res := range tlsaResults {
 		i++
 		if i >= numRecords {
@@ -209,9 +509,9 @@ func checkDane(ctx *context.Context, domain *string) (string, uint32) {
 		}
 		if res.Err != nil {
 			if !errors.Is(err, context.Canceled) {
-				log.Warnf("DNS error during TLSA lookup for %q: %v", *domain, res.Err)
+				log.With(log.Fields{"domain": *domain, "error": res.Err.Error()}).Warnf("DNS error during TLSA lookup for %q: %v", *domain, res.Err)
 			}
-			return "TEMP", 0
+			return "TEMP", 0, res.Err
 		}
 		ttls = append(ttls, res.Ttl)
 		switch res.Result {
@@ -221,19 +521,35 @@ func checkDane(ctx *context.Context, domain *string) (string, uint32) {
 			pols = append(pols, Dane)
 		default:
 			pols = append(pols, NoDane)
+			ev.addNoTlsa(res.Host)
+			missing = append(missing, res.Host)
 		}
 	}
+	if len(missing) != 0 && len(missing) < numRecords {
+		slices.Sort(missing)
+		log.With(log.Fields{"domain": *domain, "mx_hosts": missing}).Infof("MX hosts of %q without usable TLSA records: %s", *domain, strings.Join(missing, ", "))
+	}
 
 	pol := ""
-	if findMax(&pols) >= Dane {
-		if findMin(&pols) <= Dane {
-			pol = "dane"
-		} else {
-			pol = "dane-only"
-		}
+	switch {
+	case findMax(&pols) < Dane:
+		ev.explainDane("No MX host has TLSA records, DANE does not apply")
+	case findMin(&pols) == DaneOnly:
+		pol = "dane-only"
+		ev.explainDane("All MX hosts have usable TLSA records, resulting in %q", pol)
+	case config.Dane.Mode == "partial" && findMax(&pols) == DaneOnly:
+		// Restrict delivery to the MX hosts with usable TLSA records
+		pol = "dane-only"
+		ev.explainDane("Not all MX hosts have usable TLSA records, resulting in %q (partial mode), only hosts with TLSA are used", pol)
+	default:
+		pol = "dane"
+		ev.explainDane("Not all MX hosts have usable TLSA records, resulting in %q", pol)
 	}
 
-	return pol, findMin(&ttls)
+	if len(pol) == 0 {
+		return "", 0, nil
+	}
+	return pol, findMin(&ttls), nil
 }
 
 func findMin[T uint8 | uint32](s *[]T) T {
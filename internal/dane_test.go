@@ -1,20 +1,34 @@
 package tlspol
 
 import (
+	"errors"
 	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"net"
+	"slices"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func init() {
-	config = Config{
+	activeConfig.Store(&Config{
 		Server: ServerConfig{},
 		Dns: DnsConfig{
-			Address: "dns.google:53",
+			Address:       "dns.google:53",
+			RequireDnssec: true,
+		},
+		Dane: DaneConfig{
+			Enable: true,
+		},
+		MtaSts: MtaStsConfig{
+			Enable: true,
 		},
 		Redis: RedisConfig{
 			Disable: true,
 		},
-	}
+	})
 }
 
 func TestDane(t *testing.T) {
@@ -29,7 +43,7 @@ func TestDane(t *testing.T) {
 					t.SkipNow()
 					return
 				}
-				policy, _ := checkDane(&bgCtx, &domain)
+				policy, _, _ := checkDane(&bgCtx, &domain)
 				if policy != "dane-only" {
 					t.Skipf("Expected DANE for %q, but not detected", domain)
 				} else if !passedOnce {
@@ -42,3 +56,444 @@ func TestDane(t *testing.T) {
 		t.Error("All tests failed.")
 	}
 }
+
+func TestMxAddressable(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"v6only.example. 300 IN MX 10 mx.v6only.example.",
+		"mx.v6only.example. 300 IN AAAA 2001:db8::25",
+		"_25._tcp.mx.v6only.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+	prev := config.Dane
+	defer func() { config.Dane = prev }()
+
+	domain := "v6only.example"
+	policy, _, _ := checkDane(&bgCtx, &domain)
+	if policy != "dane-only" {
+		t.Fatalf("Expected dane-only without address check, got %q", policy)
+	}
+
+	config.Dane.VerifyMxAddressable = true
+	config.Dane.AddressFamily = "ipv4"
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "" {
+		t.Errorf("Expected no policy without IPv4 addressable MX, got %q", policy)
+	}
+
+	config.Dane.AddressFamily = "ipv6"
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only with IPv6 addressable MX, got %q", policy)
+	}
+}
+
+func TestTlsaUsable(t *testing.T) {
+	sha256 := fakeTlsaDigest
+	sha512 := sha256 + sha256
+	tests := []struct {
+		usage, selector, matchingType uint8
+		certificate                   string
+		usable                        bool
+	}{
+		// PKIX-TA and PKIX-EE are not applicable to SMTP (see [RFC 7672, 3.1.3])
+		{0, 1, 1, sha256, false},
+		{1, 1, 1, sha256, false},
+		{2, 1, 1, sha256, true},
+		{3, 1, 1, sha256, true},
+		{3, 0, 2, sha512, true},
+		{4, 1, 1, sha256, false},
+		{255, 1, 1, sha256, false},
+		{3, 2, 1, sha256, false},
+		{3, 1, 255, sha256, false},
+		{3, 1, 1, sha512, false},
+		{3, 1, 2, sha256, false},
+		{3, 0, 0, "00", false},
+	}
+	for _, test := range tests {
+		r := &dns.TLSA{Usage: test.usage, Selector: test.selector, MatchingType: test.matchingType, Certificate: test.certificate}
+		if isTlsaUsable(r) != test.usable {
+			t.Errorf("Expected usable=%t for TLSA %d %d %d", test.usable, test.usage, test.selector, test.matchingType)
+		}
+	}
+}
+
+func TestUnusableTlsa(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"_25._tcp.pkix.example. 300 IN TLSA 1 1 1 "+fakeTlsaDigest,
+		"_25._tcp.reserved.example. 300 IN TLSA 3 1 255 "+fakeTlsaDigest,
+		"_25._tcp.mixed.example. 300 IN TLSA 0 1 1 "+fakeTlsaDigest,
+		"_25._tcp.mixed.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+
+	// Unusable records never enforce DANE, Postfix downgrades them to mandatory TLS (see [RFC 7672, 2.2])
+	for host, expected := range map[string]string{"pkix.example": "dane", "reserved.example": "dane", "mixed.example": "dane-only", "none.example": ""} {
+		if res := checkTlsa(&bgCtx, &mxHost{Name: host}); res.Result != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, host, res.Result)
+		}
+	}
+}
+
+func TestTlsaMatchingTypes(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"_25._tcp.sha256.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"_25._tcp.sha512.example. 300 IN TLSA 3 1 2 "+fakeTlsaDigest+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+	prev := config.Dane.MatchingTypes
+	defer func() { config.Dane.MatchingTypes = prev }()
+
+	config.Dane.MatchingTypes = []uint8{2}
+	sha256 := &dns.TLSA{Usage: 3, Selector: 1, MatchingType: 1, Certificate: fakeTlsaDigest}
+	if isTlsaUsable(sha256) {
+		t.Error("Expected matching type 1 to be unusable if only 2 is allowed")
+	}
+	// Records of excluded matching types are treated like other unusable ones
+	for host, expected := range map[string]string{"sha256.example": "dane", "sha512.example": "dane-only"} {
+		if res := checkTlsa(&bgCtx, &mxHost{Name: host}); res.Result != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, host, res.Result)
+		}
+	}
+
+	if err := validateConfig(&Config{Dns: DnsConfig{Address: "127.0.0.1:53"}, Dane: DaneConfig{MatchingTypes: []uint8{3}}}); err == nil {
+		t.Error("Expected matching type 3 to be rejected")
+	}
+}
+
+func TestRequireDnssec(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(false)
+	addDaneDomain(t, z, "unsigned.example")
+	z.Add(t,
+		"signed.example. 300 IN MX 10 mx.signed.example.",
+		"signed.example. 300 IN RRSIG MX 13 2 300 20300101000000 20200101000000 12345 signed.example. AAAA",
+	)
+	startFakeDns(t, z)
+	prev := config.Dns.RequireDnssec
+	defer func() { config.Dns.RequireDnssec = prev }()
+
+	unsigned := "unsigned.example"
+	if policy, _, err := checkDane(&bgCtx, &unsigned); policy != "" || err != nil {
+		t.Errorf("Expected no policy without AD bit, got %q (%v)", policy, err)
+	}
+	signed := "signed.example"
+	if policy, _, err := checkDane(&bgCtx, &signed); policy != "TEMP" || !errors.Is(err, errDnssecNotValidated) {
+		t.Errorf("Expected TEMP for a signed answer without AD bit, got %q (%v)", policy, err)
+	}
+
+	config.Dns.RequireDnssec = false
+	if policy, _, err := checkDane(&bgCtx, &unsigned); policy != "dane-only" {
+		t.Errorf("Expected dane-only with require_dnssec disabled, got %q (%v)", policy, err)
+	}
+}
+
+func TestNullMx(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t, "nullmx.example. 300 IN MX 0 .")
+	startFakeDns(t, z)
+
+	domain := "nullmx.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "" || err != nil {
+		t.Errorf("Expected no policy for null MX, got %q (%v)", policy, err)
+	}
+	if n := z.Queries("_25._tcp.", dns.TypeTLSA) + z.Queries(".", dns.TypeA); n != 0 {
+		t.Errorf("Expected no lookups for the null MX host, got %d", n)
+	}
+}
+
+func TestImplicitMx(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"implicit.example. 300 IN A 192.0.2.25",
+		"_25._tcp.implicit.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	z.SetRcode("nx.example", dns.TypeMX, dns.RcodeNameError)
+	startFakeDns(t, z)
+
+	tests := []struct {
+		domain   string
+		status   uint8
+		expected string
+	}{
+		{"implicit.example", MxNone, "dane-only"},
+		// No address, so there is no implicit MX host either
+		{"noaddress.example", MxNone, ""},
+		{"nx.example", MxNxDomain, ""},
+	}
+	for _, test := range tests {
+		if _, _, status, err, _ := getMxRecords(&bgCtx, &test.domain); status != test.status || err != nil {
+			t.Errorf("Expected MX status %d for %s, got %d (%v)", test.status, test.domain, status, err)
+		}
+		if policy, _, err := checkDane(&bgCtx, &test.domain); policy != test.expected || err != nil {
+			t.Errorf("Expected %q for %s, got %q (%v)", test.expected, test.domain, policy, err)
+		}
+	}
+	if n := z.Queries("nx.example", dns.TypeA); n != 0 {
+		t.Errorf("Expected no address lookup for a nonexistent domain, got %d", n)
+	}
+}
+
+func TestMxAddresses(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"dual.example. 3600 IN SOA ns.dual.example. hostmaster.dual.example. 1 3600 600 86400 3600",
+		"dual.example. 120 IN A 192.0.2.25",
+		"dual.example. 60 IN AAAA 2001:db8::25",
+		"_25._tcp.dual.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+
+	mx := "dual.example"
+	ips, ttl, _, err := lookupMxAddresses(&bgCtx, &mx)
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.25")) || !ips[1].Equal(net.ParseIP("2001:db8::25")) {
+		t.Fatalf("Expected both the A and AAAA record, got %v (%v)", ips, err)
+	}
+	if ttl != 60 {
+		t.Errorf("Expected the lowest TTL of the addresses, got %d", ttl)
+	}
+	// The implicit MX host is only valid as long as its addresses
+	if policy, ttl, err := checkDane(&bgCtx, &mx); policy != "dane-only" || ttl != 60 || err != nil {
+		t.Errorf("Expected dane-only for 60s for the implicit MX host, got %q for %ds (%v)", policy, ttl, err)
+	}
+
+	insecure := newFakeZone(false)
+	insecure.Add(t, "dual.example. 120 IN A 192.0.2.25")
+	startFakeDns(t, insecure)
+	if ips, _, _, err := lookupMxAddresses(&bgCtx, &mx); len(ips) != 0 || err != nil {
+		t.Errorf("Expected no addresses without DNSSEC, got %v (%v)", ips, err)
+	}
+
+	// A failed address lookup of the implicit MX host defers, rather than meaning there is none
+	failing := newFakeZone(true)
+	failing.Add(t, "dual.example. 3600 IN SOA ns.dual.example. hostmaster.dual.example. 1 3600 600 86400 3600")
+	failing.SetRcode("dual.example", dns.TypeA, dns.RcodeServerFailure)
+	startFakeDns(t, failing)
+	if policy, _, err := checkDane(&bgCtx, &mx); policy != "TEMP" || err == nil {
+		t.Errorf("Expected TEMP for a failed address lookup of the implicit MX host, got %q (%v)", policy, err)
+	}
+}
+
+func TestMxPreference(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"prio.example. 300 IN MX 30 mx3.prio.example.",
+		"prio.example. 300 IN MX 10 mx1.prio.example.",
+		"prio.example. 300 IN MX 20 mx2.prio.example.",
+		"mx1.prio.example. 300 IN A 192.0.2.1",
+		"mx2.prio.example. 300 IN A 192.0.2.2",
+		"mx3.prio.example. 300 IN A 192.0.2.3",
+	)
+	startFakeDns(t, z)
+
+	domain := "prio.example"
+	mxRecords, _, _, err, _ := getMxRecords(&bgCtx, &domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mx1.prio.example.", "mx2.prio.example.", "mx3.prio.example."}
+	if !slices.Equal(mxNames(mxRecords), expected) {
+		t.Errorf("Expected MX hosts ordered by preference %v, got %v", expected, mxNames(mxRecords))
+	}
+}
+
+func TestPartialDane(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"mixed.example. 300 IN MX 10 new.mixed.example.",
+		"mixed.example. 300 IN MX 20 old.mixed.example.",
+		"new.mixed.example. 300 IN A 192.0.2.1",
+		"old.mixed.example. 300 IN A 192.0.2.2",
+		"_25._tcp.new.mixed.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"unusable.example. 300 IN MX 10 new.unusable.example.",
+		"unusable.example. 300 IN MX 20 old.unusable.example.",
+		"new.unusable.example. 300 IN A 192.0.2.1",
+		"old.unusable.example. 300 IN A 192.0.2.2",
+		"_25._tcp.new.unusable.example. 300 IN TLSA 1 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+	prev := config.Dane.Mode
+	defer func() { config.Dane.Mode = prev }()
+
+	tests := []struct {
+		mode, domain, expected string
+	}{
+		{"strict", "mixed.example", "dane"},
+		{"partial", "mixed.example", "dane-only"},
+		// Without any usable TLSA record, there are no hosts to restrict delivery to
+		{"strict", "unusable.example", "dane"},
+		{"partial", "unusable.example", "dane"},
+	}
+	for _, test := range tests {
+		config.Dane.Mode = test.mode
+		if policy, _, err := checkDane(&bgCtx, &test.domain); policy != test.expected {
+			t.Errorf("Expected %q for %s in %s mode, got %q (%v)", test.expected, test.domain, test.mode, policy, err)
+		}
+	}
+}
+
+func TestDanePort(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"submission.example. 300 IN MX 10 mx.submission.example.",
+		"mx.submission.example. 300 IN A 192.0.2.25",
+		"_587._tcp.mx.submission.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for query, expected := range map[string]string{
+		"submission.example:587": "OK dane-only",
+		"submission.example":     "NOTFOUND ",
+		"submission.example:0":   "NOTFOUND ",
+	} {
+		client.Write(netstring.Marshal("DANE " + query))
+		if !replies.Scan() {
+			t.Fatalf("No reply for %q: %v", query, replies.Err())
+		}
+		if reply := replies.Text(); reply != expected {
+			t.Errorf("%q: expected %q, got %q", query, expected, reply)
+		}
+	}
+	if n := z.Queries("_587._tcp.mx.submission.example", dns.TypeTLSA); n != 1 {
+		t.Errorf("Expected one TLSA lookup for port 587, got %d", n)
+	}
+
+	// The default port of dane.port
+	prev := config.Dane.Port
+	config.Dane.Port = 587
+	defer func() { config.Dane.Port = prev }()
+	domain := "submission.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only with dane.port 587, got %q (%v)", policy, err)
+	}
+}
+
+func TestCnameMx(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"cname.example. 300 IN MX 10 mail.cname.example.",
+		"mail.cname.example. 300 IN CNAME host.provider.example.",
+		"host.provider.example. 300 IN A 192.0.2.25",
+		"_25._tcp.host.provider.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		// TLSA records at the alias are used if there are none at the canonical name
+		"alias.example. 300 IN MX 10 mail.alias.example.",
+		"mail.alias.example. 300 IN CNAME other.provider.example.",
+		"other.provider.example. 300 IN A 192.0.2.26",
+		"_25._tcp.mail.alias.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+
+	domain := "cname.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only from the TLSA records of the canonical name, got %q (%v)", policy, err)
+	}
+	if z.Queries("_25._tcp.host.provider.example", dns.TypeTLSA) != 1 || z.Queries("_25._tcp.mail.cname.example", dns.TypeTLSA) != 0 {
+		t.Error("Expected TLSA records to be looked up at the canonical name only")
+	}
+
+	domain = "alias.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only from the TLSA records of the alias, got %q (%v)", policy, err)
+	}
+	if z.Queries("_25._tcp.other.provider.example", dns.TypeTLSA) != 1 || z.Queries("_25._tcp.mail.alias.example", dns.TypeTLSA) != 1 {
+		t.Error("Expected TLSA records to be looked up at the canonical name, then at the alias")
+	}
+}
+
+func TestCnameMxExpansion(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"insecure.example. 300 IN MX 10 mail.insecure.example.",
+		"mail.insecure.example. 300 IN CNAME host.unsigned.example.",
+		"host.unsigned.example. 300 IN A 192.0.2.25",
+		"_25._tcp.host.unsigned.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"_25._tcp.mail.insecure.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"failing.example. 300 IN MX 10 mail.failing.example.",
+	)
+	z.SetInsecure("host.unsigned.example")
+	z.SetRcode("mail.failing.example", dns.TypeA, dns.RcodeServerFailure)
+	startFakeDns(t, z)
+
+	// An alias that is not securely expanded is no DANE candidate (see [RFC 7672, 2.2.2])
+	domain := "insecure.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "" || err != nil {
+		t.Errorf("Expected no DANE for an insecure CNAME expansion, got %q (%v)", policy, err)
+	}
+	if z.Queries("_25._tcp.host.unsigned.example", dns.TypeTLSA) != 0 || z.Queries("_25._tcp.mail.insecure.example", dns.TypeTLSA) != 0 {
+		t.Error("Expected no TLSA lookup for an insecure CNAME expansion")
+	}
+	// The address lookup of the MX check is not repeated to expand the alias
+	if n := z.Queries("mail.insecure.example", dns.TypeA); n != 1 {
+		t.Errorf("Expected a single A lookup of the MX host, got %d", n)
+	}
+
+	domain = "failing.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "TEMP" || err == nil {
+		t.Errorf("Expected TEMP for a failed address lookup, got %q (%v)", policy, err)
+	}
+}
+
+func TestCnameLoop(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"loop.example. 300 IN MX 10 mail.loop.example.",
+		"mail.loop.example. 300 IN CNAME mail.loop.example.",
+	)
+	startFakeDns(t, z)
+
+	domain := "loop.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "TEMP" || verdictReason(err) != "cname loop" {
+		t.Errorf("Expected TEMP for a CNAME loop, got %q (%v)", policy, err)
+	}
+
+	// Chains longer than MAX_CNAME_CHAIN are treated like loops
+	r := new(dns.Msg)
+	for i := range MAX_CNAME_CHAIN + 1 {
+		r.Answer = append(r.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: fmt.Sprintf("c%d.long.example.", i), Rrtype: dns.TypeCNAME}, Target: fmt.Sprintf("c%d.long.example.", i+1)})
+	}
+	if _, err := followCnames(r, "c0.long.example."); err != errCnameLoop {
+		t.Errorf("Expected a too long chain to be rejected, got %v", err)
+	}
+	r.Answer = r.Answer[:MAX_CNAME_CHAIN]
+	if name, err := followCnames(r, "C0.long.example."); err != nil || name != fmt.Sprintf("c%d.long.example.", MAX_CNAME_CHAIN) {
+		t.Errorf("Expected the end of the chain, got %q (%v)", name, err)
+	}
+}
+
+func TestTlsaConcurrency(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	for i := range 20 {
+		z.Add(t,
+			fmt.Sprintf("many.example. 300 IN MX 10 mx%d.many.example.", i),
+			fmt.Sprintf("mx%d.many.example. 300 IN A 192.0.2.%d", i, i+1),
+			fmt.Sprintf("_25._tcp.mx%d.many.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest, i),
+		)
+	}
+	z.delay = 20 * time.Millisecond
+	startFakeDns(t, z)
+	old := config.Dane.TlsaConcurrency
+	defer func() { config.Dane.TlsaConcurrency = old }()
+	config.Dane.TlsaConcurrency = 4
+
+	domain := "many.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only with TLSA records on all MX hosts, got %q (%v)", policy, err)
+	}
+	if n := z.MaxConcurrent(dns.TypeTLSA); n > 4 || n < 2 {
+		t.Errorf("Expected up to 4 concurrent TLSA queries, got %d", n)
+	}
+
+	// A single host without TLSA records still counts in the aggregation
+	z.Remove("_25._tcp.mx7.many.example", dns.TypeTLSA)
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane" {
+		t.Errorf("Expected dane with TLSA records on some MX hosts, got %q (%v)", policy, err)
+	}
+}
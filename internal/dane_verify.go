@@ -0,0 +1,148 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errTlsHandshake = errors.New("tls handshake failed")
+	errTlsaMismatch = errors.New("certificate matches no TLSA record")
+	errCertName     = errors.New("certificate not issued for the MX host")
+)
+
+var daneDialer = &net.Dialer{Timeout: REQUEST_TIMEOUT}
+
+// Dials an MX host for dane.verify_live, replaced in tests
+var dialMx = daneDialer.DialContext
+
+// Whether a TLSA record matches the presented chain, DANE-EE only the leaf, DANE-TA any certificate of it
+func tlsaMatches(r *dns.TLSA, chain []*x509.Certificate) bool {
+	if r.Usage == 3 && len(chain) != 0 {
+		chain = chain[:1]
+	}
+	for _, cert := range chain {
+		if c, err := dns.CertificateToDANE(r.Selector, r.MatchingType, cert); err == nil && strings.EqualFold(c, r.Certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a certificate is issued for host per RFC 6125, a wildcard only standing in for the complete leftmost label
+func certMatchesHost(cert *x509.Certificate, host string) bool {
+	names := cert.DNSNames
+	if len(names) == 0 && len(cert.Subject.CommonName) != 0 {
+		names = []string{cert.Subject.CommonName} // only without DNS names in subjectAltName
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	label, parent, _ := strings.Cut(host, ".")
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == host {
+			return true
+		}
+		// A wildcard never matches a public suffix like *.com
+		if suffix, ok := strings.CutPrefix(name, "*."); ok && strings.Contains(suffix, ".") && len(label) != 0 && suffix == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to each address of an MX host, issues STARTTLS and checks the presented certificates against its usable TLSA records
+func verifyTlsaLive(ctx *context.Context, mx *string, records []dns.RR) error {
+	config := getConfig()
+	var usable []*dns.TLSA
+	for _, rr := range records {
+		if tlsa, ok := rr.(*dns.TLSA); ok && isTlsaUsable(tlsa) {
+			usable = append(usable, tlsa)
+		}
+	}
+	ips, _, _, err := lookupMxAddresses(ctx, mx)
+	if err != nil {
+		return err
+	}
+	ips = slices.DeleteFunc(ips, func(ip net.IP) bool {
+		switch config.Dane.AddressFamily {
+		case "ipv4":
+			return ip.To4() == nil
+		case "ipv6":
+			return ip.To4() != nil
+		}
+		return false
+	})
+	if len(ips) == 0 {
+		return fmt.Errorf("%w: no DNSSEC-signed address", errTlsHandshake)
+	}
+	// Postfix may deliver to any address of a dual-stack host, so each must present a matching certificate
+	for _, ip := range ips {
+		if err := verifyTlsaAddress(ctx, strings.TrimSuffix(*mx, "."), ip, usable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Issues STARTTLS on a single address of an MX host and matches the presented chain
+func verifyTlsaAddress(ctx *context.Context, host string, ip net.IP, usable []*dns.TLSA) error {
+	conn, err := dialMx(*ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(danePort(ctx)))))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTlsHandshake, err)
+	}
+	defer conn.Close()
+	deadline, ok := (*ctx).Deadline()
+	if !ok {
+		deadline = time.Now().Add(REQUEST_TIMEOUT)
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTlsHandshake, err)
+	}
+	defer c.Close()
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return fmt.Errorf("%w: %v", errTlsHandshake, err)
+		}
+	}
+	// The certificate is authenticated by its TLSA records, not by a CA
+	if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+		return fmt.Errorf("%w: %v", errTlsHandshake, err)
+	}
+	state, _ := c.TLSConnectionState()
+	c.Quit()
+	matched := false
+	for _, tlsa := range usable {
+		if !tlsaMatches(tlsa, state.PeerCertificates) {
+			continue
+		}
+		// DANE-EE binds the key itself, DANE-TA only the issuer, so the leaf must also name the MX host
+		if tlsa.Usage == 3 || certMatchesHost(state.PeerCertificates[0], host) {
+			return nil
+		}
+		matched = true
+	}
+	if matched {
+		return fmt.Errorf("%w: %s", errCertName, host)
+	}
+	return errTlsaMismatch
+}
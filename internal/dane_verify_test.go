@@ -0,0 +1,227 @@
+package tlspol
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serves a minimal SMTP dialog up to STARTTLS with a self-signed certificate for the given DNS names
+func startFakeSmtp(t *testing.T, dnsNames ...string) (*x509.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.verify.example"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var c net.Conn = conn
+				c.Write([]byte("220 mx.verify.example ESMTP\r\n"))
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.Fields(line + " x")[0]) {
+					case "EHLO":
+						c.Write([]byte("250-mx.verify.example\r\n250 STARTTLS\r\n"))
+					case "STARTTLS":
+						c.Write([]byte("220 ready\r\n"))
+						tc := tls.Server(conn, tlsConfig)
+						if tc.Handshake() != nil {
+							return
+						}
+						c = tc
+						r = bufio.NewReader(c)
+					case "QUIT":
+						c.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						c.Write([]byte("500 unknown\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return cert, ln.Addr().String()
+}
+
+func TestDaneVerifyLive(t *testing.T) {
+	config := getConfig()
+	cert, addr := startFakeSmtp(t)
+	digest, err := dns.CertificateToDANE(1, 1, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := newFakeZone(true)
+	z.Add(t,
+		"verify.example. 300 IN MX 10 mx.verify.example.",
+		"mx.verify.example. 300 IN A 192.0.2.25",
+		"mx.verify.example. 300 IN AAAA 2001:db8::25",
+		"_25._tcp.mx.verify.example. 300 IN TLSA 3 1 1 "+digest,
+		"mismatch.example. 300 IN MX 10 mx.mismatch.example.",
+		"mx.mismatch.example. 300 IN A 192.0.2.26",
+		"_25._tcp.mx.mismatch.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+	var dialed []string
+	prevDial, prevDane := dialMx, config.Dane
+	dialMx = func(ctx context.Context, network string, target string) (net.Conn, error) {
+		dialed = append(dialed, target)
+		return daneDialer.DialContext(ctx, network, addr)
+	}
+	t.Cleanup(func() {
+		dialMx = prevDial
+		config.Dane = prevDane
+	})
+
+	domain := "verify.example"
+	config.Dane.VerifyLive = false
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "dane-only" || len(dialed) != 0 {
+		t.Fatalf("Expected dane-only without dialing, got %q after dialing %v", policy, dialed)
+	}
+
+	config.Dane.VerifyLive = true
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" || err != nil {
+		t.Errorf("Expected dane-only for a matching certificate, got %q (%v)", policy, err)
+	}
+	if !slices.Equal(dialed, []string{"192.0.2.25:25", "[2001:db8::25]:25"}) {
+		t.Errorf("Expected both addresses of mx.verify.example to be dialed, got %v", dialed)
+	}
+
+	config.Dane.AddressFamily = "ipv6"
+	dialed = nil
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" || !slices.Equal(dialed, []string{"[2001:db8::25]:25"}) {
+		t.Errorf("Expected only the IPv6 address to be dialed, got %q after dialing %v (%v)", policy, dialed, err)
+	}
+	config.Dane.AddressFamily = ""
+
+	domain = "mismatch.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "TEMP" || verdictReason(err) != "tlsa mismatch" {
+		t.Errorf("Expected TEMP for a mismatching certificate, got %q (%v)", policy, err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = closed.Addr().String()
+	closed.Close()
+	domain = "verify.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "TEMP" || verdictReason(err) != "tls handshake failed" {
+		t.Errorf("Expected TEMP if the MX host is unreachable, got %q (%v)", policy, err)
+	}
+}
+
+func TestCertMatchesHost(t *testing.T) {
+	wildcard := &x509.Certificate{DNSNames: []string{"*.wild.example", "mx.exact.example"}}
+	legacy := &x509.Certificate{Subject: pkix.Name{CommonName: "mx.legacy.example"}}
+	tests := []struct {
+		cert  *x509.Certificate
+		host  string
+		match bool
+	}{
+		{wildcard, "mx.exact.example", true},
+		{wildcard, "MX.Exact.Example.", true},
+		{wildcard, "mx1.wild.example", true},
+		{wildcard, "wild.example", false},      // the wildcard needs a label of its own
+		{wildcard, "a.mx.wild.example", false}, // and stands for one label only
+		{wildcard, "mx.other.example", false},
+		{legacy, "mx.legacy.example", true}, // common name without subjectAltName
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "mx.legacy.example"}, DNSNames: []string{"mx.san.example"}}, "mx.legacy.example", false},
+		{&x509.Certificate{DNSNames: []string{"*.example"}}, "mx.example", false}, // not below a public suffix
+	}
+	for _, test := range tests {
+		if match := certMatchesHost(test.cert, test.host); match != test.match {
+			t.Errorf("Expected %v for %q against %v, got %v", test.match, test.host, test.cert.DNSNames, match)
+		}
+	}
+}
+
+func TestDaneVerifyWildcard(t *testing.T) {
+	config := getConfig()
+	cert, addr := startFakeSmtp(t, "*.wild.example")
+	digest, err := dns.CertificateToDANE(1, 1, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := newFakeZone(true)
+	z.Add(t,
+		"wild.example. 300 IN MX 10 mx1.wild.example.",
+		"mx1.wild.example. 300 IN A 192.0.2.27",
+		"_25._tcp.mx1.wild.example. 300 IN TLSA 2 1 1 "+digest,
+		"nested.example. 300 IN MX 10 a.mx.wild.example.",
+		"a.mx.wild.example. 300 IN A 192.0.2.28",
+		"_25._tcp.a.mx.wild.example. 300 IN TLSA 2 1 1 "+digest,
+		"pinned.example. 300 IN MX 10 mx.pinned.example.",
+		"mx.pinned.example. 300 IN A 192.0.2.29",
+		"_25._tcp.mx.pinned.example. 300 IN TLSA 3 1 1 "+digest,
+	)
+	startFakeDns(t, z)
+	prevDial, prevVerifyLive := dialMx, config.Dane.VerifyLive
+	dialMx = func(ctx context.Context, network string, target string) (net.Conn, error) {
+		return daneDialer.DialContext(ctx, network, addr)
+	}
+	config.Dane.VerifyLive = true
+	t.Cleanup(func() {
+		dialMx = prevDial
+		config.Dane.VerifyLive = prevVerifyLive
+	})
+
+	tests := []struct {
+		domain, policy, reason string
+	}{
+		{"wild.example", "dane-only", ""},                       // DANE-TA, the MX host only matches the wildcard
+		{"nested.example", "TEMP", "certificate name mismatch"}, // the wildcard covers a single label
+		{"pinned.example", "dane-only", ""},                     // DANE-EE ignores names
+	}
+	for _, test := range tests {
+		policy, _, err := checkDane(&bgCtx, &test.domain)
+		reason := ""
+		if err != nil {
+			reason = verdictReason(err)
+		}
+		if policy != test.policy || reason != test.reason {
+			t.Errorf("Expected %q (%q) for %s, got %q (%q)", test.policy, test.reason, test.domain, policy, reason)
+		}
+	}
+}
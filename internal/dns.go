@@ -0,0 +1,320 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var tcpClient = dns.Client{Net: "tcp", Timeout: REQUEST_TIMEOUT}
+
+// Used when dns.edns_buffer is unset
+const EDNS_BUFFER_SIZE = 1232
+
+// Pause before the first retry of a failed query, doubled for each further one
+const DNS_RETRY_BACKOFF = 50 * time.Millisecond
+
+// Time all attempts of a query may take together, including the retries without EDNS
+var dnsQueryBudget = REQUEST_TIMEOUT
+
+// Time a single attempt may take, so that a lost packet leaves time for dns.retries and the
+// retry without EDNS rather than using up the whole request
+func dnsAttemptTimeout(retries uint32) time.Duration {
+	return dnsQueryBudget / time.Duration(2*(retries+1))
+}
+
+// Number of queries sent to the resolvers
+var dnsExchanges atomic.Uint64
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// Answers by name and type, as MX hosts are often shared by many domains
+var dnsCache = struct {
+	sync.Mutex
+	m map[string]dnsCacheEntry
+}{m: make(map[string]dnsCacheEntry)}
+
+func flushDnsCache() {
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	clear(dnsCache.m)
+}
+
+// Evicts the answers about a domain, the names below it and its MX hosts, so they are resolved again
+func purgeDnsCache(domain string) {
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	names := []string{dns.Fqdn(domain)}
+	if e, ok := dnsCache.m[names[0]+"/MX"]; ok {
+		for _, answer := range e.msg.Answer {
+			if mx, ok := answer.(*dns.MX); ok && mx.Mx != "." {
+				names = append(names, strings.ToLower(dns.Fqdn(mx.Mx)))
+			}
+		}
+	}
+	for key := range dnsCache.m {
+		name := key[:strings.LastIndexByte(key, '/')]
+		for _, n := range names {
+			if name == n || strings.HasSuffix(name, "."+n) {
+				delete(dnsCache.m, key)
+				break
+			}
+		}
+	}
+}
+
+// Builds the client for the configured protocol (udp, tcp or tcp-tls)
+func newDnsClient(c *DnsConfig) *dns.Client {
+	timeout := dnsAttemptTimeout(c.Retries)
+	switch c.Protocol {
+	case "", "udp":
+		return &dns.Client{Timeout: timeout}
+	case "tcp":
+		return &dns.Client{Net: "tcp", Timeout: timeout}
+	case "tcp-tls":
+		return &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: timeout,
+			TLSConfig: &tls.Config{
+				ServerName: c.TlsServerName,
+				MinVersion: tls.VersionTLS12,
+			},
+		}
+	default:
+		log.Warnf("Unknown DNS protocol %q, using udp", c.Protocol)
+		return &dns.Client{Timeout: timeout}
+	}
+}
+
+type resolverKey struct{}
+
+// Sends all DNS queries of ctx to addr instead of the configured resolvers, e. g. for QUERY example.com @9.9.9.9
+func withResolver(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, resolverKey{}, addr)
+}
+
+// Resolver set by withResolver, empty if the configured ones are used
+func resolverOverride(ctx context.Context) string {
+	addr, _ := ctx.Value(resolverKey{}).(string)
+	return addr
+}
+
+// Resolvers in the order they are tried
+func dnsResolvers(ctx context.Context) []string {
+	config := getConfig()
+	if addr := resolverOverride(ctx); len(addr) != 0 {
+		return []string{addr}
+	}
+	if len(config.Dns.Addresses) != 0 {
+		return config.Dns.Addresses
+	}
+	return []string{config.Dns.Address}
+}
+
+// Adds the EDNS0 OPT record with the buffer size of dns.edns_buffer, requesting DNSSEC if do is set
+func setEdns0(m *dns.Msg, do bool) {
+	config := getConfig()
+	size := config.Dns.EdnsBuffer
+	if size == 0 {
+		size = EDNS_BUFFER_SIZE
+	}
+	m.SetEdns0(size, do)
+}
+
+// Copy of the query without the EDNS0 OPT record, asking for the AD bit instead (see [RFC 6840, 5.7])
+func withoutEdns0(m *dns.Msg) *dns.Msg {
+	m = m.Copy()
+	m.Extra = slices.DeleteFunc(m.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+	m.AuthenticatedData = true
+	return m
+}
+
+// Whether a failed query hints at a resolver or middlebox that can't handle EDNS
+func ednsRejected(r *dns.Msg, err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	return err == nil && r.Rcode == dns.RcodeFormatError
+}
+
+// Like c.ExchangeContext, which only honors the deadline of ctx, but also aborts the query once ctx is canceled
+func exchangeContext(ctx context.Context, c *dns.Client, m *dns.Msg, addr string) (*dns.Msg, error) {
+	conn, err := c.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	r, _, err := c.ExchangeWithConnContext(ctx, m, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r, err
+}
+
+// Whether a query failed with a timeout or network error, e. g. a lost UDP packet, rather than an answer
+func isTransientDnsError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Describes an error of a lookup for humans, e. g. "SERVFAIL from resolver"
+func describeDnsError(err error) string {
+	if isTimeout(err) {
+		return "timeout"
+	}
+	if _, isRcode := dns.StringToRcode[err.Error()]; isRcode {
+		return err.Error() + " from resolver"
+	}
+	return err.Error()
+}
+
+// Sends a query to a single resolver, retrying up to dns.retries times on timeouts and network errors
+func exchangeWith(ctx *context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	config := getConfig()
+	var r *dns.Msg
+	var err error
+	client := dnsClient.Load()
+	for attempt := uint32(0); ; attempt++ {
+		dnsExchanges.Add(1)
+		start := time.Now()
+		r, err = exchangeContext(*ctx, client, m, addr)
+		metrics.dnsLatency.Observe(time.Since(start))
+		if !isTransientDnsError(err) || attempt >= config.Dns.Retries {
+			break
+		}
+		log.Debugf("DNS resolver %s failed for %s, retrying: %v", addr, m.Question[0].Name, err)
+		select {
+		case <-(*ctx).Done():
+			return nil, (*ctx).Err()
+		case <-time.After(DNS_RETRY_BACKOFF << attempt):
+		}
+	}
+	if err == nil && r.Truncated && client.Net != "tcp" && client.Net != "tcp-tls" {
+		// Answer didn't fit into UDP, retry over TCP to get the complete answer set
+		dnsExchanges.Add(1)
+		r, err = exchangeContext(*ctx, &tcpClient, m, addr)
+	}
+	return r, err
+}
+
+// Sends a query, moving on to the next resolver on network errors or SERVFAIL
+func exchange(ctx *context.Context, m *dns.Msg) (*dns.Msg, error) {
+	var r *dns.Msg
+	var err error
+	for _, addr := range dnsResolvers(*ctx) {
+		r, err = exchangeWith(ctx, m, addr)
+		if m.IsEdns0() != nil && ednsRejected(r, err) && (*ctx).Err() == nil {
+			log.Debugf("DNS resolver %s failed with EDNS for %s, retrying without", addr, m.Question[0].Name)
+			r, err = exchangeWith(ctx, withoutEdns0(m), addr)
+		}
+		if err == nil && r.Rcode != dns.RcodeServerFailure {
+			return r, nil
+		}
+		if (*ctx).Err() != nil {
+			break
+		}
+		if err != nil {
+			log.Debugf("DNS resolver %s failed: %v", addr, err)
+		} else {
+			log.Debugf("DNS resolver %s answered SERVFAIL for %s", addr, m.Question[0].Name)
+		}
+	}
+	if err != nil {
+		metrics.dnsErrors.Add(1)
+	}
+	return r, err
+}
+
+// Lowest TTL of the answer, false if it has no records to take a TTL from
+func answerTtl(r *dns.Msg) (uint32, bool) {
+	var ttls []uint32
+	for _, rr := range append(r.Answer, r.Ns...) {
+		ttls = append(ttls, rr.Header().Ttl)
+	}
+	return findMin(&ttls), len(ttls) != 0
+}
+
+// TTL of a negative answer, the lower of the SOA record's TTL and its minimum field (see [RFC 2308, 5]),
+// false if the authority section has no SOA record
+func negativeTtl(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), true
+		}
+	}
+	return 0, false
+}
+
+// Like exchange, but answers from the DNS cache while the records are valid
+func cachedExchange(ctx *context.Context, m *dns.Msg) (*dns.Msg, error) {
+	config := getConfig()
+	// Answers of another resolver must neither come from nor go to the cache
+	if config.Dns.CacheSize == 0 || len(resolverOverride(*ctx)) != 0 {
+		return exchange(ctx, m)
+	}
+	q := m.Question[0]
+	key := strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype]
+	now := time.Now()
+	dnsCache.Lock()
+	e, ok := dnsCache.m[key]
+	dnsCache.Unlock()
+	// Answers about to expire are resolved again, so that prefetched policies get the full TTL
+	if ok && now.Before(e.expires) && (e.expires.Sub(e.stored) <= PREFETCH_MARGIN*time.Second || e.expires.Sub(now) > PREFETCH_MARGIN*time.Second) {
+		// Count down the TTLs, as a caching resolver would
+		r := e.msg.Copy()
+		r.Id = m.Id
+		elapsed := uint32(now.Sub(e.stored).Seconds())
+		for _, rr := range append(r.Answer, r.Ns...) {
+			rr.Header().Ttl -= min(elapsed, rr.Header().Ttl)
+		}
+		return r, nil
+	}
+
+	r, err := exchange(ctx, m)
+	if err != nil || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return r, err
+	}
+	ttl, ok := answerTtl(r)
+	if !ok || ttl == 0 {
+		return r, nil
+	}
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	if len(dnsCache.m) >= int(config.Dns.CacheSize) {
+		for k, e := range dnsCache.m {
+			if now.After(e.expires) {
+				delete(dnsCache.m, k)
+			}
+		}
+		if len(dnsCache.m) >= int(config.Dns.CacheSize) {
+			return r, nil // all entries are still valid, skip rather than grow
+		}
+	}
+	dnsCache.m[key] = dnsCacheEntry{msg: r.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	return r, nil
+}
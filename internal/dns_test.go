@@ -0,0 +1,312 @@
+package tlspol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolverFailover(t *testing.T) {
+	config := getConfig()
+	failing := newFakeZone(false)
+	failing.SetRcode("failover.example", dns.TypeMX, dns.RcodeServerFailure)
+	failing.SetRcode("mx.failover.example", dns.TypeA, dns.RcodeServerFailure)
+	failing.SetRcode("mx.failover.example", dns.TypeAAAA, dns.RcodeServerFailure)
+	failing.SetRcode("_25._tcp.mx.failover.example", dns.TypeTLSA, dns.RcodeServerFailure)
+	failingAddr := startFakeDns(t, failing)
+
+	working := newFakeZone(true)
+	addDaneDomain(t, working, "failover.example")
+	workingAddr := startFakeDns(t, working)
+
+	// Nothing listens on this address anymore
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	prev := config.Dns.Addresses
+	defer func() { config.Dns.Addresses = prev }()
+	domain := "failover.example"
+
+	config.Dns.Addresses = []string{failingAddr, workingAddr}
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only from the second resolver after SERVFAIL, got %q (%v)", policy, err)
+	}
+	if failing.Queries(domain, dns.TypeMX) == 0 {
+		t.Errorf("Expected the first resolver to be tried")
+	}
+
+	config.Dns.Addresses = []string{downAddr, workingAddr}
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only from the second resolver after a network error, got %q (%v)", policy, err)
+	}
+
+	config.Dns.Addresses = []string{downAddr, failingAddr}
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "TEMP" || err == nil {
+		t.Errorf("Expected TEMP when all resolvers fail, got %q (%v)", policy, err)
+	}
+}
+
+func TestTruncatedFallback(t *testing.T) {
+	z := newFakeZone(true)
+	z.truncate = true
+	for _, host := range []string{"mx1", "mx2", "mx3"} {
+		z.Add(t,
+			"truncated.example. 300 IN MX 10 "+host+".truncated.example.",
+			host+".truncated.example. 300 IN A 192.0.2.25",
+		)
+	}
+	// Only the first MX host has TLSA records, a partial answer would hide the others
+	z.Add(t, "_25._tcp.mx1.truncated.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest)
+	startFakeDns(t, z)
+
+	domain := "truncated.example"
+	mxRecords, _, _, err, _ := getMxRecords(&bgCtx, &domain)
+	if err != nil || len(mxRecords) != 3 {
+		t.Fatalf("Expected all 3 MX hosts after TCP retry, got %v (%v)", mxRecords, err)
+	}
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "dane" {
+		t.Errorf("Expected dane with TLSA on one of 3 MX hosts, got %q", policy)
+	}
+}
+
+func TestEdnsFallback(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.rejectEdns = true
+	addDaneDomain(t, z, "edns.example")
+	startFakeDns(t, z)
+
+	domain := "edns.example"
+	if policy, _, err := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only after retrying without EDNS, got %q (%v)", policy, err)
+	}
+	if n := z.Queries(domain, dns.TypeMX); n != 2 {
+		t.Errorf("Expected one query with and one without EDNS, got %d", n)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("edns.example.", dns.TypeMX)
+	prev := config.Dns.EdnsBuffer
+	config.Dns.EdnsBuffer = 512
+	defer func() { config.Dns.EdnsBuffer = prev }()
+	setEdns0(m, true)
+	if opt := m.IsEdns0(); opt == nil || opt.UDPSize() != 512 || !opt.Do() {
+		t.Errorf("Expected EDNS with a buffer of 512 and DO set, got %v", opt)
+	}
+	if stripped := withoutEdns0(m); stripped.IsEdns0() != nil || !stripped.AuthenticatedData || m.IsEdns0() == nil {
+		t.Errorf("Expected a copy without EDNS and with the AD bit")
+	}
+
+	// A firewall dropping EDNS queries is only noticed by a timeout, which must leave time for the retry
+	z = newFakeZone(true)
+	z.dropEdns = true
+	addDaneDomain(t, z, "dropped.example")
+	startFakeDns(t, z)
+	prevBudget, prevClient, prevRetries := dnsQueryBudget, dnsClient.Load(), config.Dns.Retries
+	defer func() {
+		dnsQueryBudget = prevBudget
+		dnsClient.Store(prevClient)
+		config.Dns.Retries = prevRetries
+	}()
+	dnsQueryBudget = 1200 * time.Millisecond
+	config.Dns.Retries = 1
+	dnsClient.Store(newDnsClient(&config.Dns))
+	// Bound like a query of Postfix
+	ctx, cancel := context.WithTimeout(bgCtx, dnsQueryBudget)
+	defer cancel()
+	m = new(dns.Msg)
+	m.SetQuestion("dropped.example.", dns.TypeMX)
+	setEdns0(m, true)
+	if r, err := exchange(&ctx, m); err != nil || len(r.Answer) != 1 {
+		t.Errorf("Expected the MX record after retrying without EDNS, got %v (%v)", r, err)
+	}
+	if n := z.Queries("dropped.example", dns.TypeMX); n != 3 {
+		t.Errorf("Expected two queries with and one without EDNS, got %d", n)
+	}
+}
+
+func TestDnsRetries(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "lossy.example")
+	startFakeDns(t, z)
+	oldBudget, oldClient, oldRetries := dnsQueryBudget, dnsClient.Load(), config.Dns.Retries
+	defer func() {
+		dnsQueryBudget = oldBudget
+		dnsClient.Store(oldClient)
+		config.Dns.Retries = oldRetries
+	}()
+	dnsQueryBudget = 1200 * time.Millisecond
+	setRetries := func(retries uint32) {
+		config.Dns.Retries = retries
+		dnsClient.Store(newDnsClient(&config.Dns))
+	}
+	setRetries(2)
+
+	// Bound like a query of Postfix, a lost packet must not use up the time left for the retries
+	ctx, cancel := context.WithTimeout(bgCtx, dnsQueryBudget)
+	defer cancel()
+	domain := "lossy.example"
+	z.Drop(1)
+	if policy, _, err := checkDane(&ctx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only after retrying the lost query, got %q (%v)", policy, err)
+	}
+	if n := z.Queries(domain, dns.TypeMX); n != 2 {
+		t.Errorf("Expected the lost MX query to be sent again, got %d queries", n)
+	}
+
+	// Without retries, the query and the fallback without EDNS are lost
+	setRetries(0)
+	z.Drop(2)
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "TEMP" {
+		t.Errorf("Expected TEMP without retries, got %q", policy)
+	}
+
+	// SERVFAIL is an answer, so it is not retried
+	setRetries(2)
+	z.SetRcode(domain, dns.TypeMX, dns.RcodeServerFailure)
+	before := z.Queries(domain, dns.TypeMX)
+	checkDane(&bgCtx, &domain)
+	if n := z.Queries(domain, dns.TypeMX) - before; n != 1 {
+		t.Errorf("Expected SERVFAIL not to be retried, got %d queries", n)
+	}
+}
+
+func TestDnsCancellation(t *testing.T) {
+	z := newFakeZone(true)
+	z.delay = time.Second
+	z.Add(t, "slow.example. 300 IN MX 10 mx.slow.example.")
+	startFakeDns(t, z)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	m := new(dns.Msg)
+	m.SetQuestion("slow.example.", dns.TypeMX)
+	setEdns0(m, true)
+	start := time.Now()
+	if _, err := exchange(&ctx, m); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the query to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the query to return on cancellation, took %v", elapsed)
+	}
+}
+
+func TestDnsProtocol(t *testing.T) {
+	c := newDnsClient(&DnsConfig{Protocol: "tcp-tls", TlsServerName: "dns.example"})
+	if c.Net != "tcp-tls" || c.TLSConfig == nil || c.TLSConfig.ServerName != "dns.example" {
+		t.Errorf("Expected DNS over TLS client for dns.example, got %q (%+v)", c.Net, c.TLSConfig)
+	}
+	if c.Timeout != REQUEST_TIMEOUT/2 {
+		t.Errorf("Expected timeout %v, got %v", REQUEST_TIMEOUT/2, c.Timeout)
+	}
+	// Two retries and the retry without EDNS each get a share of the request
+	if c := newDnsClient(&DnsConfig{Retries: 2}); c.Timeout != REQUEST_TIMEOUT/6 {
+		t.Errorf("Expected a sixth of %v per attempt with 2 retries, got %v", REQUEST_TIMEOUT, c.Timeout)
+	}
+	if c := newDnsClient(&DnsConfig{Protocol: "tcp"}); c.Net != "tcp" {
+		t.Errorf("Expected tcp client, got %q", c.Net)
+	}
+	if c := newDnsClient(&DnsConfig{}); c.Net != "" {
+		t.Errorf("Expected udp client by default, got %q", c.Net)
+	}
+}
+
+func TestDnsCache(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t, "_25._tcp.mx.cached.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest)
+	startFakeDns(t, z)
+	prev := config.Dns.CacheSize
+	config.Dns.CacheSize = 16
+	defer func() { config.Dns.CacheSize = prev }()
+
+	host := "mx.cached.example"
+	for i := 0; i < 3; i++ {
+		if res := checkTlsa(&bgCtx, &mxHost{Name: host}); res.Result != "dane-only" || res.Ttl == 0 || res.Ttl > 300 {
+			t.Errorf("Unexpected TLSA result %+v", res)
+		}
+	}
+	if n := z.Queries("_25._tcp."+host, dns.TypeTLSA); n != 1 {
+		t.Errorf("Expected TLSA records to be resolved once, got %d queries", n)
+	}
+}
+
+func TestPurgeDnsCache(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "purged.example")
+	addDaneDomain(t, z, "kept.example")
+	startFakeDns(t, z)
+	prev := config.Dns.CacheSize
+	config.Dns.CacheSize = 16
+	defer func() { config.Dns.CacheSize = prev }()
+
+	domains := []string{"purged.example", "kept.example"}
+	for _, domain := range domains {
+		checkDane(&bgCtx, &domain)
+	}
+	purgeDnsCache("purged.example")
+	for _, domain := range domains {
+		checkDane(&bgCtx, &domain)
+	}
+	if n := z.Queries("purged.example", dns.TypeMX); n != 2 {
+		t.Errorf("Expected the MX records of a purged domain to be resolved again, got %d queries", n)
+	}
+	if n := z.Queries("_25._tcp.mx.purged.example", dns.TypeTLSA); n != 2 {
+		t.Errorf("Expected the TLSA records of a purged MX host to be resolved again, got %d queries", n)
+	}
+	if n := z.Queries("kept.example", dns.TypeMX); n != 1 {
+		t.Errorf("Expected the MX records of another domain to stay cached, got %d queries", n)
+	}
+}
+
+func BenchmarkSharedMx(b *testing.B) {
+	config := getConfig()
+	z := newFakeZone(true)
+	var domains []string
+	for i := 0; i < 20; i++ {
+		domain := fmt.Sprintf("customer%d.example", i)
+		domains = append(domains, domain)
+		z.Add(b, domain+". 300 IN MX 10 mx1.provider.example.", domain+". 300 IN MX 20 mx2.provider.example.")
+	}
+	z.Add(b,
+		"mx1.provider.example. 300 IN A 192.0.2.25",
+		"mx2.provider.example. 300 IN A 192.0.2.26",
+		"_25._tcp.mx1.provider.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"_25._tcp.mx2.provider.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(b, z)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, size := range []uint32{0, 4096} {
+		b.Run(fmt.Sprintf("CacheSize=%d", size), func(b *testing.B) {
+			prev := config.Dns.CacheSize
+			config.Dns.CacheSize = size
+			defer func() { config.Dns.CacheSize = prev }()
+			dnsCache.Lock()
+			clear(dnsCache.m)
+			dnsCache.Unlock()
+			start := dnsExchanges.Load()
+			for i := 0; i < b.N; i++ {
+				for _, domain := range domains {
+					checkDane(&bgCtx, &domain)
+				}
+			}
+			b.ReportMetric(float64(dnsExchanges.Load()-start)/float64(b.N), "exchanges/op")
+		})
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Details collected by the checks of a single evaluation, attached to its context
+type evaluation struct {
+	mu        sync.Mutex
+	mxHosts   []string
+	noTlsa    []string
+	stsMxPats []string
+	// Steps of the checks are only recorded when explaining
+	explain   bool
+	daneSteps []string
+	stsSteps  []string
+	// Why a check failed, reported in the JSON result even without explaining
+	daneErr string
+	stsErr  string
+}
+
+// Human-readable account of how a policy was decided
+type Explanation struct {
+	Dane     []string `json:"dane"`
+	MtaSts   []string `json:"mta-sts"`
+	Decision string   `json:"decision"`
+}
+
+type evaluationKey struct{}
+
+// Number of evaluations where DANE and MTA-STS disagreed
+var disagreements atomic.Uint64
+
+func withEvaluation(ctx context.Context) (context.Context, *evaluation) {
+	ev := &evaluation{}
+	return context.WithValue(ctx, evaluationKey{}, ev), ev
+}
+
+// Returns the evaluation of the context, methods are safe to call on nil
+func getEvaluation(ctx *context.Context) *evaluation {
+	ev, _ := (*ctx).Value(evaluationKey{}).(*evaluation)
+	return ev
+}
+
+func (ev *evaluation) setMxHosts(hosts []string) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.mxHosts = slices.Clone(hosts)
+}
+
+func (ev *evaluation) addNoTlsa(host string) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.noTlsa = append(ev.noTlsa, host)
+}
+
+func (ev *evaluation) setStsMxPatterns(patterns []string) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.stsMxPats = slices.Clone(patterns)
+}
+
+func (ev *evaluation) explainDane(format string, args ...any) {
+	if ev == nil || !ev.explain {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.daneSteps = append(ev.daneSteps, fmt.Sprintf(format, args...))
+}
+
+func (ev *evaluation) explainMtaSts(format string, args ...any) {
+	if ev == nil || !ev.explain {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.stsSteps = append(ev.stsSteps, fmt.Sprintf(format, args...))
+}
+
+// Records why DANE failed, and explains it like explainDane
+func (ev *evaluation) failDane(format string, args ...any) {
+	if ev == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.daneErr = msg
+	if ev.explain {
+		ev.daneSteps = append(ev.daneSteps, msg)
+	}
+}
+
+// Records why MTA-STS failed, and explains it like explainMtaSts
+func (ev *evaluation) failMtaSts(format string, args ...any) {
+	if ev == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.stsErr = msg
+	if ev.explain {
+		ev.stsSteps = append(ev.stsSteps, msg)
+	}
+}
+
+// Why DANE and MTA-STS failed, empty if they didn't
+func (ev *evaluation) errors() (string, string) {
+	if ev == nil {
+		return "", ""
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return ev.daneErr, ev.stsErr
+}
+
+// Explains the evaluation, following the same precedence as queryDomainMap
+func (ev *evaluation) explanation(danePolicy string, stsPolicy string) *Explanation {
+	config := getConfig()
+	e := &Explanation{}
+	if ev != nil {
+		ev.mu.Lock()
+		e.Dane = slices.Clone(ev.daneSteps)
+		e.MtaSts = slices.Clone(ev.stsSteps)
+		ev.mu.Unlock()
+	}
+	switch {
+	case config.Policy.Prefer == "mtasts" && isEnforcedPolicy(stsPolicy):
+		e.Decision = "MTA-STS policy is used, as it is preferred over DANE"
+	case danePolicy == "TEMP":
+		e.Decision = "DANE evaluation failed temporarily, MTA-STS is not considered (TEMP)"
+	case danePolicy != "":
+		e.Decision = "DANE policy is used, it takes precedence over MTA-STS"
+	case stsPolicy == "TEMP":
+		e.Decision = "MTA-STS evaluation failed temporarily (TEMP)"
+	case stsPolicy != "":
+		e.Decision = "MTA-STS policy is used, as there is no DANE policy"
+	default:
+		e.Decision = "Neither DANE nor MTA-STS apply, no policy is returned"
+	}
+	return e
+}
+
+// Matches an MX host against an mx pattern of an MTA-STS policy (see [RFC 8461, 4.1])
+func matchMxPattern(pattern string, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		i := strings.IndexByte(host, '.')
+		return i > 0 && host[i+1:] == pattern[2:]
+	}
+	return pattern == host
+}
+
+// Describes where a DANE and an MTA-STS policy of the same domain disagree, empty if they don't
+func (ev *evaluation) disagreement() string {
+	if ev == nil {
+		return ""
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	var issues []string
+	for _, host := range ev.mxHosts {
+		covered := false
+		for _, pattern := range ev.stsMxPats {
+			if matchMxPattern(pattern, host) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			issues = append(issues, "MX host "+strings.TrimSuffix(host, ".")+" is not listed in the MTA-STS policy")
+		}
+	}
+	for _, host := range ev.noTlsa {
+		issues = append(issues, "MX host "+strings.TrimSuffix(host, ".")+" has no usable TLSA record")
+	}
+	slices.Sort(issues)
+	return strings.Join(issues, "; ")
+}
+
+// Whether a policy can be used, as opposed to no policy or a temporary failure
+func isUsablePolicy(policy string) bool {
+	return len(policy) != 0 && policy != "TEMP"
+}
+
+// Whether a policy requires authenticated TLS, unlike "may" of MTA-STS in testing mode
+func isEnforcedPolicy(policy string) bool {
+	return isUsablePolicy(policy) && policy != "may"
+}
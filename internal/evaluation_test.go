@@ -0,0 +1,87 @@
+package tlspol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchMxPattern(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"mx.example.com", "mx.example.com.", true},
+		{"mx.example.com", "MX.Example.com", true},
+		{"*.example.com", "mx.example.com", true},
+		{"*.example.com", "a.mx.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"mx.example.com", "mx2.example.com", false},
+	}
+	for _, c := range cases {
+		if matchMxPattern(c.pattern, c.host) != c.match {
+			t.Errorf("Pattern %q vs. host %q: expected %v", c.pattern, c.host, c.match)
+		}
+	}
+}
+
+func TestDisagreement(t *testing.T) {
+	ctx, ev := withEvaluation(bgCtx)
+	getEvaluation(&ctx).setMxHosts([]string{"mx1.example.com.", "mx2.example.net."})
+	ev.setStsMxPatterns([]string{"*.example.com"})
+	if d := ev.disagreement(); d != "MX host mx2.example.net is not listed in the MTA-STS policy" {
+		t.Errorf("Unexpected disagreement: %q", d)
+	}
+	ev.setStsMxPatterns([]string{"*.example.com", "mx2.example.net"})
+	if d := ev.disagreement(); d != "" {
+		t.Errorf("Expected no disagreement, got %q", d)
+	}
+	ev.addNoTlsa("mx2.example.net.")
+	if d := ev.disagreement(); d != "MX host mx2.example.net has no usable TLSA record" {
+		t.Errorf("Unexpected disagreement: %q", d)
+	}
+	// No evaluation attached, must not panic
+	if getEvaluation(&bgCtx).disagreement() != "" {
+		t.Error("Expected no disagreement without evaluation")
+	}
+}
+
+func TestExplainDane(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"explain.example. 300 IN MX 10 mx1.explain.example.",
+		"explain.example. 300 IN MX 20 mx2.explain.example.",
+		"mx1.explain.example. 300 IN A 192.0.2.25",
+		"mx2.explain.example. 300 IN A 192.0.2.26",
+		"_25._tcp.mx1.explain.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	startFakeDns(t, z)
+
+	ctx, ev := withEvaluation(bgCtx)
+	ev.explain = true
+	domain := "explain.example"
+	policy, _, _ := checkDane(&ctx, &domain)
+	if policy != "dane" {
+		t.Fatalf("Expected dane with TLSA on one MX host only, got %q", policy)
+	}
+	e := ev.explanation(policy, "")
+	steps := strings.Join(e.Dane, "\n")
+	for _, expected := range []string{
+		"MX host mx1.explain.example. has usable TLSA records",
+		"TLSA records are missing on MX host mx2.explain.example.",
+		`Not all MX hosts have usable TLSA records, resulting in "dane"`,
+	} {
+		if !strings.Contains(steps, expected) {
+			t.Errorf("Expected step %q in explanation:\n%s", expected, steps)
+		}
+	}
+	if !strings.HasPrefix(e.Decision, "DANE policy is used") {
+		t.Errorf("Unexpected decision %q", e.Decision)
+	}
+
+	// Without explaining, no steps are recorded
+	ctx, ev = withEvaluation(bgCtx)
+	checkDane(&ctx, &domain)
+	if e := ev.explanation(policy, ""); len(e.Dane) != 0 {
+		t.Errorf("Expected no steps when not explaining, got %v", e.Dane)
+	}
+}
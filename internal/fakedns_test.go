@@ -0,0 +1,230 @@
+package tlspol
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// In-memory zone served by a local DNS server, so tests don't depend on the internet
+type fakeZone struct {
+	mu      sync.Mutex
+	records map[string][]dns.RR
+	rcodes  map[string]int
+	queries map[string]int
+	// Queries in flight and the most seen at once, by type
+	active    map[uint16]int
+	maxActive map[uint16]int
+	// Set the AD flag on answers, as a validating resolver would
+	secure bool
+	// Names of unsigned zones, answers for them or aliases of them lack the AD flag, set with SetInsecure
+	insecure map[string]bool
+	// Truncate UDP answers with more than one record, as if they exceeded the UDP size
+	truncate bool
+	// Delay answers, to keep queries in flight
+	delay time.Duration
+	// Answer FORMERR to queries with EDNS, as some old servers and middleboxes do
+	rejectEdns bool
+	// Leave queries with EDNS unanswered, as some firewalls do
+	dropEdns bool
+	// Queries to leave unanswered, set with Drop
+	drop int
+}
+
+func newFakeZone(secure bool) *fakeZone {
+	return &fakeZone{
+		records:   make(map[string][]dns.RR),
+		rcodes:    make(map[string]int),
+		insecure:  make(map[string]bool),
+		queries:   make(map[string]int),
+		active:    make(map[uint16]int),
+		maxActive: make(map[uint16]int),
+		secure:    secure,
+	}
+}
+
+func fakeKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[qtype]
+}
+
+// Adds records in zone file format, e. g. "example.com. 300 IN MX 10 mx.example.com."
+func (z *fakeZone) Add(t testing.TB, records ...string) {
+	t.Helper()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("Invalid record %q: %v", record, err)
+		}
+		key := fakeKey(rr.Header().Name, rr.Header().Rrtype)
+		z.records[key] = append(z.records[key], rr)
+	}
+}
+
+// Digest of the TLSA records of the fake zones, no certificate matches it
+const fakeTlsaDigest = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// Adds a domain with a single MX host, mx.<domain>, that has an address and a TLSA record
+func addDaneDomain(t testing.TB, z *fakeZone, domain string) {
+	t.Helper()
+	z.Add(t,
+		domain+". 300 IN MX 10 mx."+domain+".",
+		"mx."+domain+". 300 IN A 192.0.2.25",
+		"_25._tcp.mx."+domain+". 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+}
+
+func (z *fakeZone) Remove(name string, qtype uint16) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	delete(z.records, fakeKey(name, qtype))
+}
+
+// Answers the given name and type with an rcode instead of records
+func (z *fakeZone) SetRcode(name string, qtype uint16, rcode int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.rcodes[fakeKey(name, qtype)] = rcode
+}
+
+// Answers for the name are not DNSSEC-validated, even if the zone is secure
+func (z *fakeZone) SetInsecure(name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.insecure[strings.ToLower(dns.Fqdn(name))] = true
+}
+
+func (z *fakeZone) Queries(name string, qtype uint16) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.queries[fakeKey(name, qtype)]
+}
+
+// Leaves the next n queries unanswered, as if the packets were lost
+func (z *fakeZone) Drop(n int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.drop = n
+}
+
+// Most queries of the type that were in flight at once
+func (z *fakeZone) MaxConcurrent(qtype uint16) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.maxActive[qtype]
+}
+
+func (z *fakeZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	z.mu.Lock()
+	z.active[q.Qtype]++
+	z.maxActive[q.Qtype] = max(z.maxActive[q.Qtype], z.active[q.Qtype])
+	z.mu.Unlock()
+	time.Sleep(z.delay)
+	// Done before replying, as the client may send its next query as soon as it has the reply
+	z.mu.Lock()
+	z.active[q.Qtype]--
+	z.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	key := fakeKey(q.Name, q.Qtype)
+	z.mu.Lock()
+	z.queries[key]++
+	if z.drop > 0 {
+		z.drop--
+		z.mu.Unlock()
+		return
+	}
+	if z.dropEdns && req.IsEdns0() != nil {
+		z.mu.Unlock()
+		return
+	}
+	rcode, hasRcode := z.rcodes[key]
+	answer := z.records[key]
+	secure := z.secure && !z.insecure[strings.ToLower(q.Name)]
+	// CNAMEs are followed within the zone, as a recursive resolver would
+	for name, i := q.Name, 0; q.Qtype != dns.TypeCNAME && len(z.records[fakeKey(name, q.Qtype)]) == 0 && i < 8; i++ {
+		cname := z.records[fakeKey(name, dns.TypeCNAME)]
+		if len(cname) == 0 {
+			break
+		}
+		name = cname[0].(*dns.CNAME).Target
+		secure = secure && !z.insecure[strings.ToLower(name)]
+		answer = append(answer, cname[0])
+		answer = append(answer, z.records[fakeKey(name, q.Qtype)]...)
+	}
+	// Signatures are added with the records they cover
+	for _, rr := range z.records[fakeKey(q.Name, dns.TypeRRSIG)] {
+		if len(answer) != 0 && rr.(*dns.RRSIG).TypeCovered == answer[0].Header().Rrtype {
+			answer = append(answer, rr)
+		}
+	}
+	// Negative answers carry the SOA record of the closest enclosing zone
+	var authority []dns.RR
+	if len(answer) == 0 {
+		labels := dns.SplitDomainName(q.Name)
+		for i := range labels {
+			if soa := z.records[fakeKey(strings.Join(labels[i:], "."), dns.TypeSOA)]; len(soa) != 0 {
+				authority = soa
+				break
+			}
+		}
+	}
+	z.mu.Unlock()
+	if _, isUdp := w.LocalAddr().(*net.UDPAddr); isUdp && z.truncate && len(answer) > 1 {
+		answer = answer[:1]
+		m.Truncated = true
+	}
+	if z.rejectEdns && req.IsEdns0() != nil {
+		m.Rcode = dns.RcodeFormatError
+	} else if hasRcode {
+		m.Rcode = rcode
+		if rcode == dns.RcodeNameError {
+			m.Ns = authority
+			m.AuthenticatedData = secure
+		}
+	} else {
+		m.Answer = answer
+		m.Ns = authority
+		m.AuthenticatedData = secure
+	}
+	w.WriteMsg(m)
+}
+
+// Starts a DNS server for the zone and points the configuration to it for the duration of the test
+func startFakeDns(t testing.TB, z *fakeZone) string {
+	config := getConfig()
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start fake DNS server: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: z}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	// Same port over TCP, for retries of truncated answers
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Could not start fake DNS server: %v", err)
+	}
+	tcpServer := &dns.Server{Listener: l, Handler: z}
+	tcpStarted := make(chan struct{})
+	tcpServer.NotifyStartedFunc = func() { close(tcpStarted) }
+	go tcpServer.ActivateAndServe()
+	<-tcpStarted
+	t.Cleanup(func() { tcpServer.Shutdown() })
+
+	prevAddress := config.Dns.Address
+	config.Dns.Address = pc.LocalAddr().String()
+	t.Cleanup(func() { config.Dns.Address = prevAddress })
+	return config.Dns.Address
+}
@@ -0,0 +1,178 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HTTP_READ_HEADER_TIMEOUT = 5 * time.Second
+	HTTP_IDLE_TIMEOUT        = time.Minute
+	HTTP_CACHE_MAX_ENTRIES   = 1024
+)
+
+type httpCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// Results served over HTTP, kept like the policies in the cache until the first of them expires
+var httpCache = struct {
+	sync.Mutex
+	m map[string]httpCacheEntry
+}{m: make(map[string]httpCacheEntry)}
+
+// Server with timeouts, so that slow or idle clients can't hold connections forever
+func newHttpServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		WriteTimeout:      REQUEST_TIMEOUT + evalQueueTimeout + HTTP_READ_HEADER_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+}
+
+func httpCacheGet(domain string) ([]byte, bool) {
+	httpCache.Lock()
+	defer httpCache.Unlock()
+	e, ok := httpCache.m[domain]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(httpCache.m, domain)
+		return nil, false
+	}
+	return e.body, true
+}
+
+func httpCacheSet(domain string, body []byte, ttl uint32) {
+	now := time.Now()
+	httpCache.Lock()
+	defer httpCache.Unlock()
+	if len(httpCache.m) >= HTTP_CACHE_MAX_ENTRIES {
+		for k, e := range httpCache.m {
+			if now.After(e.expires) {
+				delete(httpCache.m, k)
+			}
+		}
+		if len(httpCache.m) >= HTTP_CACHE_MAX_ENTRIES {
+			return // all entries are still fresh, skip rather than grow
+		}
+	}
+	httpCache.m[domain] = httpCacheEntry{body: body, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+func httpCacheDelete(domain string) {
+	httpCache.Lock()
+	defer httpCache.Unlock()
+	delete(httpCache.m, domain)
+}
+
+// How long a result may be served, like queryDomainMapWith caches the policies it is made of
+func resultTtl(r *Result) uint32 {
+	if r.Dane.Policy == "TEMP" || r.MtaSts.Policy == "TEMP" {
+		return cacheTempTtl()
+	}
+	var ttl uint32
+	for _, p := range []struct {
+		policy string
+		ttl    uint32
+	}{{r.Dane.Policy, r.Dane.Ttl}, {r.MtaSts.Policy, r.MtaSts.Ttl}} {
+		if isUsablePolicy(p.policy) && (ttl == 0 || p.ttl < ttl) {
+			ttl = p.ttl
+		}
+	}
+	if ttl == 0 {
+		return cacheNotFoundTtl()
+	}
+	return max(ttl, cacheMinTtl())
+}
+
+// Answers GET /policy?domain=example.com with the Result of the JSON query
+func servePolicy(w http.ResponseWriter, r *http.Request) {
+	config := getConfig()
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if token := config.Http.Token; len(token) != 0 {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	query := r.URL.Query()
+	domain, err := normalizeDomain(query.Get("domain"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Explanations are only recorded while evaluating, so they are never answered from the cache
+	explain := query.Has("explain")
+	if !explain {
+		if b, ok := httpCacheGet(domain); ok {
+			cacheHits.Add(1)
+			writeJson(w, b)
+			return
+		}
+		cacheMisses.Add(1)
+	}
+	release, ok := acquireEvalSlot()
+	if !ok {
+		log.With(log.Fields{"domain": domain}).Warnf("Too many concurrent evaluations, deferring %q", domain)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(r.Context(), REQUEST_TIMEOUT)
+	defer cancel()
+	res := resolveDomain(&ctx, &domain, explain)
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Errorf("Could not marshal JSON: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	b = append(b, '\n')
+	if !explain {
+		httpCacheSet(domain, b, resultTtl(&res))
+	}
+	writeJson(w, b)
+}
+
+func writeJson(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func startHttpServer() {
+	config := getConfig()
+	if len(config.Http.Address) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/policy", servePolicy)
+	srv := newHttpServer(config.Http.Address, mux)
+	go func() {
+		log.Debugf("Serving policies on http://%s/policy", config.Http.Address)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Errorf("Error starting HTTP server: %v", err)
+		}
+	}()
+}
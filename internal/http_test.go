@@ -0,0 +1,117 @@
+package tlspol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHttpPolicy(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "http.example")
+	startFakeDns(t, z)
+	oldHttp := config.Http
+	t.Cleanup(func() { config.Http = oldHttp })
+	config.Http = HttpConfig{Token: "secret"}
+
+	get := func(url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if len(token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		servePolicy(rec, req)
+		return rec
+	}
+
+	rec := get("/policy?domain=HTTP.example.", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	for _, key := range []string{"version", "domain", "dane", "mta-sts", "tlsrpt"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("Expected key %q in %s", key, rec.Body.String())
+		}
+	}
+	if _, ok := fields["explain"]; ok {
+		t.Errorf("Expected no explanation without explain")
+	}
+	var res Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("JSON does not match Result: %v", err)
+	}
+	if res.Domain != "http.example" || res.Dane.Policy != "dane-only" {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+
+	rec = get("/policy?domain=http.example&explain", "secret")
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Explain == nil {
+		t.Errorf("Expected an explanation, got %s", rec.Body.String())
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := get("/policy?domain=http.example", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, rec.Code)
+		}
+	}
+	if rec := get("/policy?domain=-invalid-", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid domain, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/policy?domain=http.example", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	servePolicy(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rec.Code)
+	}
+}
+
+func TestHttpPolicyCached(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "cached.http.example")
+	startFakeDns(t, z)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		servePolicy(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	first := get("/policy?domain=cached.http.example")
+	hits := cacheHits.Load()
+	second := get("/policy?domain=cached.http.example")
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("Expected the cached result %s, got %d: %s", first.Body.String(), second.Code, second.Body.String())
+	}
+	if cacheHits.Load() != hits+1 {
+		t.Error("Expected the second request to be answered from the cache")
+	}
+
+	// Evaluations wait for a free slot like socketmap queries
+	prevSlots, prevTimeout := evalSlots.Load(), evalQueueTimeout
+	setMaxConcurrent(1)
+	evalQueueTimeout = 10 * time.Millisecond
+	defer func() {
+		evalSlots.Store(prevSlots)
+		evalQueueTimeout = prevTimeout
+	}()
+	release, _ := acquireEvalSlot()
+	defer release()
+	if rec := get("/policy?domain=cached.http.example&explain"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a free evaluation slot, got %d", rec.Code)
+	}
+	if rec := get("/policy?domain=cached.http.example"); rec.Code != http.StatusOK {
+		t.Errorf("Expected cached results to be served without a free slot, got %d", rec.Code)
+	}
+}
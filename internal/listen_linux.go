@@ -0,0 +1,66 @@
+//go:build linux
+
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the configured socket options before the listener is bound
+func controlListener(network string, address string, c syscall.RawConn) error {
+	config := getConfig()
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if config.Server.ReuseAddr {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+		}
+		if config.Server.ReusePort {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Runs fn with the process umask set to mask, restoring the previous umask afterwards
+func withUmask(mask int, fn func()) {
+	prev := unix.Umask(mask)
+	defer unix.Umask(prev)
+	fn()
+}
+
+// Go always listens with the system maximum, calling listen() again adjusts the backlog
+func setListenBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = c.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package tlspol
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReusePort(t *testing.T) {
+	config := getConfig()
+	prev := config.Server.ReusePort
+	config.Server.ReusePort = true
+	defer func() { config.Server.ReusePort = prev }()
+	lc := net.ListenConfig{Control: controlListener}
+	first, err := lc.Listen(bgCtx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer first.Close()
+	if err := setListenBacklog(first, 16); err != nil {
+		t.Errorf("Could not set listen backlog: %v", err)
+	}
+	second, err := lc.Listen(bgCtx, "tcp", first.Addr().String())
+	if err != nil {
+		t.Fatalf("Second listener should share the port: %v", err)
+	}
+	second.Close()
+}
+
+func TestWithUmask(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	prev := unix.Umask(0o022)
+	defer unix.Umask(prev)
+	withUmask(0o077, func() {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+	if mask := unix.Umask(0o022); mask != 0o022 {
+		t.Errorf("Expected the umask to be restored to 022, got %o", mask)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net"
+	"syscall"
+)
+
+func controlListener(network string, address string, c syscall.RawConn) error {
+	config := getConfig()
+	if config.Server.ReuseAddr || config.Server.ReusePort {
+		log.Warn("reuse_addr and reuse_port are only supported on Linux, ignoring")
+	}
+	return nil
+}
+
+func withUmask(mask int, fn func()) {
+	fn()
+}
+
+func setListenBacklog(listener net.Listener, backlog int) error {
+	log.Warn("listen_backlog is only supported on Linux, ignoring")
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type memCacheEntry struct {
+	key     string
+	entry   *cacheEntry
+	expires time.Time
+}
+
+// Least recently used cache entries, serving as the cache if Valkey is disabled or unreachable
+var memCache = struct {
+	sync.Mutex
+	lru *list.List
+	m   map[string]*list.Element
+}{lru: list.New(), m: make(map[string]*list.Element)}
+
+func memCacheGet(key string) (*cacheEntry, uint32, bool) {
+	config := getConfig()
+	if config.Cache.MemoryEntries == 0 {
+		return nil, 0, false
+	}
+	memCache.Lock()
+	defer memCache.Unlock()
+	el, ok := memCache.m[key]
+	if !ok {
+		return nil, 0, false
+	}
+	e := el.Value.(*memCacheEntry)
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		memCache.lru.Remove(el)
+		delete(memCache.m, key)
+		return nil, 0, false
+	}
+	memCache.lru.MoveToFront(el)
+	return e.entry, uint32(ttl.Seconds()), true
+}
+
+func memCacheDelete(key string) bool {
+	memCache.Lock()
+	defer memCache.Unlock()
+	el, ok := memCache.m[key]
+	if !ok {
+		return false
+	}
+	memCache.lru.Remove(el)
+	delete(memCache.m, key)
+	return time.Now().Before(el.Value.(*memCacheEntry).expires)
+}
+
+// Unexpired entries, for the cache statistics
+func memCacheEntries() []CacheStruct {
+	memCache.Lock()
+	defer memCache.Unlock()
+	now := time.Now()
+	entries := make([]CacheStruct, 0, memCache.lru.Len())
+	for el := memCache.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*memCacheEntry); now.Before(e.expires) {
+			entries = append(entries, e.entry.data)
+		}
+	}
+	return entries
+}
+
+// Keys of the unexpired entries, for exporting the cache
+func memCacheKeys() []string {
+	memCache.Lock()
+	defer memCache.Unlock()
+	now := time.Now()
+	keys := make([]string, 0, memCache.lru.Len())
+	for el := memCache.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*memCacheEntry); now.Before(e.expires) {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
+func memCacheSet(key string, data CacheStruct, ttl time.Duration) {
+	config := getConfig()
+	if config.Cache.MemoryEntries == 0 {
+		return
+	}
+	e := &memCacheEntry{key: key, entry: newCacheEntry("", data), expires: time.Now().Add(ttl)}
+	memCache.Lock()
+	defer memCache.Unlock()
+	if el, ok := memCache.m[key]; ok {
+		el.Value = e
+		memCache.lru.MoveToFront(el)
+		return
+	}
+	memCache.m[key] = memCache.lru.PushFront(e)
+	for memCache.lru.Len() > int(config.Cache.MemoryEntries) {
+		oldest := memCache.lru.Back()
+		memCache.lru.Remove(oldest)
+		delete(memCache.m, oldest.Value.(*memCacheEntry).key)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"sync"
+	"time"
+)
+
+const MEMO_MAX_ENTRIES = 1024
+
+type memoEntry struct {
+	result  PolicyResult
+	expires time.Time
+}
+
+// Remembers freshly evaluated results for a very short time, to absorb bursts of identical
+// queries that arrive before the result is written to the cache
+var memo = struct {
+	sync.Mutex
+	m map[string]memoEntry
+}{m: make(map[string]memoEntry)}
+
+type flight struct {
+	done chan struct{}
+	res  PolicyResult
+	ok   bool
+}
+
+// Evaluations in progress, so that concurrent identical queries share a single one
+var flights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: make(map[string]*flight)}
+
+// Runs eval once for all concurrent callers with the same key, shared is set for
+// the callers that got the result of another one's evaluation
+func coalesce(key string, eval func() (PolicyResult, bool)) (res PolicyResult, ok bool, shared bool) {
+	flights.Lock()
+	if f, inFlight := flights.m[key]; inFlight {
+		flights.Unlock()
+		<-f.done
+		return f.res, f.ok, true
+	}
+	f := &flight{done: make(chan struct{})}
+	flights.m[key] = f
+	flights.Unlock()
+
+	defer func() {
+		flights.Lock()
+		delete(flights.m, key)
+		flights.Unlock()
+		close(f.done)
+	}()
+	f.res, f.ok = eval()
+	return f.res, f.ok, false
+}
+
+func memoGet(key string) (PolicyResult, bool) {
+	config := getConfig()
+	if config.Server.MemoizeWindow == 0 {
+		return PolicyResult{}, false
+	}
+	memo.Lock()
+	defer memo.Unlock()
+	e, ok := memo.m[key]
+	if !ok {
+		return PolicyResult{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(memo.m, key)
+		return PolicyResult{}, false
+	}
+	return e.result, true
+}
+
+func memoSet(key string, result PolicyResult) {
+	config := getConfig()
+	if config.Server.MemoizeWindow == 0 {
+		return
+	}
+	now := time.Now()
+	memo.Lock()
+	defer memo.Unlock()
+	if len(memo.m) >= MEMO_MAX_ENTRIES {
+		for k, e := range memo.m {
+			if now.After(e.expires) {
+				delete(memo.m, k)
+			}
+		}
+		if len(memo.m) >= MEMO_MAX_ENTRIES {
+			return // all entries are still fresh, skip rather than grow
+		}
+	}
+	memo.m[key] = memoEntry{result: result, expires: now.Add(time.Duration(config.Server.MemoizeWindow) * time.Millisecond)}
+}
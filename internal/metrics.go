@@ -0,0 +1,114 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the DNS latency histogram
+var dnsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	bounds  []float64
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	sumUs   atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	for i, bound := range h.bounds {
+		if d.Seconds() <= bound {
+			h.buckets[i].Add(1)
+		}
+	}
+	h.count.Add(1)
+	h.sumUs.Add(uint64(d.Microseconds()))
+}
+
+// Counters exposed on metrics.address in the Prometheus text format
+var metrics = struct {
+	queries      atomic.Uint64
+	notFound     atomic.Uint64
+	ok           atomic.Uint64
+	temp         atomic.Uint64
+	perm         atomic.Uint64
+	danePolicies atomic.Uint64
+	stsPolicies  atomic.Uint64
+	noPolicies   atomic.Uint64
+	dnsErrors    atomic.Uint64
+	dnsLatency   *histogram
+}{dnsLatency: newHistogram(dnsLatencyBuckets)}
+
+func writeCounter(w io.Writer, name string, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for labels := range values {
+		keys = append(keys, labels)
+	}
+	slices.Sort(keys)
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, labels, values[labels])
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "tlspol_queries_total", "Socketmap queries received.", map[string]uint64{"": metrics.queries.Load()})
+	writeCounter(w, "tlspol_replies_total", "Socketmap replies by verdict.", map[string]uint64{
+		`{verdict="ok"}`:       metrics.ok.Load(),
+		`{verdict="notfound"}`: metrics.notFound.Load(),
+		`{verdict="temp"}`:     metrics.temp.Load(),
+		`{verdict="perm"}`:     metrics.perm.Load(),
+	})
+	writeCounter(w, "tlspol_cache_hits_total", "Queries answered from the cache.", map[string]uint64{"": cacheHits.Load()})
+	writeCounter(w, "tlspol_cache_misses_total", "Queries that required an evaluation.", map[string]uint64{"": cacheMisses.Load()})
+	writeCounter(w, "tlspol_policies_total", "Evaluations by the mechanism that determined the policy, none if there was no usable one.", map[string]uint64{
+		`{source="dane"}`:    metrics.danePolicies.Load(),
+		`{source="mta-sts"}`: metrics.stsPolicies.Load(),
+		`{source="none"}`:    metrics.noPolicies.Load(),
+	})
+	writeCounter(w, "tlspol_disagreements_total", "Evaluations where DANE and MTA-STS disagreed.", map[string]uint64{"": disagreements.Load()})
+	writeCounter(w, "tlspol_dns_errors_total", "DNS queries that failed with a network error on all resolvers.", map[string]uint64{"": metrics.dnsErrors.Load()})
+
+	h := metrics.dnsLatency
+	name := "tlspol_dns_query_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of DNS queries to the resolvers.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i].Load())
+	}
+	count := h.count.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(float64(h.sumUs.Load())/1e6, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func startMetricsServer() {
+	config := getConfig()
+	if len(config.Metrics.Address) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	srv := newHttpServer(config.Metrics.Address, mux)
+	go func() {
+		log.Debugf("Serving metrics on http://%s/metrics", config.Metrics.Address)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Errorf("Error starting metrics server: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package tlspol
+
+import (
+	"bufio"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Could not scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid metric line %q", line)
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "metrics.example")
+	startFakeDns(t, z)
+	ts := httptest.NewServer(http.HandlerFunc(serveMetrics))
+	defer ts.Close()
+	before := scrapeMetrics(t, ts.URL)
+
+	server, client := net.Pipe()
+	go handleConnection(&server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	// Only the two lookups count as queries
+	for _, q := range []string{"QUERY metrics.example", "PING", "CAPS", "BOGUS metrics.example", "QUERY 192.0.2.1"} {
+		client.Write(netstring.Marshal(q))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", q, replies.Err())
+		}
+	}
+
+	after := scrapeMetrics(t, ts.URL)
+	for metric, increment := range map[string]float64{
+		"tlspol_queries_total":                     2,
+		`tlspol_replies_total{verdict="ok"}`:       1,
+		`tlspol_replies_total{verdict="notfound"}`: 1,
+		`tlspol_policies_total{source="dane"}`:     1,
+		"tlspol_cache_misses_total":                1,
+	} {
+		if after[metric]-before[metric] != increment {
+			t.Errorf("Expected %s to increase by %v, got %v -> %v", metric, increment, before[metric], after[metric])
+		}
+	}
+	if after["tlspol_dns_query_duration_seconds_count"] <= before["tlspol_dns_query_duration_seconds_count"] {
+		t.Errorf("Expected DNS queries to be observed")
+	}
+	if after[`tlspol_dns_query_duration_seconds_bucket{le="+Inf"}`] != after["tlspol_dns_query_duration_seconds_count"] {
+		t.Errorf("Expected the +Inf bucket to match the count")
+	}
+}
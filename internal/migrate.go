@@ -0,0 +1,70 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Schema of cache entries written before entries carried their own schema
+const UNVERSIONED_SCHEMA = "3"
+
+// Upgrades a raw cache entry from one schema to the next
+type migration struct {
+	to      string
+	migrate func(entry map[string]any) error
+}
+
+// Migrations keyed by the schema they upgrade from, schemas without a path to DB_SCHEMA are purged.
+// A field-compatible schema bump only needs an entry here to keep the cache across the upgrade.
+var migrations = map[string]migration{
+	"3": {to: "4", migrate: func(entry map[string]any) error {
+		// Only adds the schema field to each entry
+		return nil
+	}},
+}
+
+// Whether entries of the given schema can be upgraded to DB_SCHEMA
+func canMigrate(schema string) bool {
+	for steps := 0; schema != DB_SCHEMA; steps++ {
+		m, ok := migrations[schema]
+		if !ok || steps > len(migrations) {
+			return false
+		}
+		schema = m.to
+	}
+	return true
+}
+
+// Upgrades a raw cache entry to DB_SCHEMA
+func migrateEntry(jsonData []byte) (CacheStruct, error) {
+	var data CacheStruct
+	entry := make(map[string]any)
+	if err := json.Unmarshal(jsonData, &entry); err != nil {
+		return data, err
+	}
+	schema := UNVERSIONED_SCHEMA
+	if s, ok := entry["s"].(string); ok {
+		schema = s
+	}
+	for steps := 0; schema != DB_SCHEMA; steps++ {
+		m, ok := migrations[schema]
+		if !ok || steps > len(migrations) {
+			return data, fmt.Errorf("No migration for cache schema %q", schema)
+		}
+		if err := m.migrate(entry); err != nil {
+			return data, fmt.Errorf("Could not migrate cache entry from schema %q to %q: %v", schema, m.to, err)
+		}
+		schema = m.to
+		entry["s"] = schema
+	}
+	migrated, err := json.Marshal(entry)
+	if err != nil {
+		return data, err
+	}
+	return data, json.Unmarshal(migrated, &data)
+}
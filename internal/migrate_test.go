@@ -0,0 +1,71 @@
+package tlspol
+
+import (
+	"testing"
+)
+
+func TestMigrateUnversionedEntry(t *testing.T) {
+	data, err := migrateEntry([]byte(`{"d":"example.com","r":"dane-only","p":"","t":3600}`))
+	if err != nil {
+		t.Fatalf("Could not migrate entry: %v", err)
+	}
+	if data.Schema != DB_SCHEMA || data.Domain != "example.com" || data.Result != "dane-only" || data.Ttl != 3600 {
+		t.Errorf("Unexpected migrated entry: %+v", data)
+	}
+}
+
+func TestMigrateUnknownSchema(t *testing.T) {
+	if canMigrate("1") {
+		t.Error("Schema 1 has no migration path and must be purged")
+	}
+	if !canMigrate(UNVERSIONED_SCHEMA) {
+		t.Errorf("Schema %s should be migratable to %s", UNVERSIONED_SCHEMA, DB_SCHEMA)
+	}
+	if _, err := migrateEntry([]byte(`{"s":"1","d":"example.com"}`)); err == nil {
+		t.Error("Expected an error for an entry without migration path")
+	}
+
+	migrations["5"] = migration{to: "6", migrate: func(map[string]any) error { return nil }}
+	migrations["6"] = migration{to: "5", migrate: func(map[string]any) error { return nil }}
+	defer func() {
+		delete(migrations, "5")
+		delete(migrations, "6")
+	}()
+	if canMigrate("5") {
+		t.Error("Expected a cycle of migrations not to reach the current schema")
+	}
+}
+
+func TestMigrateChain(t *testing.T) {
+	// A v2 entry named the result "result" and had no report yet
+	migrations["2"] = migration{to: "3", migrate: func(entry map[string]any) error {
+		if result, ok := entry["result"]; ok {
+			entry["r"] = result
+			delete(entry, "result")
+		}
+		if _, ok := entry["p"]; !ok {
+			entry["p"] = ""
+		}
+		return nil
+	}}
+	defer delete(migrations, "2")
+
+	if !canMigrate("2") {
+		t.Fatalf("Schema 2 should be migratable to %s through schema 3", DB_SCHEMA)
+	}
+	v2 := `{"s":"2","d":"example.com","result":"dane-only","t":3600}`
+	data, err := migrateEntry([]byte(v2))
+	if err != nil {
+		t.Fatalf("Could not migrate entry: %v", err)
+	}
+	if data.Schema != DB_SCHEMA || data.Domain != "example.com" || data.Result != "dane-only" || data.Ttl != 3600 {
+		t.Errorf("Unexpected migrated entry: %+v", data)
+	}
+
+	// Entries read from the cache are flagged, so that they are written back in the new schema
+	key := CACHE_KEY_PREFIX + "migrate.example"
+	e, migrated, err := decodeCacheEntry(&key, v2)
+	if err != nil || !migrated || e.data.Schema != DB_SCHEMA || e.data.Result != "dane-only" {
+		t.Errorf("Expected the entry to be migrated on read, got %+v (migrated=%v, %v)", e, migrated, err)
+	}
+}
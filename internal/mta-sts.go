@@ -7,47 +7,152 @@ package tlspol
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	valid "github.com/asaskevich/govalidator/v11"
 	"github.com/miekg/dns"
 )
 
-func checkMtaStsRecord(ctx *context.Context, domain *string) (bool, error) {
+// Parses the id field of an MTA-STS TXT record (see [RFC 8461, 3.1])
+func parseMtaStsId(record string) string {
+	for _, field := range strings.Split(record, ";") {
+		keyVal := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyVal) != 2 || strings.TrimSpace(keyVal[0]) != "id" {
+			continue
+		}
+		id := strings.TrimSpace(keyVal[1])
+		if len(id) == 0 || len(id) > 32 || !valid.IsAlphanumeric(id) {
+			return ""
+		}
+		return id
+	}
+	return ""
+}
+
+func checkMtaStsRecord(ctx *context.Context, domain *string) (bool, string, error) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn("_mta-sts."+(*domain)), dns.TypeTXT)
-	m.SetEdns0(1232, false)
+	setEdns0(m, false)
 
-	r, _, err := client.ExchangeContext(*ctx, m, config.Dns.Address)
+	r, err := exchange(ctx, m)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 	switch r.Rcode {
-	case dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeServerFailure:
+	case dns.RcodeServerFailure:
+		// Treated as no record, but reported for debugging
+		getEvaluation(ctx).failMtaSts("TXT lookup for _mta-sts.%s failed: SERVFAIL from resolver", *domain)
+	case dns.RcodeSuccess, dns.RcodeNameError:
 	default:
-		return false, errors.New(dns.RcodeToString[r.Rcode])
+		return false, "", errors.New(dns.RcodeToString[r.Rcode])
 	}
 	if len(r.Answer) == 0 {
-		return false, nil
+		return false, "", nil
 	}
 
 	for _, answer := range r.Answer {
 		if txt, ok := answer.(*dns.TXT); ok {
-			for _, txtRecord := range txt.Txt {
-				if strings.HasPrefix(txtRecord, "v=STSv1") {
-					return true, nil
-				}
+			// Long TXT records may be split into multiple strings
+			txtRecord := strings.Join(txt.Txt, "")
+			if strings.HasPrefix(txtRecord, "v=STSv1") {
+				return true, parseMtaStsId(txtRecord), nil
 			}
 		}
 	}
 
-	return false, nil
+	return false, "", nil
+}
+
+var errMtaStsBreakerOpen = errors.New("all addresses of the MTA-STS host are failing")
+
+// Circuit breakers by IP address, as many domains usually share the MTA-STS host of their provider
+var mtaStsBreakers = struct {
+	sync.Mutex
+	m map[string]*circuitBreaker
+}{m: make(map[string]*circuitBreaker)}
+
+func getMtaStsBreaker(ip string) *circuitBreaker {
+	mtaStsBreakers.Lock()
+	defer mtaStsBreakers.Unlock()
+	b, ok := mtaStsBreakers.m[ip]
+	if !ok {
+		b = &circuitBreaker{}
+		mtaStsBreakers.m[ip] = b
+	}
+	return b
+}
+
+func mtaStsHostFailed(ip string) {
+	config := getConfig()
+	if config.MtaSts.BreakerThreshold == 0 {
+		return
+	}
+	window := time.Duration(config.MtaSts.BreakerWindow) * time.Second
+	cooldown := time.Duration(config.MtaSts.BreakerCooldown) * time.Second
+	if getMtaStsBreaker(ip).Failure(config.MtaSts.BreakerThreshold, window, cooldown) {
+		log.Warnf("MTA-STS host %s failed %d times in a row, pausing for %ds", ip, config.MtaSts.BreakerThreshold, config.MtaSts.BreakerCooldown)
+	}
+}
+
+func mtaStsHostSucceeded(ip string) {
+	config := getConfig()
+	if config.MtaSts.BreakerThreshold == 0 {
+		return
+	}
+	mtaStsBreakers.Lock()
+	defer mtaStsBreakers.Unlock()
+	delete(mtaStsBreakers.m, ip)
+	// Drop breakers of hosts that recovered silently
+	window := time.Duration(config.MtaSts.BreakerWindow) * time.Second
+	for k, b := range mtaStsBreakers.m {
+		if b.Idle(window) {
+			delete(mtaStsBreakers.m, k)
+		}
+	}
+}
+
+var mtaStsDialer = &net.Dialer{Timeout: REQUEST_TIMEOUT}
+
+// Dials the first address of the MTA-STS host that is not paused by its circuit breaker
+func dialMtaStsHost(ctx context.Context, network string, addr string) (net.Conn, error) {
+	config := getConfig()
+	if config.MtaSts.BreakerThreshold == 0 {
+		return mtaStsDialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = errMtaStsBreakerOpen
+	for _, ip := range ips {
+		if !getMtaStsBreaker(ip.IP.String()).Allow() {
+			continue
+		}
+		var conn net.Conn
+		conn, err = mtaStsDialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
 }
 
 var httpClient = &http.Client{
@@ -60,9 +165,28 @@ var httpClient = &http.Client{
 			InsecureSkipVerify: false,            // Ensure SSL certificate validation
 			MinVersion:         tls.VersionTLS12, // set minimum to TLSv1.2
 		},
-		DisableKeepAlives: true,
+		DialContext: dialMtaStsHost,
+		// Keep connections to policy hosts for the next fetch, many domains share the same host
+		MaxIdleConns:        256,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: REQUEST_TIMEOUT,
 	},
-	Timeout: REQUEST_TIMEOUT, // Set a timeout for the request
+	Timeout: REQUEST_TIMEOUT, // Hard limit, mtasts.fetch_timeout can only shorten it
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Time a policy fetch may take, mtasts.fetch_timeout capped at REQUEST_TIMEOUT
+func mtaStsFetchTimeout() time.Duration {
+	config := getConfig()
+	if config.MtaSts.FetchTimeout == 0 {
+		return REQUEST_TIMEOUT
+	}
+	return min(time.Duration(config.MtaSts.FetchTimeout)*time.Second, REQUEST_TIMEOUT)
 }
 
 func parseLine(mxServers *[]string, mode *string, maxAge *uint32, report *string, mxHosts *string, existingKeys *map[string]bool, line string) bool {
@@ -97,60 +221,351 @@ func parseLine(mxServers *[]string, mode *string, maxAge *uint32, report *string
 			val = val[1:]
 		}
 		*mxServers = append(*mxServers, val)
+	case "version":
+		if val != "STSv1" {
+			return false // unsupported version
+		}
 	case "mode":
+		if val != "enforce" && val != "testing" && val != "none" {
+			return false // invalid policy
+		}
 		*mode = val
 	case "max_age":
-		age, err := strconv.ParseUint(val, 10, 32)
-		if err == nil {
-			*maxAge = uint32(age)
+		age, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return false // invalid policy
 		}
+		*maxAge = uint32(min(age, MTASTS_MAX_AGE))
 	default:
 	}
 	return true
 }
 
+// Max value of max_age in seconds (see [RFC 8461, 3.2])
+const MTASTS_MAX_AGE = 31557600
+
+// Caps max_age at mtasts.max_age_cap, if set
+func capMtaStsMaxAge(maxAge uint32) uint32 {
+	config := getConfig()
+	if limit := config.MtaSts.MaxAgeCap; limit != 0 {
+		return min(maxAge, limit)
+	}
+	return maxAge
+}
+
+// Parses a policy body line by line, the report holds the mx_host_pattern and policy_string fields
+func parseMtaStsPolicy(body []byte) (mxServers []string, mode string, maxAge uint32, report string, ok bool) {
+	mxHosts := ""
+	existingKeys := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(body)) // also strips the \r of CRLF line endings
+	for scanner.Scan() {
+		if !parseLine(&mxServers, &mode, &maxAge, &report, &mxHosts, &existingKeys, scanner.Text()) {
+			return nil, "", 0, "", false
+		}
+	}
+	if scanner.Err() != nil || !existingKeys["version"] || len(mode) == 0 {
+		return nil, "", 0, "", false
+	}
+	if mode == "enforce" && maxAge == 0 {
+		return nil, "", 0, "", false // an enforced policy must be cached for some time
+	}
+	return mxServers, mode, maxAge, mxHosts + report, true
+}
+
+const MTASTS_MAX_ENTRIES = 4096
+
+// Used when mtasts.max_body_bytes is unset
+const MTASTS_MAX_BODY_BYTES = 64 * 1024
+
+type mtaStsEntry struct {
+	id       string
+	mode     string
+	report   string
+	patterns []string
+	expires  time.Time
+}
+
+// Fetched policies by domain, reused until the id in the TXT record changes or max_age has passed
+var mtaStsCache = struct {
+	sync.Mutex
+	m map[string]mtaStsEntry
+}{m: make(map[string]mtaStsEntry)}
+
+func getCachedMtaSts(domain string, id string) (mtaStsEntry, bool) {
+	if len(id) == 0 {
+		return mtaStsEntry{}, false
+	}
+	mtaStsCache.Lock()
+	defer mtaStsCache.Unlock()
+	e, ok := mtaStsCache.m[domain]
+	if !ok || e.id != id || time.Now().After(e.expires) {
+		return mtaStsEntry{}, false
+	}
+	return e, true
+}
+
+func setCachedMtaSts(domain string, e mtaStsEntry, maxAge uint32) {
+	if len(e.id) == 0 || maxAge == 0 {
+		return
+	}
+	now := time.Now()
+	e.expires = now.Add(time.Duration(maxAge) * time.Second)
+	mtaStsCache.Lock()
+	defer mtaStsCache.Unlock()
+	if len(mtaStsCache.m) >= MTASTS_MAX_ENTRIES {
+		for k, e := range mtaStsCache.m {
+			if now.After(e.expires) {
+				delete(mtaStsCache.m, k)
+			}
+		}
+	}
+	if len(mtaStsCache.m) < MTASTS_MAX_ENTRIES {
+		mtaStsCache.m[domain] = e
+	}
+}
+
 func checkMtaSts(ctx *context.Context, domain *string) (string, string, uint32) {
-	hasRecord, err := checkMtaStsRecord(ctx, domain)
+	config := getConfig()
+	ev := getEvaluation(ctx)
+	hasRecord, id, err := checkMtaStsRecord(ctx, domain)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
-			log.Warnf("DNS error during MTA-STS lookup for %q: %v", *domain, err)
+			log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("DNS error during MTA-STS lookup for %q: %v", *domain, err)
 		}
+		ev.failMtaSts("TXT lookup for _mta-sts.%s failed: %s", *domain, describeDnsError(err))
 		return "", "", 0
 	}
 	if !hasRecord {
+		ev.explainMtaSts("No MTA-STS TXT record at _mta-sts.%s, MTA-STS does not apply", *domain)
 		return "", "", 0
 	}
+	// The id only changes with the policy, so there is no need to fetch it again (see [RFC 8461, 5.1])
+	if e, ok := getCachedMtaSts(*domain, id); ok {
+		log.Debugf("MTA-STS policy id %q of %q is unchanged, using the fetched policy", id, *domain)
+		ev.setStsMxPatterns(e.patterns)
+		ev.explainMtaSts("Policy id %s is unchanged, reusing the policy fetched before", id)
+		policy, ttl := mtaStsPolicy(ctx, domain, e.mode, e.patterns, uint32(time.Until(e.expires).Seconds()))
+		return policy, e.report, ttl
+	}
 
 	mtaSTSURL := "https://mta-sts." + (*domain) + "/.well-known/mta-sts.txt"
-	req, err := http.NewRequestWithContext(*ctx, http.MethodGet, mtaSTSURL, nil)
+	fetchCtx, cancel := context.WithTimeout(*ctx, mtaStsFetchTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, mtaSTSURL, nil)
 	if err != nil {
 		return "", "", 0
 	}
 	req.Header.Set("User-Agent", "postfix-tlspol/"+Version)
+	remoteIp := ""
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		ConnectDone: func(network string, addr string, err error) {
+			ip, _, _ := net.SplitHostPort(addr)
+			if err != nil {
+				mtaStsHostFailed(ip)
+			} else {
+				remoteIp = ip
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			// A reused connection skips ConnectDone
+			if info.Reused {
+				remoteIp, _, _ = net.SplitHostPort(info.Conn.RemoteAddr().String())
+			}
+		},
+	}))
 	resp, err := httpClient.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
+		if errors.Is(err, errMtaStsBreakerOpen) {
+			log.Debugf("Skipping MTA-STS policy fetch for %q: %v", *domain, err)
+			ev.failMtaSts("Policy fetch from %s skipped: %v", mtaSTSURL, err)
+			return "TEMP", "", 0
+		}
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			// A policy host without a valid certificate may be under attack, don't silently drop the policy
+			log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("Invalid certificate of the MTA-STS policy host of %q: %v", *domain, err)
+			ev.failMtaSts("Policy fetch from %s failed, the certificate is invalid: %v", mtaSTSURL, err)
+			return "TEMP", "", 0
+		}
+		if len(remoteIp) != 0 && !errors.Is(err, context.Canceled) {
+			mtaStsHostFailed(remoteIp)
+		}
+		ev.failMtaSts("Policy fetch from %s failed: %v", mtaSTSURL, err)
+		if isTimeout(err) {
+			log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("MTA-STS policy fetch for %q timed out", *domain)
+			return "TEMP", "", 0
+		}
 		return "", "", 0
 	}
 	defer resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 || resp.TLS.PeerCertificates[0].VerifyHostname("mta-sts."+(*domain)) != nil {
+		log.With(log.Fields{"domain": *domain}).Warnf("MTA-STS policy of %q was not served with a certificate for mta-sts.%s", *domain, *domain)
+		ev.failMtaSts("Policy from %s was not served with a certificate for its host", mtaSTSURL)
+		return "TEMP", "", 0
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		// Redirects are not allowed (see [RFC 8461, 3.3])
+		log.With(log.Fields{"domain": *domain}).Warnf("MTA-STS policy fetch for %q was redirected to %q", *domain, resp.Header.Get("Location"))
+		ev.failMtaSts("Policy fetch from %s was redirected, which is not allowed", mtaSTSURL)
+		return "TEMP", "", 0
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		mtaStsHostFailed(remoteIp)
+	} else {
+		mtaStsHostSucceeded(remoteIp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		ev.failMtaSts("Policy fetch from %s failed with HTTP status %d", mtaSTSURL, resp.StatusCode)
+		return "", "", 0
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		// The policy must be served as text/plain (see [RFC 8461, 3.2])
+		log.With(log.Fields{"domain": *domain}).Warnf("MTA-STS policy of %q has an invalid content type %q", *domain, resp.Header.Get("Content-Type"))
+		ev.failMtaSts("Policy from %s has an invalid content type %q", mtaSTSURL, resp.Header.Get("Content-Type"))
+		return "", "", 0
+	}
+	maxBody := int64(config.MtaSts.MaxBodyBytes)
+	if maxBody == 0 {
+		maxBody = MTASTS_MAX_BODY_BYTES
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		ev.failMtaSts("Policy fetch from %s failed: %v", mtaSTSURL, err)
+		if isTimeout(err) {
+			log.With(log.Fields{"domain": *domain, "error": err.Error()}).Warnf("MTA-STS policy fetch for %q timed out", *domain)
+			return "TEMP", "", 0
+		}
+		return "", "", 0
+	}
+	if int64(len(body)) > maxBody {
+		log.With(log.Fields{"domain": *domain}).Warnf("MTA-STS policy of %q exceeds %d bytes", *domain, maxBody)
+		ev.failMtaSts("Policy from %s exceeds %d bytes", mtaSTSURL, maxBody)
+		return "", "", 0
+	}
 
-	var mxServers []string
-	mode := ""
-	var maxAge uint32 = 0
-	report := ""
-	mxHosts := ""
-	existingKeys := make(map[string]bool)
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		if !parseLine(&mxServers, &mode, &maxAge, &report, &mxHosts, &existingKeys, scanner.Text()) {
-			return "", "", 0
+	mxServers, mode, maxAge, report, ok := parseMtaStsPolicy(body)
+	if !ok {
+		ev.failMtaSts("Policy from %s is invalid", mtaSTSURL)
+		return "", "", 0
+	}
+	report = "policy_type=sts policy_domain=" + (*domain) + report
+	maxAge = capMtaStsMaxAge(maxAge)
+
+	patterns := make([]string, len(mxServers))
+	for i, mx := range mxServers {
+		if strings.HasPrefix(mx, ".") {
+			mx = "*" + mx
+		}
+		patterns[i] = mx
+	}
+	ev.setStsMxPatterns(patterns)
+
+	switch mode {
+	case "enforce":
+		ev.explainMtaSts("Policy is in mode=enforce for MX hosts %s", strings.Join(patterns, ", "))
+	case "testing":
+		// The report is kept for TLS-RPT even if the policy is not honored (see [RFC 8461, 5])
+		if config.MtaSts.HonorTesting {
+			ev.explainMtaSts("Policy is in mode=testing for MX hosts %s, TLS is opportunistic", strings.Join(patterns, ", "))
+		} else {
+			ev.explainMtaSts("Policy is in mode=testing, MTA-STS is not enforced")
+		}
+		log.Debugf("MTA-STS policy of %q is in testing mode", *domain)
+	default:
+		ev.explainMtaSts("Policy is in mode=%s, MTA-STS is not enforced", mode)
+		report = ""
+	}
+	setCachedMtaSts(*domain, mtaStsEntry{id: id, mode: mode, report: report, patterns: patterns}, maxAge)
+	policy, ttl := mtaStsPolicy(ctx, domain, mode, patterns, maxAge)
+	return policy, report, ttl
+}
+
+// Translates a fetched policy into a Postfix TLS policy, valid for ttl or until the MX records
+// that wildcard patterns were expanded to expire
+func mtaStsPolicy(ctx *context.Context, domain *string, mode string, patterns []string, ttl uint32) (string, uint32) {
+	config := getConfig()
+	switch mode {
+	case "enforce":
+		match, mxTtl, expanded := mtaStsMatch(ctx, domain, patterns)
+		if expanded {
+			ttl = min(ttl, mxTtl)
 		}
+		return "secure match=" + strings.Join(match, ":") + " servername=hostname", ttl
+	case "testing":
+		if config.MtaSts.HonorTesting {
+			return "may", ttl
+		}
+	}
+	return "", ttl
+}
+
+type nextHopKey struct{}
+
+// Delivers to the MX hosts of another domain than the recipient domain, as with QUERY recipient nexthop
+func withNextHop(ctx context.Context, nextHop string) context.Context {
+	return context.WithValue(ctx, nextHopKey{}, nextHop)
+}
+
+// Domain whose MX hosts receive the mail of a recipient domain
+func nextHopOf(ctx *context.Context, domain string) string {
+	if nextHop, _ := (*ctx).Value(nextHopKey{}).(string); len(nextHop) != 0 {
+		return nextHop
 	}
-	report = "policy_type=sts policy_domain=" + (*domain) + mxHosts + report
+	return domain
+}
 
-	if mode == "enforce" {
-		res := "secure match=" + strings.Join(mxServers, ":") + " servername=hostname"
-		return res, report, maxAge
+// Expands wildcard mx patterns to the MX hosts they match, as Postfix would also match
+// deeper subdomains with .example.com (see [RFC 8461, 4.1]). Returns the TTL of the MX
+// records if they were looked up, as the expansion is only valid as long as they are.
+func mtaStsMatch(ctx *context.Context, domain *string, patterns []string) ([]string, uint32, bool) {
+	var hosts []string
+	var ttl uint32
+	looked := false
+	var match []string
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "*.") {
+			match = append(match, pattern)
+			continue
+		}
+		if !looked {
+			looked = true
+			var err error
+			mxDomain := nextHopOf(ctx, *domain)
+			if hosts, ttl, err = lookupMxHosts(ctx, &mxDomain); err != nil {
+				log.Debugf("Could not expand wildcard MTA-STS mx patterns of %q: %v", *domain, err)
+			}
+		}
+		expanded := false
+		for _, host := range hosts {
+			if matchMxPattern(pattern, host) && !slices.Contains(match, host) {
+				match = append(match, host)
+				expanded = true
+			}
+		}
+		if !expanded {
+			match = append(match, pattern[1:]) // no MX host matches (yet), fall back to the parent domain
+		}
 	}
+	return match, ttl, looked
+}
 
-	return "", "", maxAge
+// Names of the MX hosts of a domain with the lowest TTL of the MX records, or of the negative answer
+func lookupMxHosts(ctx *context.Context, domain *string) ([]string, uint32, error) {
+	r, mxs, err := exchangeMx(ctx, domain)
+	if err != nil {
+		return nil, 0, err
+	}
+	var hosts []string
+	var ttls []uint32
+	for _, mx := range mxs {
+		ttls = append(ttls, mx.Hdr.Ttl)
+		if mx.Mx != "." {
+			hosts = append(hosts, strings.ToLower(strings.TrimSuffix(mx.Mx, ".")))
+		}
+	}
+	if len(ttls) == 0 {
+		ttl, _ := negativeTtl(r)
+		return hosts, ttl, nil
+	}
+	return hosts, findMin(&ttls), nil
 }
@@ -1,21 +1,38 @@
 package tlspol
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func init() {
-	config = Config{
+	activeConfig.Store(&Config{
 		Server: ServerConfig{},
 		Dns: DnsConfig{
-			Address: "dns.google:53",
+			Address:       "dns.google:53",
+			RequireDnssec: true,
+		},
+		Dane: DaneConfig{
+			Enable: true,
+		},
+		MtaSts: MtaStsConfig{
+			Enable: true,
 		},
 		Redis: RedisConfig{
 			Disable: true,
 		},
-	}
+	})
 }
 
 func TestMtaSts(t *testing.T) {
@@ -43,3 +60,278 @@ func TestMtaSts(t *testing.T) {
 		t.Error("All tests failed.")
 	}
 }
+
+func TestParseMtaStsId(t *testing.T) {
+	cases := map[string]string{
+		"v=STSv1; id=20160831085700Z;":  "20160831085700Z",
+		"v=STSv1;id=abc123":             "abc123",
+		"v=STSv1; id=":                  "",
+		"v=STSv1; id=not-alphanumeric;": "",
+		"v=STSv1;":                      "",
+	}
+	for record, expected := range cases {
+		if id := parseMtaStsId(record); id != expected {
+			t.Errorf("Expected id %q for %q, got %q", expected, record, id)
+		}
+	}
+}
+
+func TestParseMtaStsPolicy(t *testing.T) {
+	cases := []struct {
+		body string
+		mode string // empty if the policy is invalid
+		mx   string
+	}{
+		{"version: STSv1\r\nmode: enforce\r\nmx: mx.example.com\r\nmax_age: 86400\r\n", "enforce", "mx.example.com"},
+		{"version: STSv1\nmode: testing\nmode: enforce\nmx: mx.example.com\nmx: *.example.net\nmax_age: 86400", "testing", "mx.example.com .example.net"},
+		{"version: STSv1\nx-junk: a:b:c\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n", "enforce", "mx.example.com"},
+		{"version:STSv1\nmode:enforce\nmx:mx.example.com\nmax_age:86400", "enforce", "mx.example.com"},
+		{"mode: enforce\nmx: mx.example.com\nmax_age: 86400\n", "", ""},
+		{"version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n", "", ""},
+		{"version: STSv1\nmode: enforce:testing\nmx: mx.example.com\nmax_age: 86400\n", "", ""},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com:25\nmax_age: 86400\n", "", ""},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 1d\n", "", ""},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\njunk without colon\n", "", ""},
+	}
+	for _, c := range cases {
+		mxServers, mode, _, _, ok := parseMtaStsPolicy([]byte(c.body))
+		if !ok {
+			if len(c.mode) != 0 {
+				t.Errorf("Expected policy %q to be valid", c.body)
+			}
+			continue
+		}
+		if mode != c.mode || strings.Join(mxServers, " ") != c.mx {
+			t.Errorf("Unexpected mode %q and mx %q for policy %q", mode, mxServers, c.body)
+		}
+	}
+}
+
+func TestMtaStsMaxAge(t *testing.T) {
+	config := getConfig()
+	cases := []struct {
+		body   string
+		ok     bool
+		maxAge uint32
+	}{
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n", true, 86400},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 31557601\n", true, MTASTS_MAX_AGE},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 99999999999\n", true, MTASTS_MAX_AGE},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 0\n", false, 0},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\n", false, 0},
+		{"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: -1\n", false, 0},
+		{"version: STSv1\nmode: none\nmax_age: 0\n", true, 0},
+	}
+	for _, c := range cases {
+		_, _, maxAge, _, ok := parseMtaStsPolicy([]byte(c.body))
+		if ok != c.ok || maxAge != c.maxAge {
+			t.Errorf("Expected valid=%v and max_age %d for policy %q, got valid=%v and %d", c.ok, c.maxAge, c.body, ok, maxAge)
+		}
+	}
+
+	old := config.MtaSts.MaxAgeCap
+	defer func() { config.MtaSts.MaxAgeCap = old }()
+	config.MtaSts.MaxAgeCap = 0
+	if maxAge := capMtaStsMaxAge(MTASTS_MAX_AGE); maxAge != MTASTS_MAX_AGE {
+		t.Errorf("Expected max_age to be kept without mtasts.max_age_cap, got %d", maxAge)
+	}
+	config.MtaSts.MaxAgeCap = 3600
+	if maxAge := capMtaStsMaxAge(86400); maxAge != 3600 {
+		t.Errorf("Expected max_age to be capped at 3600, got %d", maxAge)
+	}
+	if maxAge := capMtaStsMaxAge(600); maxAge != 600 {
+		t.Errorf("Expected max_age below the cap to be kept, got %d", maxAge)
+	}
+}
+
+// Serves MTA-STS policies for all domains, with a certificate valid for example.com and its subdomains
+func startFakeMtaSts(t *testing.T, trusted bool, handler http.Handler) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewTLSServer(handler)
+	t.Cleanup(ts.Close)
+
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return mtaStsDialer.DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	if trusted {
+		roots := x509.NewCertPool()
+		roots.AddCert(ts.Certificate())
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	prevTransport := httpClient.Transport
+	httpClient.Transport = transport
+	t.Cleanup(func() { httpClient.Transport = prevTransport })
+	return ts
+}
+
+func TestMtaStsPolicyId(t *testing.T) {
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=1;"`)
+	startFakeDns(t, z)
+	var fetches atomic.Int32
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+
+	domain := "example.com"
+	for i := 0; i < 3; i++ {
+		if policy, _, _ := checkMtaSts(&bgCtx, &domain); policy != "secure match=mx.example.com servername=hostname" {
+			t.Fatalf("Unexpected policy %q", policy)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected the policy to be fetched once while the id is unchanged, got %d fetches", n)
+	}
+
+	z.Remove("_mta-sts.example.com", dns.TypeTXT)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=2;"`)
+	checkMtaSts(&bgCtx, &domain)
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected the policy to be fetched again after the id changed, got %d fetches", n)
+	}
+}
+
+func TestMtaStsFetchErrors(t *testing.T) {
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=fetcherrors;"`)
+	startFakeDns(t, z)
+	domain := "example.com"
+
+	startFakeMtaSts(t, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	if policy, _, _ := checkMtaSts(&bgCtx, &domain); policy != "TEMP" {
+		t.Errorf("Expected TEMP for a policy served with an untrusted certificate, got %q", policy)
+	}
+
+	startFakeMtaSts(t, true, http.RedirectHandler("https://mta-sts.example.com/elsewhere.txt", http.StatusFound))
+	if policy, _, _ := checkMtaSts(&bgCtx, &domain); policy != "TEMP" {
+		t.Errorf("Expected TEMP for a redirected policy, got %q", policy)
+	}
+}
+
+func TestMtaStsInvalidBody(t *testing.T) {
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=invalidbody;"`)
+	startFakeDns(t, z)
+	domain := "example.com"
+	policy := "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n"
+
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, policy+strings.Repeat("#", MTASTS_MAX_BODY_BYTES))
+	}))
+	if result, _, _ := checkMtaSts(&bgCtx, &domain); result != "" {
+		t.Errorf("Expected an oversized policy to be rejected, got %q", result)
+	}
+
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, policy)
+	}))
+	if result, _, _ := checkMtaSts(&bgCtx, &domain); result != "" {
+		t.Errorf("Expected a policy with a wrong content type to be rejected, got %q", result)
+	}
+
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, policy)
+	}))
+	if result, _, _ := checkMtaSts(&bgCtx, &domain); result != "secure match=mx.example.com servername=hostname" {
+		t.Errorf("Unexpected policy %q", result)
+	}
+}
+
+func TestMtaStsTestingMode(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=testing1;"`)
+	startFakeDns(t, z)
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	domain := "example.com"
+
+	policy, report, _ := checkMtaSts(&bgCtx, &domain)
+	if policy != "" {
+		t.Errorf("Expected no policy for testing mode by default, got %q", policy)
+	}
+	if !strings.Contains(report, "policy_string = mode: testing") {
+		t.Errorf("Expected the report to be kept for testing mode, got %q", report)
+	}
+
+	prevHonorTesting := config.MtaSts.HonorTesting
+	config.MtaSts.HonorTesting = true
+	t.Cleanup(func() { config.MtaSts.HonorTesting = prevHonorTesting })
+	z.Remove("_mta-sts.example.com", dns.TypeTXT)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=testing2;"`)
+	if policy, report, _ := checkMtaSts(&bgCtx, &domain); policy != "may" || len(report) == 0 {
+		t.Errorf("Expected may with a report for testing mode with honor_testing, got %q and %q", policy, report)
+	}
+}
+
+func TestMtaStsWildcardMatch(t *testing.T) {
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=wildcard;"`)
+	z.Add(t, `example.com. 300 IN MX 10 mx1.example.com.`)
+	z.Add(t, `example.com. 300 IN MX 20 MX2.example.com.`)
+	z.Add(t, `example.com. 120 IN MX 30 deep.mx.example.com.`)
+	startFakeDns(t, z)
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: *.example.com\nmx: backup.example.org\nmx: *.example.net\nmax_age: 86400\n")
+	}))
+	domain := "example.com"
+
+	expected := "secure match=mx1.example.com:mx2.example.com:backup.example.org:.example.net servername=hostname"
+	for i := 0; i < 2; i++ { // fetched, then reused by id
+		// The expanded hosts are only valid while the MX records are, not for max_age
+		if policy, _, ttl := checkMtaSts(&bgCtx, &domain); policy != expected || ttl == 0 || ttl > 120 {
+			t.Errorf("Expected %q with TTL of at most 120, got %q with TTL %d", expected, policy, ttl)
+		}
+	}
+}
+
+func TestMtaStsFetchTimeout(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(false)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=slow1;"`)
+	startFakeDns(t, z)
+	var slow atomic.Bool
+	var clients sync.Map
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients.Store(r.RemoteAddr, true)
+		if slow.Load() {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(3 * time.Second):
+			}
+			return
+		}
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	prevFetchTimeout := config.MtaSts.FetchTimeout
+	config.MtaSts.FetchTimeout = 1
+	t.Cleanup(func() { config.MtaSts.FetchTimeout = prevFetchTimeout })
+	domain := "example.com"
+
+	if policy, _, _ := checkMtaSts(&bgCtx, &domain); policy != "secure match=mx.example.com servername=hostname" {
+		t.Fatalf("Unexpected policy %q", policy)
+	}
+	z.Remove("_mta-sts.example.com", dns.TypeTXT)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=slow2;"`)
+	slow.Store(true)
+	start := time.Now()
+	if policy, _, _ := checkMtaSts(&bgCtx, &domain); policy != "TEMP" {
+		t.Errorf("Expected TEMP for a policy host slower than fetch_timeout, got %q", policy)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("Expected the fetch to be aborted after a second, took %v", elapsed)
+	}
+	n := 0
+	clients.Range(func(_, _ any) bool { n++; return true })
+	if n != 1 {
+		t.Errorf("Expected both fetches to share a connection, got %d", n)
+	}
+}
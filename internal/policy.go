@@ -0,0 +1,199 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	valid "github.com/asaskevich/govalidator/v11"
+	"gopkg.in/yaml.v3"
+)
+
+// Format of the file referenced by policy.lists_file
+type PolicyListsFile struct {
+	Overrides map[string]string `yaml:"overrides"`
+	Allowlist []string          `yaml:"allowlist"`
+	Denylist  []string          `yaml:"denylist"`
+}
+
+// Domain lists, keyed by domain or by wildcard (*.example.com) for all subdomains
+type policyLists struct {
+	overrides map[string]string
+	allow     map[string]bool
+	deny      map[string]bool
+}
+
+var activePolicyLists atomic.Pointer[policyLists]
+
+// Normalizes a list entry, ".example.com" is accepted as an alias for "*.example.com"
+func normalizeListEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	name := entry
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+	} else if strings.HasPrefix(name, ".") {
+		name = name[1:]
+		entry = "*" + entry
+	}
+	if !valid.IsDNSName(name) {
+		return "", fmt.Errorf("Invalid domain %q", entry)
+	}
+	return entry, nil
+}
+
+func compilePolicyLists(f *PolicyListsFile) (*policyLists, error) {
+	lists := &policyLists{
+		overrides: make(map[string]string),
+		allow:     make(map[string]bool),
+		deny:      make(map[string]bool),
+	}
+	for domain, policy := range f.Overrides {
+		entry, err := normalizeListEntry(domain)
+		if err != nil {
+			return nil, fmt.Errorf("overrides: %v", err)
+		}
+		policy = strings.TrimSpace(policy)
+		if len(policy) == 0 {
+			return nil, fmt.Errorf("overrides: Empty policy for %q, use NOTFOUND to return no policy", domain)
+		}
+		lists.overrides[entry] = policy
+	}
+	for _, domain := range f.Allowlist {
+		entry, err := normalizeListEntry(domain)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: %v", err)
+		}
+		lists.allow[entry] = true
+	}
+	for _, domain := range f.Denylist {
+		entry, err := normalizeListEntry(domain)
+		if err != nil {
+			return nil, fmt.Errorf("denylist: %v", err)
+		}
+		lists.deny[entry] = true
+	}
+	return lists, nil
+}
+
+// Merges the lists of config.yaml with those of policy.lists_file, whose overrides take precedence
+func loadPolicyLists(c *PolicyConfig) (*policyLists, error) {
+	f := PolicyListsFile{Overrides: make(map[string]string)}
+	if len(c.ListsFile) != 0 {
+		data, err := os.ReadFile(c.ListsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+		if f.Overrides == nil {
+			f.Overrides = make(map[string]string)
+		}
+	}
+	for domain, policy := range c.Overrides {
+		if _, ok := f.Overrides[domain]; !ok {
+			f.Overrides[domain] = policy
+		}
+	}
+	f.Allowlist = append(f.Allowlist, c.Allowlist...)
+	f.Denylist = append(f.Denylist, c.Denylist...)
+	return compilePolicyLists(&f)
+}
+
+// (Re)loads the policy lists, keeping the previous ones if the new lists are invalid
+func reloadPolicyLists() {
+	config := getConfig()
+	p := &config.Policy
+	if len(p.ListsFile) == 0 && len(p.Overrides) == 0 && len(p.Allowlist) == 0 && len(p.Denylist) == 0 {
+		activePolicyLists.Store(nil)
+		return
+	}
+	lists, err := loadPolicyLists(p)
+	if err != nil {
+		log.Errorf("Could not load policy lists, keeping previous lists: %v", err)
+		return
+	}
+	activePolicyLists.Store(lists)
+	log.Infof("Loaded policy lists: %d overrides, %d allowed and %d denied domains", len(lists.overrides), len(lists.allow), len(lists.deny))
+}
+
+// Finds the most specific entry for a domain: the domain itself, or a wildcard of one of its parents
+func lookupDomain[T any](m map[string]T, domain string) (T, bool) {
+	if v, ok := m[domain]; ok {
+		return v, true
+	}
+	for parent := domain; ; {
+		i := strings.IndexByte(parent, '.')
+		if i < 0 {
+			break
+		}
+		parent = parent[i+1:]
+		if v, ok := m["*."+parent]; ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Whether a domain must neither be resolved nor get a policy, as it is denied or not allowed
+func isDomainBlocked(domain string) bool {
+	lists := activePolicyLists.Load()
+	if lists == nil {
+		return false
+	}
+	if _, denied := lookupDomain(lists.deny, domain); denied {
+		log.Debugf("Skipping policy for denied domain: %q", domain)
+		return true
+	}
+	if len(lists.allow) != 0 {
+		if _, allowed := lookupDomain(lists.allow, domain); !allowed {
+			log.Debugf("Skipping policy for domain not on the allowlist: %q", domain)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a fixed verdict for domains that are denied, not allowed, or overridden
+func checkPolicyLists(domain string) (policy string, matched bool) {
+	if isDomainBlocked(domain) {
+		return "", true
+	}
+	lists := activePolicyLists.Load()
+	if lists == nil {
+		return "", false
+	}
+	if override, ok := lookupDomain(lists.overrides, domain); ok {
+		if strings.ToUpper(override) == "NOTFOUND" {
+			override = ""
+		}
+		log.Infof("Overriding policy for %q: %q", domain, override)
+		return override, true
+	}
+	return "", false
+}
+
+// Special-use names that are never resolved by the public DNS (RFC 6761, 6762, 7686, 8375 and 9476)
+var specialTlds = []string{"alt", "home.arpa", "invalid", "local", "localhost", "onion", "test"}
+
+// Whether a domain is one of the special-use names or policy.special_tlds, or below one of them
+func isSpecialUseDomain(domain string) bool {
+	config := getConfig()
+	below := func(tld string) bool { return isDomainBelow(domain, tld) }
+	return slices.ContainsFunc(specialTlds, below) || slices.ContainsFunc(config.Policy.SpecialTlds, below)
+}
+
+// Whether a domain is parent itself or one of its subdomains, a leading dot of parent is ignored
+func isDomainBelow(domain string, parent string) bool {
+	parent = strings.ToLower(strings.TrimPrefix(parent, "."))
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
@@ -0,0 +1,251 @@
+package tlspol
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func writePolicyLists(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "lists.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestPolicyListsReload(t *testing.T) {
+	config := getConfig()
+	prev := config.Policy.ListsFile
+	config.Policy.ListsFile = writePolicyLists(t, `
+overrides:
+  broken.example: "secure match=mx.broken.example"
+  "*.wild.example": NOTFOUND
+denylist:
+  - .denied.example
+`)
+	defer func() {
+		config.Policy.ListsFile = prev
+		reloadPolicyLists()
+	}()
+	reloadPolicyLists()
+
+	cases := []struct {
+		domain  string
+		policy  string
+		matched bool
+	}{
+		{"broken.example", "secure match=mx.broken.example", true},
+		{"sub.wild.example", "", true},
+		{"wild.example", "", false},
+		{"mail.denied.example", "", true},
+		{"other.example", "", false},
+	}
+	for _, c := range cases {
+		policy, matched := checkPolicyLists(c.domain)
+		if policy != c.policy || matched != c.matched {
+			t.Errorf("%q: expected (%q, %v), got (%q, %v)", c.domain, c.policy, c.matched, policy, matched)
+		}
+	}
+
+	// An invalid file must not replace the active lists
+	os.WriteFile(config.Policy.ListsFile, []byte("denylist: [\"not a domain\"]"), 0o644)
+	reloadPolicyLists()
+	if policy, _ := checkPolicyLists("broken.example"); policy != "secure match=mx.broken.example" {
+		t.Errorf("Invalid lists file replaced the active lists")
+	}
+}
+
+func TestPolicyOverrides(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	prevOverrides := config.Policy.Overrides
+	config.Policy.Overrides = map[string]string{
+		"override.example":   "secure match=mx.override.example",
+		"*.override.example": "NOTFOUND",
+	}
+	defer func() {
+		config.Policy.Overrides = prevOverrides
+		reloadPolicyLists()
+	}()
+	reloadPolicyLists()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for domain, expected := range map[string]string{
+		"override.example":     "OK secure match=mx.override.example",
+		"sub.override.example": "NOTFOUND ",
+	} {
+		client.Write(netstring.Marshal("QUERY " + domain))
+		if !replies.Scan() {
+			t.Fatalf("No reply for %q: %v", domain, replies.Err())
+		}
+		if reply := replies.Text(); reply != expected {
+			t.Errorf("%q: expected %q, got %q", domain, expected, reply)
+		}
+		if n := z.Queries(domain, dns.TypeMX); n != 0 {
+			t.Errorf("%q: expected no DNS queries for an overridden domain, got %d", domain, n)
+		}
+	}
+
+	// The lists file takes precedence over config.yaml
+	prevListsFile := config.Policy.ListsFile
+	config.Policy.ListsFile = writePolicyLists(t, "overrides:\n  override.example: NOTFOUND\n")
+	defer func() { config.Policy.ListsFile = prevListsFile }()
+	reloadPolicyLists()
+	if policy, matched := checkPolicyLists("override.example"); policy != "" || !matched {
+		t.Errorf("Expected the lists file to take precedence, got (%q, %v)", policy, matched)
+	}
+}
+
+func TestPolicyAllowDenylist(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	prevAllowlist, prevDenylist := config.Policy.Allowlist, config.Policy.Denylist
+	defer func() {
+		config.Policy.Allowlist = prevAllowlist
+		config.Policy.Denylist = prevDenylist
+		reloadPolicyLists()
+	}()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	query := func(domain string, skipped bool) {
+		t.Helper()
+		client.Write(netstring.Marshal("QUERY " + domain))
+		if !replies.Scan() {
+			t.Fatalf("No reply for %q: %v", domain, replies.Err())
+		}
+		if reply := replies.Text(); reply != "NOTFOUND " {
+			t.Errorf("%q: expected NOTFOUND, got %q", domain, reply)
+		}
+		if n := z.Queries(domain, dns.TypeMX); (n == 0) != skipped {
+			t.Errorf("%q: expected skipped=%v, got %d MX queries", domain, skipped, n)
+		}
+	}
+
+	// Denylist only: everything else is evaluated
+	config.Policy.Denylist = []string{"denied.example", ".denied.org"}
+	reloadPolicyLists()
+	query("denied.example", true)
+	query("mail.denied.org", true)
+	query("sub.denied.example", false)
+	query("evaluated.example", false)
+
+	// Allowlist: only listed domains are evaluated, the denylist still wins
+	config.Policy.Allowlist = []string{"*.allowed.example", "mail.denied.org"}
+	reloadPolicyLists()
+	query("mx.allowed.example", false)
+	query("other.example", true)
+	query("allowed.example", true)
+	query("mail.denied.org", true)
+}
+
+func TestPolicyListsAllPaths(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "denied.example")
+	addDaneDomain(t, z, "recipient.example")
+	startFakeDns(t, z)
+	prevDenylist, prevHttp := config.Policy.Denylist, config.Http
+	defer func() {
+		config.Policy.Denylist = prevDenylist
+		config.Http = prevHttp
+		reloadPolicyLists()
+	}()
+	config.Policy.Denylist = []string{"denied.example"}
+	config.Http = HttpConfig{}
+	reloadPolicyLists()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+
+	client.Write(netstring.Marshal("QUERYVERBOSE denied.example"))
+	if !replies.Scan() {
+		t.Fatalf("No reply: %v", replies.Err())
+	}
+	var verbose VerboseResult
+	if reply, _ := strings.CutPrefix(replies.Text(), "OK "); json.Unmarshal([]byte(reply), &verbose) != nil || verbose.Policy != "" {
+		t.Errorf("QUERYVERBOSE: expected no policy, got %q", replies.Text())
+	}
+
+	// The next-hop is resolved, so a denied next-hop skips the recipient domain as well
+	client.Write(netstring.Marshal("QUERY recipient.example denied.example"))
+	if !replies.Scan() || replies.Text() != "NOTFOUND " {
+		t.Errorf("QUERY with a denied next-hop: expected NOTFOUND, got %q", replies.Text())
+	}
+
+	jsonClient := pipeConnection(t)
+	jsonClient.SetDeadline(time.Now().Add(5 * time.Second))
+	jsonClient.Write(netstring.Marshal("JSON denied.example"))
+	var result Result
+	if raw, err := bufio.NewReader(jsonClient).ReadBytes('\n'); err != nil || json.Unmarshal(raw, &result) != nil || result.Dane.Policy != "" || result.MtaSts.Policy != "" {
+		t.Errorf("JSON: expected no policy, got %s (%v)", raw, err)
+	}
+
+	rec := httptest.NewRecorder()
+	servePolicy(rec, httptest.NewRequest(http.MethodGet, "/policy?domain=denied.example", nil))
+	if json.Unmarshal(rec.Body.Bytes(), &result) != nil || result.Dane.Policy != "" || result.MtaSts.Policy != "" {
+		t.Errorf("HTTP: expected no policy, got %s", rec.Body.String())
+	}
+
+	for _, name := range []string{"denied.example", "_mta-sts.denied.example", "_mta-sts.recipient.example"} {
+		for _, qtype := range []uint16{dns.TypeMX, dns.TypeTXT} {
+			if n := z.Queries(name, qtype); n != 0 {
+				t.Errorf("Expected no %s queries for %s, got %d", dns.TypeToString[qtype], name, n)
+			}
+		}
+	}
+}
+
+func TestSpecialUseDomains(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	prev := config.Policy.SpecialTlds
+	defer func() { config.Policy.SpecialTlds = prev }()
+	config.Policy.SpecialTlds = []string{".Corp"}
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for _, test := range []struct {
+		domain  string
+		skipped bool
+	}{
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion", true},
+		{"mail.onion", true},
+		{"printer.local", true},
+		{"mail.corp", true},
+		{"corp", true},
+		{"onion.example", false},
+		{"corporate.example", false},
+	} {
+		client.Write(netstring.Marshal("QUERY " + test.domain))
+		if !replies.Scan() || replies.Text() != "NOTFOUND " {
+			t.Errorf("%q: expected NOTFOUND, got %q", test.domain, replies.Text())
+		}
+		if n := z.Queries(test.domain, dns.TypeMX); (n == 0) != test.skipped {
+			t.Errorf("%q: expected skipped=%v, got %d MX queries", test.domain, test.skipped, n)
+		}
+	}
+
+	if err := validateConfig(&Config{Dns: DnsConfig{Address: "127.0.0.1:53"}, Policy: PolicyConfig{SpecialTlds: []string{"not a tld"}}}); err == nil {
+		t.Error("Expected an invalid policy.special_tlds entry to be rejected")
+	}
+}
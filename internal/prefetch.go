@@ -6,8 +6,11 @@
 package tlspol
 
 import (
+	"cmp"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"math/rand/v2"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,29 +24,90 @@ const (
 )
 
 func startPrefetching() {
-	ticker := time.NewTicker(time.Duration(PREFETCH_INTERVAL) * time.Second)
+	config := getConfig()
+	// Daemons started together, e. g. sharing a Valkey (Redis), don't sweep in lockstep
+	if jitter := config.Prefetch.StartupJitter; jitter != 0 {
+		time.Sleep(rand.N(time.Duration(jitter) * time.Second))
+	}
+	interval := prefetchInterval()
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	for range ticker.C {
 		prefetchCachedPolicies()
+		// prefetch.interval may have been changed by a reload
+		if i := prefetchInterval(); i != interval {
+			interval = i
+			ticker.Reset(time.Duration(interval) * time.Second)
+		}
 	}
 }
 
-func prefetchCachedPolicies() {
-	keys, err := (*dbClient).Keys(bgCtx, CACHE_KEY_PREFIX+"*").Result()
-	if err != nil {
-		log.Errorf("Error fetching keys from Redis: %v", err)
-		return
+// Seconds between sweeps, PREFETCH_INTERVAL if prefetch.interval is unset
+func prefetchInterval() float64 {
+	config := getConfig()
+	if config.Prefetch.Interval == 0 {
+		return PREFETCH_INTERVAL
 	}
-	polCnt := len(keys) - 1
-	if polCnt < 1 {
-		return
+	return float64(config.Prefetch.Interval)
+}
+
+func prefetchConcurrency() int {
+	config := getConfig()
+	if config.Prefetch.Concurrency == 0 {
+		return runtime.NumCPU() * 8
+	}
+	return int(config.Prefetch.Concurrency)
+}
+
+// Blocks until the next refresh may start, spacing them out to prefetch.rate per second
+func prefetchPacer() func() {
+	config := getConfig()
+	if config.Prefetch.Rate == 0 {
+		return func() {}
 	}
-	semaphore := make(chan struct{}, runtime.NumCPU()*8)
+	interval := time.Second / time.Duration(config.Prefetch.Rate)
+	var next time.Time
+	return func() {
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		next = time.Now().Add(interval)
+	}
+}
+
+// Whether a cached policy expires before the sweep after next, so it has to be refreshed now
+func isPrefetchDue(data *CacheStruct, ttl uint32) bool {
+	interval := prefetchInterval()
+	factor := (interval + 1.0) / float64(PREFETCH_MARGIN)
+	return data.Ttl >= PREFETCH_MARGIN && float64(ttl)-PREFETCH_MARGIN < float64(data.Ttl)*factor+interval
+}
+
+// Whether the cached policy of a query (domain, domain:port or "recipient nexthop") is left to expire,
+// as one of its domains is in prefetch.exclude or below an entry of it
+func isPrefetchExcluded(query string) bool {
+	config := getConfig()
+	if len(config.Prefetch.Exclude) == 0 {
+		return false
+	}
+	recipient, nextHop := splitNextHop(query)
+	recipient, _, _ = splitDanePort(recipient)
+	nextHop, _, _ = splitDanePort(nextHop)
+	return slices.ContainsFunc(config.Prefetch.Exclude, func(entry string) bool {
+		return isDomainBelow(recipient, entry) || isDomainBelow(nextHop, entry)
+	})
+}
+
+type prefetchCandidate struct {
+	key  string
+	data CacheStruct
+	ttl  uint32
+}
+
+// Reads the cached policies that are due for a refresh, the ones closest to expiry first
+func prefetchCandidates(keys []string) (candidates []prefetchCandidate, examined uint32) {
+	semaphore := make(chan struct{}, prefetchConcurrency())
 	var wg sync.WaitGroup
-	var counter atomic.Uint32
+	var mu sync.Mutex
 	for _, key := range keys {
-		if key == CACHE_KEY_PREFIX+"version" {
-			continue
-		}
 		semaphore <- struct{}{}
 		wg.Add(1)
 		go func(key string) {
@@ -55,20 +119,87 @@ func prefetchCachedPolicies() {
 			if err != nil || cachedPolicy.Result == "" {
 				return
 			}
-			// Check if the original TTL is greater than the margin and within the prefetching range
-			if cachedPolicy.Ttl >= PREFETCH_MARGIN && float64(ttl-PREFETCH_MARGIN) < float64(cachedPolicy.Ttl)*PREFETCH_FACTOR+PREFETCH_INTERVAL {
-				// Refresh the cached policy
-				refreshedResult, refreshedRpt, refreshedTtl := queryDomain(&cachedPolicy.Domain)
-				if refreshedResult != "" && refreshedResult != "TEMP" {
-					counter.Add(1)
-					cacheJsonSet(&key, &CacheStruct{Domain: cachedPolicy.Domain, Result: refreshedResult, Report: refreshedRpt, Ttl: refreshedTtl})
-				}
+			mu.Lock()
+			defer mu.Unlock()
+			examined++
+			if isPrefetchDue(&cachedPolicy, ttl) && !isPrefetchExcluded(cachedPolicy.Domain) {
+				candidates = append(candidates, prefetchCandidate{key: key, data: cachedPolicy, ttl: ttl})
 			}
 		}(key)
 	}
 	wg.Wait()
-	count := counter.Load()
-	if count > 0 {
-		log.Debugf("Prefetched %d of %d policies", count, polCnt)
+	slices.SortFunc(candidates, func(a, b prefetchCandidate) int {
+		return cmp.Compare(a.ttl, b.ttl)
+	})
+	return candidates, examined
+}
+
+// Evaluates the candidates again and caches the new policies, returns how many were refreshed, changed and failed
+func refreshCandidates(candidates []prefetchCandidate) (uint32, uint32, uint32) {
+	// Workers take the candidates in order, so a limited concurrency refreshes the most urgent ones first
+	next := make(chan prefetchCandidate)
+	var wg sync.WaitGroup
+	var refreshed, changed, failed atomic.Uint32
+	for i := 0; i < min(prefetchConcurrency(), len(candidates)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				res := queryDomainMap(&c.data.Domain, c.data.Map)
+				if res.Policy != "" && res.Policy != "TEMP" {
+					refreshed.Add(1)
+					if res.Policy != c.data.Result {
+						changed.Add(1)
+					}
+					cacheJsonSet(&c.key, &CacheStruct{Domain: c.data.Domain, Map: c.data.Map, Result: res.Policy, Report: res.Rpt, Source: annotatedSource(&res), Ttl: res.Ttl})
+				} else {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	pace := prefetchPacer()
+	for _, c := range candidates {
+		pace()
+		next <- c
+	}
+	close(next)
+	wg.Wait()
+	return refreshed.Load(), changed.Load(), failed.Load()
+}
+
+type PrefetchStats struct {
+	Examined  uint32        `json:"examined"`
+	Refreshed uint32        `json:"refreshed"`
+	Changed   uint32        `json:"changed"`
+	Failed    uint32        `json:"failed"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Statistics of the last prefetch sweep
+var lastPrefetch atomic.Pointer[PrefetchStats]
+
+func prefetchCachedPolicies() {
+	start := time.Now()
+	keys, err := cacheKeys()
+	if err != nil {
+		log.Errorf("Error fetching keys from Redis: %v", err)
+		return
+	}
+	candidates, examined := prefetchCandidates(keys)
+	refreshed, changed, failed := refreshCandidates(candidates)
+	stats := PrefetchStats{
+		Examined:  examined,
+		Refreshed: refreshed,
+		Changed:   changed,
+		Failed:    failed,
+		Duration:  time.Since(start),
+	}
+	lastPrefetch.Store(&stats)
+	logf := log.Debugf // quiet unless the sweep did something
+	if stats.Refreshed > 0 || stats.Failed > 0 {
+		logf = log.Infof
 	}
+	logf("Prefetch sweep: %d examined, %d refreshed, %d changed, %d failed in %s (queries so far: %d from cache, %d evaluated)",
+		stats.Examined, stats.Refreshed, stats.Changed, stats.Failed, stats.Duration.Truncate(time.Millisecond), cacheHits.Load(), cacheMisses.Load())
 }
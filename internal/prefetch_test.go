@@ -0,0 +1,148 @@
+package tlspol
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefetchOrder(t *testing.T) {
+	config := getConfig()
+	prevMemoryEntries, prevConcurrency := config.Cache.MemoryEntries, config.Prefetch.Concurrency
+	config.Cache.MemoryEntries = 100
+	config.Prefetch.Concurrency = 1
+	defer func() {
+		config.Cache.MemoryEntries = prevMemoryEntries
+		config.Prefetch.Concurrency = prevConcurrency
+	}()
+	// Policies with a TTL of one hour are due in the last 702 seconds with the default interval,
+	// memory entries count as PREFETCH_MARGIN longer like the Valkey entries they stand in for
+	remaining := map[string]time.Duration{
+		"later.example":  400 * time.Second,
+		"urgent.example": 50 * time.Second,
+		"soon.example":   200 * time.Second,
+		"fresh.example":  3000 * time.Second,
+	}
+	var keys []string
+	for domain, ttl := range remaining {
+		key := getCacheKey(&domain)
+		keys = append(keys, key)
+		memCacheSet(key, CacheStruct{Domain: domain, Result: "dane-only", Ttl: 3600}, ttl)
+	}
+
+	candidates, examined := prefetchCandidates(keys)
+	if examined != 4 {
+		t.Errorf("Expected 4 examined policies, got %d", examined)
+	}
+	var domains []string
+	for _, c := range candidates {
+		domains = append(domains, c.data.Domain)
+	}
+	expected := []string{"urgent.example", "soon.example", "later.example"}
+	if !slices.Equal(domains, expected) {
+		t.Errorf("Expected policies to be refreshed in the order %v, got %v", expected, domains)
+	}
+}
+
+func TestPrefetchDue(t *testing.T) {
+	config := getConfig()
+	prev := config.Prefetch.Interval
+	defer func() { config.Prefetch.Interval = prev }()
+	tests := []struct {
+		ttl, remaining, interval uint32
+		due                      bool
+	}{
+		// Due in the last 702 seconds of a one hour TTL with the default interval of 30 seconds
+		{3600, 701, 0, true},
+		{3600, 703, 0, false},
+		// A longer interval refreshes earlier, here in the last 1092 seconds
+		{3600, 1000, 60, true},
+		{3600, 1093, 60, false},
+		// Policies already within the margin are due, computing in uint32 used to wrap and skip them
+		{3600, 100, 0, true},
+		// Policies with a TTL below the margin are never prefetched
+		{200, 100, 0, false},
+	}
+	for _, test := range tests {
+		config.Prefetch.Interval = test.interval
+		if due := isPrefetchDue(&CacheStruct{Ttl: test.ttl}, test.remaining); due != test.due {
+			t.Errorf("Expected due=%v for TTL %d with %ds remaining and interval %d, got %v", test.due, test.ttl, test.remaining, test.interval, due)
+		}
+	}
+}
+
+func TestPrefetchRate(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	var candidates []prefetchCandidate
+	for _, domain := range []string{"rate1.example", "rate2.example", "rate3.example", "rate4.example", "rate5.example"} {
+		z.Add(t,
+			domain+". 3600 IN MX 10 mx."+domain+".",
+			"mx."+domain+". 3600 IN A 192.0.2.25",
+			"_25._tcp.mx."+domain+". 3600 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		)
+		candidates = append(candidates, prefetchCandidate{key: getCacheKey(&domain), data: CacheStruct{Domain: domain, Result: "dane-only", Ttl: 3600}})
+	}
+	startFakeDns(t, z)
+	prev := config.Prefetch.Rate
+	config.Prefetch.Rate = 10
+	defer func() { config.Prefetch.Rate = prev }()
+
+	start := time.Now()
+	refreshed, _, failed := refreshCandidates(candidates)
+	if refreshed != 5 || failed != 0 {
+		t.Fatalf("Expected 5 refreshed policies, got %d refreshed and %d failed", refreshed, failed)
+	}
+	// 5 refreshes at 10 per second start 100ms apart
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the refreshes to be spaced out over at least 400ms, took %v", elapsed)
+	}
+	if n := z.MaxConcurrent(dns.TypeMX); n != 1 {
+		t.Errorf("Expected one MX lookup at a time, got %d at once", n)
+	}
+
+	config.Prefetch.Rate = 0
+	start = time.Now()
+	refreshCandidates(candidates)
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("Expected no pacing without prefetch.rate, took %v", elapsed)
+	}
+}
+
+func TestPrefetchExclude(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	prevMemoryEntries, prevExclude := config.Cache.MemoryEntries, config.Prefetch.Exclude
+	config.Cache.MemoryEntries = 100
+	config.Prefetch.Exclude = []string{"rare.example", ".seldom.example"}
+	defer func() {
+		config.Cache.MemoryEntries = prevMemoryEntries
+		config.Prefetch.Exclude = prevExclude
+	}()
+	var keys []string
+	for _, domain := range []string{"rare.example", "mx.rare.example", "mail.seldom.example:587", "frequent.example rare.example", "frequent.example", "notrare.example"} {
+		key := getCacheKey(&domain)
+		keys = append(keys, key)
+		memCacheSet(key, CacheStruct{Domain: domain, Result: "dane-only", Ttl: 3600}, 400*time.Second)
+	}
+
+	candidates, examined := prefetchCandidates(keys)
+	if examined != 6 {
+		t.Errorf("Expected 6 examined policies, got %d", examined)
+	}
+	var domains []string
+	for _, c := range candidates {
+		domains = append(domains, c.data.Domain)
+	}
+	slices.Sort(domains)
+	if expected := []string{"frequent.example", "notrare.example"}; !slices.Equal(domains, expected) {
+		t.Errorf("Expected only %v to be refreshed, got %v", expected, domains)
+	}
+	refreshCandidates(candidates)
+	if z.Queries("frequent.example", dns.TypeMX) == 0 || z.Queries("rare.example", dns.TypeMX) != 0 {
+		t.Error("Expected only the domains that are not excluded to be looked up")
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Token bucket refilled with rate tokens per second, holding at most a second worth of them
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) Allow(rate float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Whether the bucket is full again, so dropping it loses nothing
+func (b *tokenBucket) Idle(rate float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(rate, time.Now())
+	return b.tokens >= rate
+}
+
+// Rate limiters of TCP clients by IP address, shared by all their connections
+var clientLimiters = struct {
+	sync.Mutex
+	m map[string]*tokenBucket
+}{m: make(map[string]*tokenBucket)}
+
+// Rate limiter of a connection, per remote IP address over TCP and per connection otherwise
+func getRateLimiter(conn net.Conn) *tokenBucket {
+	config := getConfig()
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return &tokenBucket{}
+	}
+	ip := addr.IP.String()
+	clientLimiters.Lock()
+	defer clientLimiters.Unlock()
+	b, ok := clientLimiters.m[ip]
+	if !ok {
+		// Drop limiters of clients that have been quiet long enough
+		rate := float64(config.Server.RateLimit)
+		for k, other := range clientLimiters.m {
+			if other.Idle(rate) {
+				delete(clientLimiters.m, k)
+			}
+		}
+		b = &tokenBucket{}
+		clientLimiters.m[ip] = b
+	}
+	return b
+}
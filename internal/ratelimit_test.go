@@ -0,0 +1,94 @@
+package tlspol
+
+import (
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t, "limited.example. 300 IN MX 0 .")
+	startFakeDns(t, z)
+	prev := config.Server.RateLimit
+	config.Server.RateLimit = 2
+	defer func() { config.Server.RateLimit = prev }()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	send := func(request string) string {
+		t.Helper()
+		client.Write(netstring.Marshal(request))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", request, replies.Err())
+		}
+		return replies.Text()
+	}
+	for i := range 2 {
+		if reply := send("QUERY limited.example"); reply != "NOTFOUND " {
+			t.Fatalf("Expected query %d within the rate to be answered, got %q", i+1, reply)
+		}
+	}
+	if reply := send("QUERY limited.example"); reply != "TEMP " {
+		t.Errorf("Expected TEMP after exceeding the rate, got %q", reply)
+	}
+	if reply := send("PING"); reply != "PONG" {
+		t.Errorf("Expected PING not to be rate limited, got %q", reply)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if reply := send("QUERY limited.example"); reply != "NOTFOUND " {
+		t.Errorf("Expected the bucket to refill, got %q", reply)
+	}
+
+	// Each domain of QUERYMANY takes a token, those beyond the rate are answered with TEMP
+	time.Sleep(time.Second)
+	client.Write(netstring.Marshal("QUERYMANY limited.example limited.example limited.example"))
+	for i, expected := range []string{"NOTFOUND ", "NOTFOUND ", "TEMP "} {
+		if !replies.Scan() || replies.Text() != expected {
+			t.Errorf("Expected %q for domain %d of QUERYMANY, got %q (%v)", expected, i+1, replies.Text(), replies.Err())
+		}
+	}
+
+	// Another connection over a unix socket or pipe has its own budget
+	other := pipeConnection(t)
+	other.SetDeadline(time.Now().Add(5 * time.Second))
+	other.Write(netstring.Marshal("QUERY limited.example"))
+	if otherReplies := netstring.NewScanner(other); !otherReplies.Scan() || otherReplies.Text() != "NOTFOUND " {
+		t.Errorf("Expected a separate limit per connection")
+	}
+}
+
+func TestRateLimitPerIp(t *testing.T) {
+	config := getConfig()
+	prev := config.Server.RateLimit
+	config.Server.RateLimit = 1
+	defer func() { config.Server.RateLimit = prev }()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var limiters []*tokenBucket
+	for range 2 {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		limiters = append(limiters, getRateLimiter(server))
+	}
+	if limiters[0] != limiters[1] {
+		t.Fatal("Expected connections from the same IP address to share a limiter")
+	}
+	if !limiters[0].Allow(1) || limiters[1].Allow(1) {
+		t.Error("Expected the budget to be shared by both connections")
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/valkey-io/valkey-go/valkeycompat"
+)
+
+// Time given to commands still running on a replaced Valkey client before it is closed,
+// longer than the connection timeout of the client
+const VALKEY_DRAIN_DELAY = 30 * time.Second
+
+// Reloads config.yaml and the policy lists on SIGHUP, returns a function to stop watching
+func watchReload() (stop func()) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Info("Received SIGHUP, reloading configuration...")
+			reloadConfig()
+		}
+	}()
+	return func() {
+		signal.Stop(sighup)
+		close(sighup)
+	}
+}
+
+// Replaces the configuration, keeping the current one if the new one is invalid
+func reloadConfig() {
+	c, err := loadConfig(configFile)
+	if err == nil {
+		err = validateConfig(&c)
+	}
+	if err != nil {
+		log.Errorf("Could not reload %s, keeping the current configuration: %v", configFile, err)
+		reloadPolicyLists()
+		return
+	}
+	old := getConfig()
+
+	// Settings bound at startup only take effect on restart
+	restart := func(name string, changed bool) bool {
+		if changed {
+			log.Warnf("Ignoring changed %s, restart to apply it", name)
+		}
+		return changed
+	}
+	if restart("server.address", c.Server.Address != old.Server.Address) {
+		c.Server.Address = old.Server.Address
+	}
+	if restart("server.socket_mode", c.Server.SocketMode != old.Server.SocketMode) {
+		c.Server.SocketMode = old.Server.SocketMode
+	}
+	if restart("server.socket_owner", c.Server.SocketOwner != old.Server.SocketOwner) {
+		c.Server.SocketOwner = old.Server.SocketOwner
+	}
+	if restart("server.socket_group", c.Server.SocketGroup != old.Server.SocketGroup) {
+		c.Server.SocketGroup = old.Server.SocketGroup
+	}
+	if restart("server.listen_backlog", c.Server.ListenBacklog != old.Server.ListenBacklog) {
+		c.Server.ListenBacklog = old.Server.ListenBacklog
+	}
+	if restart("server.reuse_addr", c.Server.ReuseAddr != old.Server.ReuseAddr) {
+		c.Server.ReuseAddr = old.Server.ReuseAddr
+	}
+	if restart("server.reuse_port", c.Server.ReusePort != old.Server.ReusePort) {
+		c.Server.ReusePort = old.Server.ReusePort
+	}
+	if restart("server.network", c.Server.Network != old.Server.Network) {
+		c.Server.Network = old.Server.Network
+	}
+	if restart("server.prefetch", c.Server.Prefetch != old.Server.Prefetch) {
+		c.Server.Prefetch = old.Server.Prefetch
+	}
+	if restart("metrics.address", c.Metrics.Address != old.Metrics.Address) {
+		c.Metrics.Address = old.Metrics.Address
+	}
+	if restart("http.address", c.Http.Address != old.Http.Address) {
+		c.Http.Address = old.Http.Address
+	}
+	if restart("redis.disable", c.Redis.Disable != old.Redis.Disable) {
+		c.Redis.Disable = old.Redis.Disable
+	}
+	if restart("redis.namespace", c.Redis.Namespace != old.Redis.Namespace) {
+		c.Redis.Namespace = old.Redis.Namespace
+	}
+
+	if !c.Redis.Disable && c.Redis != old.Redis {
+		newClient, err := newValkeyClient(&c.Redis)
+		if err != nil {
+			log.Errorf("Could not connect to the new Valkey (Redis) server, keeping the current one: %v", err)
+			c.Redis = old.Redis
+		} else {
+			dbAdapter := valkeycompat.NewAdapter(newClient)
+			dbClient.Store(&dbAdapter)
+			// Queries may still be running commands on the previous client
+			if prevClient := valkeyClient.Swap(&newClient); prevClient != nil {
+				time.AfterFunc(VALKEY_DRAIN_DELAY, func() { (*prevClient).Close() })
+			}
+			log.Infof("Switched cache to %s (DB %d)", c.Redis.Address, c.Redis.DB)
+		}
+	}
+
+	// Answers of the previous resolvers must not outlive them
+	if !reflect.DeepEqual(c.Dns, old.Dns) {
+		flushDnsCache()
+	}
+
+	// Swap the pointers, so readers never see a partially updated configuration
+	dnsClient.Store(newDnsClient(&c.Dns))
+	activeConfig.Store(&c)
+	applyLogConfig(&c.Log)
+	if c.Server.MaxConcurrent != old.Server.MaxConcurrent {
+		setMaxConcurrent(c.Server.MaxConcurrent)
+	}
+	reloadPolicyLists()
+	log.Info("Configuration reloaded")
+}
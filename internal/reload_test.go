@@ -0,0 +1,90 @@
+package tlspol
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReloadConfig(t *testing.T) {
+	signed := newFakeZone(true)
+	addDaneDomain(t, signed, "reload.example")
+	signedAddr := startFakeDns(t, signed)
+	startFakeDns(t, newFakeZone(true))
+
+	prevConfig, prevClient, prevConfigFile := getConfig(), dnsClient.Load(), configFile
+	defer func() {
+		activeConfig.Store(prevConfig)
+		dnsClient.Store(prevClient)
+		configFile = prevConfigFile
+	}()
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	domain := "reload.example"
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "" {
+		t.Fatalf("Expected no policy from the empty zone, got %q", policy)
+	}
+
+	dnsCache.Lock()
+	dnsCache.m["stale.example./MX"] = dnsCacheEntry{msg: new(dns.Msg), stored: time.Now(), expires: time.Now().Add(time.Hour)}
+	dnsCache.Unlock()
+
+	// Queries keep running while the configuration is swapped
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				checkDane(&bgCtx, &domain)
+			}
+		}
+	}()
+
+	stop := watchReload()
+	defer stop()
+	write("server:\n  address: 127.0.0.1:1\ndns:\n  address: " + signedAddr + "\n  require_dnssec: true\nredis:\n  disable: true\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for i := 0; i < 50 && getConfig().Dns.Address != signedAddr; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := getConfig().Dns.Address; addr != signedAddr {
+		t.Fatalf("Expected dns.address to be reloaded, got %q", addr)
+	}
+	if addr := getConfig().Server.Address; addr != prevConfig.Server.Address {
+		t.Errorf("Expected server.address to be kept until restart, got %q", addr)
+	}
+	close(done)
+	wg.Wait()
+	dnsCache.Lock()
+	_, stale := dnsCache.m["stale.example./MX"]
+	dnsCache.Unlock()
+	if stale {
+		t.Error("Expected the DNS cache to be flushed as dns.address changed")
+	}
+	if policy, _, _ := checkDane(&bgCtx, &domain); policy != "dane-only" {
+		t.Errorf("Expected dane-only from the reloaded resolver, got %q", policy)
+	}
+
+	// Invalid configurations are rejected as a whole
+	current := getConfig()
+	write("dns:\n  address: 127.0.0.1:53\n  protocol: carrier-pigeon\n")
+	reloadConfig()
+	if getConfig() != current {
+		t.Error("Expected the invalid configuration to be rejected")
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Used when startup.selftest_domain is unset, a DNSSEC-signed domain
+const SELFTEST_DOMAIN = "isc.org"
+
+// Checks on start that the resolver answers and validates DNSSEC and that Valkey is reachable,
+// logs each failed check and returns them joined
+func runSelfTest() error {
+	config := getConfig()
+	var errs []error
+	ctx, cancel := context.WithTimeout(bgCtx, REQUEST_TIMEOUT)
+	defer cancel()
+	domain := strings.TrimSuffix(cmp.Or(config.Startup.SelfTestDomain, SELFTEST_DOMAIN), ".")
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeSOA)
+	setEdns0(m, true)
+	r, err := exchange(&ctx, m)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("DNS resolver failed for %s: %s", domain, describeDnsError(err)))
+	case r.Rcode != dns.RcodeSuccess:
+		errs = append(errs, fmt.Errorf("DNS resolver answered %s for %s", dns.RcodeToString[r.Rcode], domain))
+	case !r.AuthenticatedData:
+		errs = append(errs, fmt.Errorf("DNS resolver answered %s without AD bit, is it validating DNSSEC?", domain))
+	}
+
+	if db := getDbClient(); !config.Redis.Disable && db != nil {
+		ctx, cancel := context.WithTimeout(bgCtx, PING_TIMEOUT)
+		defer cancel()
+		if err := db.Ping(ctx).Err(); err != nil {
+			errs = append(errs, fmt.Errorf("Valkey (Redis) is unreachable: %v", err))
+		}
+	}
+
+	for _, err := range errs {
+		log.Errorf("Self-test failed: %v", err)
+	}
+	return errors.Join(errs...)
+}
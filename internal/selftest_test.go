@@ -0,0 +1,47 @@
+package tlspol
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/valkey-io/valkey-go/valkeycompat"
+)
+
+func TestSelfTest(t *testing.T) {
+	config := getConfig()
+	startFakeDns(t, newFakeZone(true))
+	if err := runSelfTest(); err != nil {
+		t.Errorf("Expected the self-test to pass with a validating resolver, got %v", err)
+	}
+
+	// A resolver that doesn't validate DNSSEC
+	startFakeDns(t, newFakeZone(false))
+	if err := runSelfTest(); err == nil || !strings.Contains(err.Error(), "AD bit") {
+		t.Errorf("Expected the self-test to fail without AD bit, got %v", err)
+	}
+
+	// A resolver that doesn't answer at all
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dns.Address = closed.LocalAddr().String()
+	closed.Close()
+	if err := runSelfTest(); err == nil || !strings.Contains(err.Error(), "DNS resolver failed") {
+		t.Errorf("Expected the self-test to fail with an unreachable resolver, got %v", err)
+	}
+
+	startFakeDns(t, newFakeZone(true))
+	var down valkeycompat.Cmdable = downCache{}
+	prev, prevDb := config.Redis.Disable, dbClient.Load()
+	config.Redis.Disable = false
+	dbClient.Store(&down)
+	defer func() {
+		config.Redis.Disable = prev
+		dbClient.Store(prevDb)
+	}()
+	if err := runSelfTest(); err == nil || !strings.Contains(err.Error(), "Valkey (Redis) is unreachable") {
+		t.Errorf("Expected the self-test to fail with Valkey down, got %v", err)
+	}
+}
@@ -7,19 +7,31 @@ package tlspol
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base32"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
-	"math/rand/v2"
+	"io"
+	"io/fs"
 	"net"
 	"os"
+	"os/signal"
+	"os/user"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	valid "github.com/asaskevich/govalidator/v11"
@@ -27,47 +39,192 @@ import (
 	"github.com/neilotoole/jsoncolor"
 	"github.com/valkey-io/valkey-go"
 	"github.com/valkey-io/valkey-go/valkeycompat"
+	"golang.org/x/net/idna"
 )
 
 type CacheStruct struct {
+	Schema string `json:"s,omitempty"`
 	Domain string `json:"d"`
+	Map    string `json:"m,omitempty"`
 	Result string `json:"r"`
 	Report string `json:"p"`
+	Reason string `json:"e,omitempty"`
+	Source string `json:"o,omitempty"`
 	Ttl    uint32 `json:"t"`
 }
 
 const (
-	DB_SCHEMA          = "3"
+	DB_SCHEMA          = "4"
 	CACHE_KEY_PREFIX   = "TLSPOL-"
 	CACHE_NOTFOUND_TTL = 600
+	CACHE_TEMP_TTL     = 60
 	CACHE_MIN_TTL      = 180
 	REQUEST_TIMEOUT    = 5 * time.Second
+	PING_TIMEOUT       = time.Second
+)
+
+var (
+	// Queries answered from cache and by evaluation
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
 )
 
 var (
 	Version     = "undefined"
 	bgCtx       = context.Background()
-	client      = dns.Client{Timeout: REQUEST_TIMEOUT}
-	config      Config
-	dbClient    *valkeycompat.Cmdable
 	NS_NOTFOUND = netstring.Marshal("NOTFOUND ")
 	NS_TEMP     = netstring.Marshal("TEMP ")
 	NS_PERM     = netstring.Marshal("PERM ")
 	NS_TIMEOUT  = netstring.Marshal("TIMEOUT ")
+
+	NS_PONG          = netstring.Marshal("PONG")
+	NS_PONG_DEGRADED = netstring.Marshal("PONG cache unavailable")
 )
 
+// Configuration and clients in use, swapped as a whole on reload while queries are running
+var (
+	activeConfig = newAtomicPointer(&Config{})
+	dnsClient    = newAtomicPointer(newDnsClient(&DnsConfig{}))
+	dbClient     atomic.Pointer[valkeycompat.Cmdable]
+	// Underlying client of dbClient, closed on shutdown
+	valkeyClient atomic.Pointer[valkey.Client]
+)
+
+func newAtomicPointer[T any](v *T) *atomic.Pointer[T] {
+	p := new(atomic.Pointer[T])
+	p.Store(v)
+	return p
+}
+
+// Current configuration, read once per request so that a reload never takes effect halfway
+func getConfig() *Config {
+	return activeConfig.Load()
+}
+
+// Valkey client in use, nil unless Valkey is enabled
+func getDbClient() valkeycompat.Cmdable {
+	if db := dbClient.Load(); db != nil {
+		return *db
+	}
+	return nil
+}
+
 var showVersion = false
 var showLicense = false
 var configFile string
 var queryMode = false
 var purgeCache = false
+var cacheStatusDomain string
+var verifyStsDomain string
+var expectedStsId string
+var explainQuery = false
+var resolveDomainName string
+var showStats = false
+var purgeDomainName string
+var checkConfigOnly = false
+var exportCachePath string
+var importCachePath string
 
 func init() {
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.BoolVar(&showLicense, "license", false, "Show LICENSE")
 	flag.StringVar(&configFile, "config", "/etc/postfix-tlspol/config.yaml", "Path to the config.yaml")
-	flag.String("query", "", "Query a domain")
+	flag.BoolVar(&checkConfigOnly, "check-config", false, "Validate the config.yaml and exit without starting the server")
+	flag.String("query", "", "Query a domain, with another resolver as example.com@9.9.9.9")
+	flag.BoolVar(&explainQuery, "explain", false, "Explain how the policy was decided (used with -query or -resolve)")
+	flag.StringVar(&resolveDomainName, "resolve", "", "Evaluate a domain in-process, without a running daemon or the cache")
 	flag.BoolVar(&purgeCache, "purge", false, "Manually clear the cache")
+	flag.StringVar(&purgeDomainName, "purge-domain", "", "Remove the cached policies of a domain")
+	flag.StringVar(&exportCachePath, "export-cache", "", "Write the cached policies to a file, e. g. to move them to another Valkey (Redis)")
+	flag.StringVar(&importCachePath, "import-cache", "", "Restore the cached policies from a file written by -export-cache")
+	flag.StringVar(&cacheStatusDomain, "cache-status", "", "Show the cached policy of a domain without evaluating it")
+	flag.BoolVar(&showStats, "stats", false, "Show statistics of the cache of the running daemon")
+	flag.StringVar(&verifyStsDomain, "verify-sts", "", "Compare the MTA-STS policy id of a domain with the one given by -sts-id")
+	flag.StringVar(&expectedStsId, "sts-id", "", "Expected MTA-STS policy id (used with -verify-sts)")
+}
+
+func printJson(v any) error {
+	return printJsonTo(os.Stdout, v)
+}
+
+// Prints colored and indented JSON to terminals, else one line
+func printJsonTo(w io.Writer, v any) error {
+	if f, ok := w.(*os.File); ok {
+		if o, err := f.Stat(); err == nil && (o.Mode()&os.ModeCharDevice) != 0 {
+			enc := jsoncolor.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.SetColors(jsoncolor.DefaultColors())
+			return enc.Encode(v)
+		}
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(v)
+}
+
+// Connects to the socketmap server of the running daemon
+func dialDaemon() (net.Conn, error) {
+	config := getConfig()
+	if strings.HasPrefix(config.Server.Address, "unix:") {
+		return net.Dial("unix", config.Server.Address[5:])
+	}
+	return net.Dial(serverNetwork(), config.Server.Address)
+}
+
+// Network of server.address if it is not a unix socket: tcp, or tcp4 or tcp6 to force IPv4 or IPv6
+func serverNetwork() string {
+	config := getConfig()
+	return cmp.Or(config.Server.Network, "tcp")
+}
+
+// Opens the socketmap listener on server.address
+func listenServer() (net.Listener, error) {
+	config := getConfig()
+	lc := net.ListenConfig{Control: controlListener}
+	if strings.HasPrefix(config.Server.Address, "unix:") {
+		path := config.Server.Address[5:]
+		mode, err := parseSocketMode(config.Server.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		var listener net.Listener
+		if mode != 0 {
+			// The socket must never be reachable with wider permissions than configured
+			withUmask(int(0o777&^mode), func() { listener, err = listenUnix(&lc, path) })
+		} else {
+			listener, err = listenUnix(&lc, path)
+		}
+		if err == nil {
+			if err = setSocketPermissions(path); err != nil {
+				listener.Close()
+			}
+		}
+		return listener, err
+	}
+	return lc.Listen(bgCtx, serverNetwork(), config.Server.Address)
+}
+
+// Prints the cache statistics of the running daemon
+func queryStats() {
+	conn, err := dialDaemon()
+	if err != nil {
+		log.Errorf("Could not get cache statistics. Is postfix-tlspol running? (%v)", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write(netstring.Marshal("STATS"))
+	raw, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		log.Errorf("Could not get cache statistics. (%v)", err)
+		return
+	}
+	var stats CacheStats
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		log.Errorf("Could not get cache statistics. (%v)", err)
+		return
+	}
+	if err := printJson(stats); err != nil {
+		log.Errorf("Could not print cache statistics. (%v)", err)
+	}
 }
 
 func flagQueryFunc(f *flag.Flag) {
@@ -75,24 +232,31 @@ func flagQueryFunc(f *flag.Flag) {
 		return
 	}
 	queryMode = true
-	domain := (*f).Value.String()
+	// -query example.com@9.9.9.9 evaluates the domain with another resolver
+	domain, resolver, _ := strings.Cut((*f).Value.String(), "@")
+	domain = strings.TrimSpace(domain)
 	if len(domain) == 0 || !valid.IsDNSName(domain) {
 		log.Errorf("Invalid domain: %q", domain)
 		return
 	}
-	var conn net.Conn
-	var err error
-	if strings.HasPrefix(config.Server.Address, "unix:") {
-		conn, err = net.Dial("unix", config.Server.Address[5:])
-	} else {
-		conn, err = net.Dial("tcp", config.Server.Address)
+	if resolver = strings.TrimSpace(resolver); len(resolver) != 0 {
+		domain += " @" + resolver
+		if _, _, ok := splitResolver(domain); !ok {
+			log.Errorf("Invalid resolver: %q", resolver)
+			return
+		}
 	}
+	conn, err := dialDaemon()
 	if err != nil {
 		log.Errorf("Could not query domain %q. Is postfix-tlspol running? (%v)", domain, err)
 		return
 	}
 	defer conn.Close()
-	conn.Write(netstring.Marshal("JSON " + domain))
+	if explainQuery {
+		conn.Write(netstring.Marshal("JSON " + domain + " explain"))
+	} else {
+		conn.Write(netstring.Marshal("JSON " + domain))
+	}
 	raw, err := bufio.NewReader(conn).ReadBytes('\n')
 	if err != nil {
 		log.Errorf("Could not query domain %q. (%v)", domain, err)
@@ -104,16 +268,7 @@ func flagQueryFunc(f *flag.Flag) {
 		log.Errorf("Could not query domain %q. (%v)", domain, err)
 		return
 	}
-	o, err := os.Stdout.Stat()
-	if err == nil && (o.Mode()&os.ModeCharDevice) != 0 {
-		enc := jsoncolor.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		enc.SetColors(jsoncolor.DefaultColors())
-		err = enc.Encode(result)
-	} else {
-		enc := json.NewEncoder(os.Stdout)
-		err = enc.Encode(result)
-	}
+	err = printJson(result)
 	if err != nil {
 		log.Errorf("Could not query domain %q. (%v)", domain, err)
 		return
@@ -121,6 +276,139 @@ func flagQueryFunc(f *flag.Flag) {
 	return
 }
 
+type CacheStatus struct {
+	Domain    string `json:"domain"`
+	Cached    bool   `json:"cached"`
+	Policy    string `json:"policy,omitempty"`
+	Report    string `json:"report,omitempty"`
+	Ttl       uint32 `json:"ttl,omitempty"`
+	Remaining uint32 `json:"remaining,omitempty"`
+}
+
+// Prints the cached policy of a domain, never triggers an evaluation
+func showCacheStatus(domain string) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !valid.IsDNSName(domain) {
+		log.Errorf("Invalid domain: %q", domain)
+		return
+	}
+	status := CacheStatus{Domain: domain}
+	cacheKey := getCacheKey(&domain)
+	cache, ttl, err := cacheJsonGet(&cacheKey)
+	if err != nil && err != valkey.Nil {
+		log.Errorf("Could not read cache for %q: %v", domain, err)
+		return
+	}
+	// Entries within the prefetch margin are not served from cache anymore
+	if err == nil && ttl > PREFETCH_MARGIN {
+		status.Cached = true
+		status.Policy = cache.Result
+		status.Report = cache.Report
+		status.Ttl = cache.Ttl
+		status.Remaining = ttl - PREFETCH_MARGIN
+	}
+	if err := printJson(status); err != nil {
+		log.Errorf("Could not print cache status for %q. (%v)", domain, err)
+	}
+}
+
+// Max length of a domain name without the trailing dot (see [RFC 1035, 2.3.4])
+const MAX_DOMAIN_LENGTH = 253
+
+// Whether domain is a host name within the length limit, its trailing dot already stripped
+func isValidDomain(domain string) bool {
+	return len(domain) <= MAX_DOMAIN_LENGTH && !strings.HasSuffix(domain, ".") && valid.IsDNSName(domain)
+}
+
+// Lowercases a domain given on the command line or the socket and converts it to its A-labels
+func normalizeDomain(domain string) (string, error) {
+	domain, err := idna.Lookup.ToASCII(strings.TrimSpace(domain))
+	if err != nil {
+		return "", fmt.Errorf("Invalid domain: %v", err)
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	if !isValidDomain(domain) {
+		return "", fmt.Errorf("Invalid domain: %q", domain)
+	}
+	return domain, nil
+}
+
+// Prints the policies of a domain like -query does, but evaluated by this process
+func resolveQuery(domain string, w io.Writer) error {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(bgCtx, REQUEST_TIMEOUT)
+	defer cancel()
+	return printJsonTo(w, resolveDomain(&ctx, &domain, explainQuery))
+}
+
+type StsIdVerification struct {
+	Domain   string `json:"domain"`
+	Expected string `json:"expected"`
+	Id       string `json:"id"`
+	Match    bool   `json:"match"`
+	Policy   string `json:"policy"`
+	Report   string `json:"report"`
+}
+
+// Removes the cached policies of a domain from Valkey
+func purgeDomainCache(domain string) {
+	config := getConfig()
+	if config.Redis.Disable {
+		log.Error("Cannot purge a domain with Valkey (Redis) disabled, send PURGE over the socket instead!")
+		return
+	}
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	purged, err := purgeDomain(domain)
+	switch {
+	case err != nil:
+		log.Errorf("Error while purging %q from the cache: %v", domain, err)
+	case purged:
+		log.Infof("Purged %q from the cache", domain)
+	default:
+		log.Infof("No cached policy for %q", domain)
+	}
+}
+
+// Fetches the current MTA-STS policy id of a domain and compares it with the expected one
+func verifyMtaStsId(domain string, expected string) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !valid.IsDNSName(domain) {
+		log.Errorf("Invalid domain: %q", domain)
+		return
+	}
+	if len(expected) == 0 {
+		log.Error("Missing expected MTA-STS policy id, use -sts-id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(bgCtx, REQUEST_TIMEOUT)
+	defer cancel()
+	hasRecord, id, err := checkMtaStsRecord(&ctx, &domain)
+	if err != nil {
+		log.Errorf("Could not look up MTA-STS record for %q: %v", domain, err)
+		return
+	}
+	if !hasRecord {
+		log.Errorf("No MTA-STS record found for %q", domain)
+		return
+	}
+	v := StsIdVerification{Domain: domain, Expected: expected, Id: id, Match: id == expected}
+	v.Policy, v.Report, _ = checkMtaSts(&ctx, &domain)
+	if err := printJson(v); err != nil {
+		log.Errorf("Could not print verification for %q. (%v)", domain, err)
+		return
+	}
+	if !v.Match {
+		log.Warnf("MTA-STS policy id mismatch for %q: expected %q, got %q", domain, expected, id)
+	}
+}
+
 func StartDaemon(v *string, licenseText *string) {
 	Version = *v
 	curYear, _, _ := time.Now().Date()
@@ -137,9 +425,26 @@ func StartDaemon(v *string, licenseText *string) {
 		return
 	}
 
+	if checkConfigOnly {
+		if err := checkConfig(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration %s is invalid: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %s is valid\n", configFile)
+		return
+	}
+
 	// Read config.yaml
-	var err error
-	config, err = loadConfig(configFile)
+	loaded, err := loadConfig(configFile)
+	if err == nil {
+		// Rejected like on reload, rather than failing on the first query that needs the invalid option
+		err = validateConfig(&loaded)
+	}
+	config := &loaded
+	activeConfig.Store(config)
+	if err == nil {
+		dnsClient.Store(newDnsClient(&config.Dns))
+	}
 
 	flag.Visit(flagQueryFunc)
 
@@ -147,6 +452,23 @@ func StartDaemon(v *string, licenseText *string) {
 		return
 	}
 
+	if showStats {
+		queryStats()
+		return
+	}
+
+	if len(verifyStsDomain) != 0 {
+		verifyMtaStsId(verifyStsDomain, expectedStsId)
+		return
+	}
+
+	if len(resolveDomainName) != 0 {
+		if err := resolveQuery(resolveDomainName, os.Stdout); err != nil {
+			log.Errorf("Could not resolve domain %q. (%v)", resolveDomainName, err)
+		}
+		return
+	}
+
 	if len(os.Args) < 2 {
 		flag.PrintDefaults()
 		return
@@ -156,31 +478,28 @@ func StartDaemon(v *string, licenseText *string) {
 
 	if err != nil {
 		log.Errorf("Error loading config: %v", err)
-		return
+		os.Exit(1)
 	}
 
-	envPrefetch, envExists := os.LookupEnv("TLSPOL_PREFETCH")
-	if envExists {
-		config.Server.Prefetch = envPrefetch == "1"
-	}
-	envTlsRpt, envExists := os.LookupEnv("TLSPOL_TLSRPT")
-	if envExists {
-		config.Server.TlsRpt = envTlsRpt == "1"
+	applyLogConfig(&config.Log)
+	if _, err := os.Stat(configFile); errors.Is(err, fs.ErrNotExist) {
+		log.Infof("%s does not exist, using the defaults and environment variables", configFile)
 	}
 
 	if !config.Redis.Disable {
 		// Setup redis client for cache
-		valkeyClient, err := valkey.NewClient(valkey.ClientOption{
-			InitAddress: []string{config.Redis.Address},
-			Password:    config.Redis.Password,
-			SelectDB:    config.Redis.DB,
-		})
+		vc, err := newValkeyClient(&config.Redis)
 		if err != nil {
 			log.Errorf("Could not initialize Valkey (Redis) client: %v", err)
 			return
 		}
-		dbAdapter := valkeycompat.NewAdapter(valkeyClient)
-		dbClient = &dbAdapter
+		valkeyClient.Store(&vc)
+		dbAdapter := valkeycompat.NewAdapter(vc)
+		dbClient.Store(&dbAdapter)
+		if len(cacheStatusDomain) != 0 {
+			showCacheStatus(cacheStatusDomain)
+			return
+		}
 		updateDatabase()
 		go func() {
 			if config.Server.Prefetch {
@@ -188,6 +507,9 @@ func StartDaemon(v *string, licenseText *string) {
 				startPrefetching()
 			}
 		}()
+	} else if len(cacheStatusDomain) != 0 {
+		log.Error("Cannot show cache status with Valkey (Redis) disabled!")
+		return
 	} else if config.Server.Prefetch {
 		log.Warn("Cannot prefetch with Valkey (Redis) disabled!")
 	}
@@ -202,108 +524,454 @@ func StartDaemon(v *string, licenseText *string) {
 		return
 	}
 
+	if len(purgeDomainName) != 0 {
+		purgeDomainCache(purgeDomainName)
+		return
+	}
+
+	if len(exportCachePath) != 0 {
+		if err := exportCacheFile(exportCachePath); err != nil {
+			log.Errorf("Error while exporting the cache: %v", err)
+		}
+		return
+	}
+
+	if len(importCachePath) != 0 {
+		if err := importCacheFile(importCachePath); err != nil {
+			log.Errorf("Error while importing the cache: %v", err)
+		}
+		return
+	}
+
+	if config.Startup.SelfTest {
+		if err := runSelfTest(); err == nil {
+			log.Info("Self-test passed")
+		} else if config.Startup.SelfTestRequired {
+			log.Error("Refusing to start, as startup.selftest_required is set")
+			return
+		}
+	}
+
+	setMaxConcurrent(config.Server.MaxConcurrent)
+	reloadPolicyLists()
+	watchReload()
+
+	startMetricsServer()
+	startHttpServer()
+	startTlsRptReporter()
+
 	// Start the socketmap server for Postfix
 	startServer()
 }
 
+func applyLogConfig(c *LogConfig) {
+	log.SetFormat(c.Format)
+	level, err := log.ParseLevel(c.Level)
+	if err != nil && len(c.Level) != 0 {
+		log.Warnf("Ignoring log.level: %v", err)
+	}
+	log.SetLevel(level)
+}
+
+func newValkeyClient(c *RedisConfig) (valkey.Client, error) {
+	opt, err := valkeyClientOption(c)
+	if err != nil {
+		return nil, err
+	}
+	client, err := valkey.NewClient(opt)
+	if err == nil || len(opt.InitAddress) == 1 || len(opt.Sentinel.MasterSet) != 0 {
+		return client, err
+	}
+	// Multiple addresses are tried as a cluster first, else the first reachable node is used
+	for _, address := range opt.InitAddress {
+		single := opt
+		single.InitAddress = []string{address}
+		single.ForceSingleClient = true
+		if client, err = valkey.NewClient(single); err == nil {
+			log.Infof("Using Valkey (Redis) node %s", address)
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+func valkeyClientOption(c *RedisConfig) (valkey.ClientOption, error) {
+	opt := valkey.ClientOption{
+		Password: c.Password,
+		SelectDB: c.DB,
+		Sentinel: valkey.SentinelOption{MasterSet: c.SentinelMaster},
+	}
+	for _, address := range strings.Split(c.Address, ",") {
+		if address = strings.TrimSpace(address); len(address) != 0 {
+			opt.InitAddress = append(opt.InitAddress, address)
+		}
+	}
+	if !c.Tls {
+		return opt, nil
+	}
+	// The server name is taken from the address of each node
+	opt.TLSConfig = &tls.Config{
+		InsecureSkipVerify: c.TlsSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(c.TlsCa) != 0 {
+		pem, err := os.ReadFile(c.TlsCa)
+		if err != nil {
+			return opt, fmt.Errorf("Could not read redis.tls_ca: %v", err)
+		}
+		opt.TLSConfig.RootCAs = x509.NewCertPool()
+		if !opt.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return opt, fmt.Errorf("No certificates found in redis.tls_ca %q", c.TlsCa)
+		}
+	}
+	if len(c.TlsCert) != 0 || len(c.TlsKey) != 0 {
+		cert, err := tls.LoadX509KeyPair(c.TlsCert, c.TlsKey)
+		if err != nil {
+			return opt, fmt.Errorf("Could not load redis.tls_cert and redis.tls_key: %v", err)
+		}
+		opt.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	opt.Sentinel.TLSConfig = opt.TLSConfig
+	return opt, nil
+}
+
+// Serves socketmap queries until SIGINT or SIGTERM
 func startServer() {
-	var listener net.Listener
-	var err error
-	if strings.HasPrefix(config.Server.Address, "unix:") {
-		listener, err = net.Listen("unix", config.Server.Address[5:])
-	} else {
-		listener, err = net.Listen("tcp", config.Server.Address)
+	config := getConfig()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	listener, err := listenServer()
+	if err == nil && config.Server.ListenBacklog != 0 {
+		err = setListenBacklog(listener, int(config.Server.ListenBacklog))
 	}
 	if err != nil {
 		log.Errorf("Error starting socketmap server: %v", err)
 		return
 	}
-	defer listener.Close()
 
 	log.Debugf("Listening on %s...", config.Server.Address)
 
+	go func() {
+		sig := <-stop
+		log.Infof("Received %v, shutting down...", sig)
+		// Stops accepting connections, unix sockets are unlinked on close
+		listener.Close()
+	}()
+
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			log.Errorf("Error accepting connection: %v", err)
 			continue
 		}
-		go handleConnection(&conn)
+		trackConnection(conn)
+		go func() {
+			defer untrackConnection(conn)
+			handleConnection(&conn)
+		}()
+	}
+
+	drainConnections(SHUTDOWN_TIMEOUT)
+	if vc := valkeyClient.Load(); vc != nil {
+		(*vc).Close()
+	}
+	if strings.HasPrefix(config.Server.Address, "unix:") {
+		if err := os.Remove(config.Server.Address[5:]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Could not remove socket: %v", err)
+		}
 	}
+	log.Info("Shut down")
+}
+
+// Listens on a unix socket, replacing a socket left behind by a crashed daemon
+func listenUnix(lc *net.ListenConfig, path string) (net.Listener, error) {
+	listener, err := lc.Listen(bgCtx, "unix", path)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+	if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v (another instance is running)", err)
+	}
+	log.Warnf("Removing stale socket %s", path)
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return lc.Listen(bgCtx, "unix", path)
+}
+
+// Parses server.socket_mode, 0 keeps the mode given by the umask
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if len(mode) == 0 {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm == 0 || perm > 0o777 {
+		return 0, fmt.Errorf("Invalid server.socket_mode %q, expected an octal mode like 0660", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// Applies server.socket_mode, server.socket_owner and server.socket_group to the unix socket
+func setSocketPermissions(path string) error {
+	config := getConfig()
+	if mode, err := parseSocketMode(config.Server.SocketMode); err != nil {
+		return err
+	} else if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if len(config.Server.SocketOwner) == 0 && len(config.Server.SocketGroup) == 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	if len(config.Server.SocketOwner) != 0 {
+		id, err := lookupId(config.Server.SocketOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid server.socket_owner: %v", err)
+		}
+		uid = id
+	}
+	if len(config.Server.SocketGroup) != 0 {
+		id, err := lookupId(config.Server.SocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid server.socket_group: %v", err)
+		}
+		gid = id
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Resolves a user or group name to its id, numeric ids are taken as they are
+func lookupId(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
 }
 
 func getCacheKey(domain *string) string {
 	hash := sha256.Sum256([]byte(*domain))
-	return CACHE_KEY_PREFIX + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:])
+	return cacheKeyPrefix() + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(hash[:])
+}
+
+// Policies of the split maps are cached independently from the combined one
+func getMapCacheKey(domain *string, mapName string) string {
+	if mapName == MapCombined {
+		return getCacheKey(domain)
+	}
+	key := mapName + ":" + (*domain)
+	return getCacheKey(&key)
 }
 
 func tryCachedPolicy(conn *net.Conn, domain *string, cacheKey *string, withTlsRpt *bool) bool {
-	if !config.Redis.Disable {
-		cache, ttl, err := cacheJsonGet(cacheKey)
-		if err == nil && ttl > PREFETCH_MARGIN {
-			ttl := ttl - PREFETCH_MARGIN
-			switch cache.Result {
-			case "":
-				log.Infof("No policy found for %q (from cache, %ds remaining)", *domain, ttl)
-				(*conn).Write(NS_NOTFOUND)
-			case "TEMP":
-				log.Warnf("Evaluating policy for %q failed temporarily (from cache, %ds remaining)", *domain, ttl)
-				(*conn).Write(NS_TEMP)
-			default:
-				log.Infof("Evaluated policy for %q: %s (from cache, %ds remaining)", *domain, cache.Result, ttl)
-				if *withTlsRpt {
-					cache.Result = cache.Result + " " + cache.Report
-				}
-				(*conn).Write(netstring.Marshal("OK " + cache.Result))
-			}
-			return true
+	return replyFromCache(conn, domain, cacheKey, withTlsRpt, false)
+}
+
+// Serves a policy that is about to expire (within the prefetch margin) when evaluation failed temporarily
+func tryStalePolicy(conn *net.Conn, domain *string, cacheKey *string, withTlsRpt *bool) bool {
+	return replyFromCache(conn, domain, cacheKey, withTlsRpt, true)
+}
+
+func replyFromCache(conn *net.Conn, domain *string, cacheKey *string, withTlsRpt *bool, stale bool) bool {
+	e, ttl, err := cacheEntryGet(cacheKey)
+	if err != nil {
+		return false
+	}
+	origin := "from cache"
+	if stale {
+		if ttl == 0 || ttl > PREFETCH_MARGIN || e.data.Result == "TEMP" {
+			return false
+		}
+		origin = "from stale cache"
+	} else {
+		if ttl <= PREFETCH_MARGIN {
+			return false
+		}
+		ttl = ttl - PREFETCH_MARGIN
+	}
+	writeCachedReply(*conn, domain, e, ttl, origin, *withTlsRpt)
+	recordTlsRpt(e.data.Domain, e.data.Result, e.data.Report, e.data.Reason)
+	return true
+}
+
+func writeCachedReply(conn net.Conn, domain *string, e *cacheEntry, ttl uint32, origin string, withTlsRpt bool) {
+	source := strings.TrimPrefix(origin, "from ")
+	switch e.data.Result {
+	case "":
+		log.With(log.Fields{"domain": *domain, "ttl": ttl, "source": source}).Infof("No policy found for %q (%s, %ds remaining)", *domain, origin, ttl)
+		replyNotFound(&conn)
+	case "TEMP":
+		log.With(log.Fields{"domain": *domain, "policy": "TEMP", "ttl": ttl, "source": source}).Warnf("Evaluating policy for %q failed temporarily (%s, retrying in %ds)", *domain, origin, ttl)
+		replyTemp(&conn, e.data.Reason)
+	default:
+		log.With(log.Fields{"domain": *domain, "policy": e.data.Result, "ttl": ttl, "source": source, "policy_source": e.data.Source}).Infof("Evaluated policy for %q: %s%s (%s, %ds remaining)", *domain, e.data.Result, sourceSuffix(e.data.Source), origin, ttl)
+		if withTlsRpt {
+			replyPolicy(&conn, domain, e.replyWithRpt)
+		} else {
+			replyPolicy(&conn, domain, e.reply)
 		}
 	}
-	return false
 }
 
 type DanePolicy struct {
 	Policy string `json:"policy"`
 	Ttl    uint32 `json:"ttl"`
 	Time   string `json:"time"`
+	// Why the evaluation failed, e. g. "MX lookup failed: SERVFAIL from resolver"
+	Error string `json:"error,omitempty"`
 }
 type MtaStsPolicy struct {
 	Policy string `json:"policy"`
 	Ttl    uint32 `json:"ttl"`
 	Report string `json:"report"`
 	Time   string `json:"time"`
+	Error  string `json:"error,omitempty"`
+}
+type TlsRptPolicy struct {
+	Rua string `json:"rua"`
+	Ttl uint32 `json:"ttl"`
 }
 type Result struct {
 	Version string       `json:"version"`
 	Domain  string       `json:"domain"`
 	Dane    DanePolicy   `json:"dane"`
 	MtaSts  MtaStsPolicy `json:"mta-sts"`
+	TlsRpt  TlsRptPolicy `json:"tlsrpt"`
+	// Set if both DANE and MTA-STS have a policy, but for different MX hosts
+	Disagreement string       `json:"disagreement,omitempty"`
+	Explain      *Explanation `json:"explain,omitempty"`
 }
 
-func replyJson(ctx *context.Context, conn *net.Conn, domain *string) {
-	ta := time.Now()
-	var (
-		wg    sync.WaitGroup
-		tb    time.Time = ta
-		dPol  string
-		dTtl  uint32
-		tc    time.Time = ta
-		msPol string
-		msRpt string
-		msTtl uint32
-	)
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		dPol, dTtl = checkDane(ctx, domain)
-		tb = time.Now()
-	}()
+func replyJson(ctx *context.Context, conn *net.Conn, domain *string, explain bool) {
+	release, ok := acquireEvalSlot()
+	if !ok {
+		log.With(log.Fields{"domain": *domain}).Warnf("Too many concurrent evaluations, deferring %q", *domain)
+		replyTemp(conn, "busy")
+		return
+	}
+	defer release()
+	b, err := json.Marshal(resolveDomain(ctx, domain, explain))
+	if err != nil {
+		log.Errorf("Could not marshal JSON: %v", err)
+		return
+	}
+
+	(*conn).Write(append(b, '\n'))
+}
+
+// Reply to QUERYVERBOSE, the policy QUERY would return with the time each evaluation took
+type VerboseResult struct {
+	Domain     string `json:"domain"`
+	Policy     string `json:"policy"`
+	Report     string `json:"report,omitempty"`
+	Ttl        uint32 `json:"ttl"`
+	DaneTime   string `json:"dane-time,omitempty"`
+	MtaStsTime string `json:"mta-sts-time,omitempty"`
+}
+
+// Evaluates a domain like QUERY, bypassing the cache, and answers with a netstring of JSON
+func replyVerbose(conn *net.Conn, domain string) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		replyNotFound(conn)
+		return
+	}
+	release, ok := acquireEvalSlot()
+	if !ok {
+		log.With(log.Fields{"domain": domain}).Warnf("Too many concurrent evaluations, deferring %q", domain)
+		replyTemp(conn, "busy")
+		return
+	}
+	defer release()
+	res := queryDomain(&domain)
+	r := VerboseResult{Domain: domain, Policy: res.Policy, Report: res.Rpt, Ttl: res.Ttl}
+	if res.DaneTime != 0 {
+		r.DaneTime = res.DaneTime.Truncate(time.Microsecond).String()
+	}
+	if res.MtaStsTime != 0 {
+		r.MtaStsTime = res.MtaStsTime.Truncate(time.Microsecond).String()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Could not marshal JSON: %v", err)
+		return
+	}
+	replyOk(conn, netstring.Marshal("OK "+string(b)))
+}
+
+// Evaluates DANE, MTA-STS and TLS-RPT of a domain side by side, bypassing the cache; each
+// result stands on its own, so a failure of one check leaves the others intact
+func resolveDomain(parentCtx *context.Context, domain *string, explain bool) Result {
+	config := getConfig()
+	if isDomainBlocked(*domain) {
+		return Result{Version: Version, Domain: *domain}
+	}
+	evCtx, ev := withEvaluation(*parentCtx)
+	ev.explain = explain
+	ctx := &evCtx
+	ta := time.Now()
+	var (
+		wg    sync.WaitGroup
+		tb    time.Time = ta
+		dPol  string
+		dTtl  uint32
+		dErr  error
+		tc    time.Time = ta
+		msPol string
+		msRpt string
+		msTtl uint32
+		rua   string
+		rTtl  uint32
+	)
+	if config.Dane.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dPol, dTtl, dErr = checkDane(ctx, domain)
+			tb = time.Now()
+		}()
+	}
+	if config.MtaSts.Enable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msPol, msRpt, msTtl = checkMtaSts(ctx, domain)
+			tc = time.Now()
+		}()
+	}
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		msPol, msRpt, msTtl = checkMtaSts(ctx, domain)
-		tc = time.Now()
+		rua, rTtl, _ = checkTlsRpt(ctx, domain)
 	}()
 	wg.Wait()
+	dReason, msReason := ev.errors()
+	if len(dReason) == 0 && dErr != nil {
+		dReason = describeDnsError(dErr) // a failure without a recorded reason still shows up
+	}
 	r := Result{
 		Version: Version,
 		Domain:  *domain,
@@ -311,208 +979,806 @@ func replyJson(ctx *context.Context, conn *net.Conn, domain *string) {
 			Policy: dPol,
 			Ttl:    dTtl,
 			Time:   tb.Sub(ta).Truncate(time.Millisecond).String(),
+			Error:  dReason,
 		},
 		MtaSts: MtaStsPolicy{
 			Policy: msPol,
 			Ttl:    msTtl,
 			Report: msRpt,
 			Time:   tc.Sub(ta).Truncate(time.Millisecond).String(),
+			Error:  msReason,
+		},
+		TlsRpt: TlsRptPolicy{
+			Rua: rua,
+			Ttl: rTtl,
 		},
 	}
+	if isUsablePolicy(dPol) && isEnforcedPolicy(msPol) {
+		r.Disagreement = ev.disagreement()
+	}
+	if explain {
+		r.Explain = ev.explanation(dPol, msPol)
+	}
+	return r
+}
 
-	b, err := json.Marshal(r)
-	if err != nil {
-		log.Errorf("Could not marshal JSON: %v", err)
+func replyOk(conn *net.Conn, reply []byte) {
+	metrics.ok.Add(1)
+	(*conn).Write(reply)
+}
+
+// Used when server.max_reply_size is unset, the default socketmap_max_reply_size of Postfix
+const MAX_REPLY_SIZE = 100000
+
+// Writes an OK reply, or TEMP if Postfix would reject it as too long
+func replyPolicy(conn *net.Conn, domain *string, reply []byte) {
+	config := getConfig()
+	maxSize := int(config.Server.MaxReplySize)
+	if maxSize == 0 {
+		maxSize = MAX_REPLY_SIZE
+	}
+	// Postfix limits the payload, without the length prefix and trailing comma
+	if size := len(reply) - bytes.IndexByte(reply, ':') - 2; size > maxSize {
+		log.With(log.Fields{"domain": *domain, "size": size}).Warnf("Policy for %q is too long (%d bytes, at most %d allowed), replying TEMP", *domain, size, maxSize)
+		replyTemp(conn, "policy too long")
 		return
 	}
+	replyOk(conn, reply)
+}
 
-	(*conn).Write(append(b, '\n'))
+func replyNotFound(conn *net.Conn) {
+	metrics.notFound.Add(1)
+	(*conn).Write(NS_NOTFOUND)
+}
+
+// Writes a verdict, appending the reason only if verbose verdicts are enabled
+func replyVerdict(conn *net.Conn, verdict []byte, status string, reason string) {
+	config := getConfig()
+	if status == "TEMP" {
+		metrics.temp.Add(1)
+	} else {
+		metrics.perm.Add(1)
+	}
+	if len(reason) == 0 || !config.Server.VerboseVerdicts {
+		(*conn).Write(verdict)
+		return
+	}
+	(*conn).Write(netstring.Marshal(status + " " + reason))
+}
+
+func replyTemp(conn *net.Conn, reason string) {
+	replyVerdict(conn, NS_TEMP, "TEMP", reason)
+}
+
+func replyPerm(conn *net.Conn, reason string) {
+	replyVerdict(conn, NS_PERM, "PERM", reason)
+}
+
+// Rejects a request that is not a lookup, always with the reason, as it is a protocol error rather than a verdict
+func replyBadRequest(conn *net.Conn, cmd string) {
+	metrics.perm.Add(1)
+	isWord := len(cmd) != 0 && strings.IndexFunc(cmd, func(r rune) bool { return r < 'A' || r > 'Z' }) == -1
+	if isWord {
+		(*conn).Write(netstring.Marshal("PERM unsupported command"))
+	} else {
+		(*conn).Write(netstring.Marshal("PERM malformed request"))
+	}
+}
+
+// Reason of a TEMP verdict when the MTA-STS policy could not be fetched
+const REASON_STS_UNAVAILABLE = "mta-sts host unavailable"
+
+// Maps an evaluation error to a short reason suitable for a verdict
+func verdictReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "dns timeout"
+	}
+	if errors.Is(err, errDnssecNotValidated) {
+		return "dnssec not validated"
+	}
+	if errors.Is(err, errTlsHandshake) {
+		return "tls handshake failed"
+	}
+	if errors.Is(err, errTlsaMismatch) {
+		return "tlsa mismatch"
+	}
+	if errors.Is(err, errCertName) {
+		return "certificate name mismatch"
+	}
+	if errors.Is(err, errCnameLoop) {
+		return "cname loop"
+	}
+	if _, isRcode := dns.StringToRcode[err.Error()]; isRcode {
+		return "dns " + strings.ToLower(err.Error())
+	}
+	return "dns error"
 }
 
-func replySocketmap(conn *net.Conn, domain *string, policy *string, report *string, ttl *uint32, withTlsRpt *bool) {
+func replySocketmap(conn *net.Conn, domain *string, policy *string, report *string, ttl *uint32, reason *string, withTlsRpt *bool, source string) {
+	config := getConfig()
 	switch *policy {
 	case "":
-		log.Infof("No policy found for %q (cached for %ds)", *domain, *ttl)
-		(*conn).Write(NS_NOTFOUND)
+		log.With(log.Fields{"domain": *domain, "ttl": *ttl, "source": "live", "policy_source": "none"}).Infof("No policy found for %q (cached for %ds)", *domain, *ttl)
+		replyNotFound(conn)
 	case "TEMP":
-		log.Warnf("Evaluating policy for %q failed temporarily (cached for %ds)", *domain, *ttl)
-		(*conn).Write(NS_TEMP)
+		log.With(log.Fields{"domain": *domain, "policy": "TEMP", "ttl": *ttl, "source": "live", "reason": *reason}).Warnf("Evaluating policy for %q failed temporarily (retrying in %ds)", *domain, *ttl)
+		replyTemp(conn, *reason)
 	default:
-		log.Infof("Evaluated policy for %q: %s (cached for %ds)", *domain, *policy, *ttl)
+		suffix := ""
+		if config.Server.AnnotateSource {
+			suffix = sourceSuffix(source)
+		}
+		log.With(log.Fields{"domain": *domain, "policy": *policy, "ttl": *ttl, "source": "live", "policy_source": source}).Infof("Evaluated policy for %q: %s%s (cached for %ds)", *domain, *policy, suffix, *ttl)
 		res := *policy
 		if *withTlsRpt {
 			res = res + " " + (*report)
 		}
-		(*conn).Write(netstring.Marshal("OK " + res))
+		replyPolicy(conn, domain, netstring.Marshal("OK "+res))
 	}
 }
 
+// Connection that extends its read or write deadline by server.conn_timeout on every operation
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	// Don't undo drainConnections interrupting the read
+	if shuttingDown.Load() {
+		c.Conn.SetReadDeadline(time.Now())
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
 func handleConnection(conn *net.Conn) {
+	config := getConfig()
 	defer (*conn).Close()
+	// Reaps clients that stop sending queries or reading replies
+	if config.Server.ConnTimeout != 0 {
+		var timed net.Conn = &deadlineConn{Conn: *conn, timeout: time.Duration(config.Server.ConnTimeout) * time.Second}
+		conn = &timed
+	}
 
 	ns := netstring.NewScanner(*conn)
+	limiter := getRateLimiter(*conn)
+	limited := false
 
 	for ns.Scan() {
+		// A reload applies from the next query on, never in the middle of one
+		config := getConfig()
 		query := ns.Text()
 		parts := strings.SplitN(query, " ", 2)
 		cmd := strings.ToUpper(parts[0])
+		// Postfix sends the name of the socketmap as the first word
+		if len(config.Server.MapName) != 0 && strings.EqualFold(parts[0], config.Server.MapName) {
+			cmd = "QUERY"
+		}
+		if cmd == "PING" {
+			replyPing(conn)
+			continue
+		}
+		if cmd == "STATS" {
+			replyStats(conn)
+			continue
+		}
+		if cmd == "CAPS" {
+			replyCaps(conn)
+			continue
+		}
+		if cmd == "PURGE" {
+			// PURGE <domain>
+			domain := ""
+			if len(parts) == 2 {
+				domain = parts[1]
+			}
+			replyPurge(conn, domain)
+			continue
+		}
+		// Takes a token per lookup, so that batching them in QUERYMANY doesn't get around the limit
+		allow := func() bool {
+			rate := config.Server.RateLimit
+			if rate == 0 || limiter.Allow(float64(rate)) {
+				limited = false
+				return true
+			}
+			// Warn once per burst, not for every rejected query
+			if !limited {
+				log.With(log.Fields{"client": (*conn).RemoteAddr().String()}).Warnf("Client exceeded %d queries per second, replying TEMP", rate)
+				limited = true
+			}
+			return false
+		}
+		if cmd != "QUERYMANY" && !allow() {
+			replyTemp(conn, "rate limited")
+			continue
+		}
 		withTlsRpt := config.Server.TlsRpt
+		mapName := MapCombined
 		switch cmd {
 		case "QUERYWITHTLSRPT": // QUERYwithTLSRPT
 			withTlsRpt = true
-		case "QUERY", "JSON":
+		case "DANE":
+			mapName = MapDane
+		case "MTASTS":
+			mapName = MapMtaSts
+		case "MTASTSWITHTLSRPT": // MTASTSwithTLSRPT
+			mapName = MapMtaSts
+			withTlsRpt = true
+		case "QUERY", "QUERYMANY", "QUERYVERBOSE", "JSON":
 		default:
+			// Only this request is rejected, Postfix keeps the connection for further lookups
 			log.Warnf("Unknown command: %q", query)
-			(*conn).Write(NS_PERM)
-			return
+			replyBadRequest(conn, cmd)
+			continue
 		}
+		// Only lookups are counted, not PING, CAPS and the like, nor rejected requests
+		metrics.queries.Add(1)
 		if len(parts) != 2 { // empty query
-			(*conn).Write(NS_NOTFOUND)
+			replyNotFound(conn)
 			continue
 		}
 
 		domain := strings.ToLower(strings.TrimSpace(parts[1]))
 
 		if cmd == "JSON" {
+			// JSON <domain> [@resolver] [explain]
+			domain, resolver, ok := splitResolver(domain)
+			if !ok {
+				replyNotFound(conn)
+				continue
+			}
+			explain := false
+			if fields := strings.Fields(domain); len(fields) == 2 && fields[1] == "explain" {
+				domain = fields[0]
+				explain = true
+			}
+			domain, err := idna.Lookup.ToASCII(domain)
+			if err != nil {
+				replyNotFound(conn)
+				continue
+			}
+			// Cancel right away, the connection may stay open for many more queries
 			ctx, cancel := context.WithTimeout(bgCtx, REQUEST_TIMEOUT)
-			defer cancel()
-			replyJson(&ctx, conn, &domain)
+			if len(resolver) != 0 {
+				ctx = withResolver(ctx, resolver)
+			}
+			replyJson(&ctx, conn, &domain, explain)
+			cancel()
 			continue
 		}
 
-		if valid.IsIPv4(domain) || valid.IsIPv6(domain) {
-			log.Debugf("Skipping policy for non-domain: %q", domain)
-			(*conn).Write(NS_NOTFOUND)
-			continue
-		}
-		if strings.HasPrefix(domain, ".") && valid.IsDNSName(domain[1:]) {
-			log.Debugf("Skipping policy for parent domain: %q", domain)
-			(*conn).Write(NS_NOTFOUND)
-			continue
-		}
-		if !valid.IsDNSName(domain) {
-			log.Debugf("Skipping policy for invalid domain name: %q", domain)
-			(*conn).Write(NS_NOTFOUND)
+		if cmd == "QUERYVERBOSE" {
+			replyVerbose(conn, domain)
 			continue
 		}
 
-		cacheKey := getCacheKey(&domain)
-		if tryCachedPolicy(conn, &domain, &cacheKey, &withTlsRpt) {
+		if cmd == "QUERYMANY" {
+			// QUERYMANY <domain> <domain>..., separated by spaces or newlines
+			handleQueryMany(conn, strings.Fields(domain), allow)
 			continue
 		}
 
-		policy, report, ttl := queryDomain(&domain)
+		handleQuery(conn, domain, mapName, withTlsRpt)
+	}
 
-		replySocketmap(conn, &domain, &policy, &report, &ttl, &withTlsRpt)
+	// A clean end-of-stream (Postfix closing an idle connection) yields no error
+	if err := ns.Err(); isTimeout(err) && !shuttingDown.Load() {
+		log.Debugf("Closing socketmap connection idle for %ds", config.Server.ConnTimeout)
+	} else if err != nil && !errors.Is(err, net.ErrClosed) && !shuttingDown.Load() {
+		log.Warnf("Closing socketmap connection: %v", err)
+	}
+}
 
-		if !config.Redis.Disable {
-			cacheJsonSet(&cacheKey, &CacheStruct{Domain: domain, Result: policy, Report: report, Ttl: ttl})
-		}
+// Health check of the listener and the cache, never logged nor counted as a query
+func replyPing(conn *net.Conn) {
+	config := getConfig()
+	db := getDbClient()
+	if config.Redis.Disable || db == nil {
+		(*conn).Write(NS_PONG)
+		return
 	}
+	ctx, cancel := context.WithTimeout(bgCtx, PING_TIMEOUT)
+	defer cancel()
+	if err := db.Ping(ctx).Err(); err != nil {
+		(*conn).Write(NS_PONG_DEGRADED)
+		return
+	}
+	(*conn).Write(NS_PONG)
 }
 
-type PolicyResult struct {
-	IsDane bool
-	Policy string
-	Rpt    string
-	Ttl    uint32
+// Commands of the socketmap protocol, as listed by CAPS
+var socketCommands = []string{"QUERY", "QUERYWITHTLSRPT", "DANE", "MTASTS", "MTASTSWITHTLSRPT", "QUERYMANY", "QUERYVERBOSE", "JSON", "PING", "STATS", "PURGE", "CAPS"}
+
+// Version and supported commands, so clients can adapt to older daemons
+func replyCaps(conn *net.Conn) {
+	config := getConfig()
+	commands := socketCommands
+	// The name of server.map_name is answered like QUERY
+	if len(config.Server.MapName) != 0 {
+		commands = append(slices.Clip(commands), strings.ToUpper(config.Server.MapName))
+	}
+	(*conn).Write(netstring.Marshal("OK version=" + Version + " commands=" + strings.Join(commands, ",")))
 }
 
-func queryDomain(domain *string) (string, string, uint32) {
-	results := make(chan PolicyResult)
-	ctx, cancel := context.WithTimeout(bgCtx, REQUEST_TIMEOUT)
-	defer cancel()
+// Cache statistics as one line of JSON, like the JSON command
+func replyStats(conn *net.Conn) {
+	stats, err := getCacheStats()
+	if err != nil {
+		log.Errorf("Could not get cache statistics: %v", err)
+		(*conn).Write(NS_TEMP)
+		return
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.Errorf("Could not marshal JSON: %v", err)
+		return
+	}
+	(*conn).Write(append(b, '\n'))
+}
 
-	// DANE query
-	go func() {
-		policy, ttl := checkDane(&ctx, domain)
-		results <- PolicyResult{IsDane: true, Policy: policy, Rpt: "", Ttl: ttl}
-	}()
+// Removes the cached policies of a domain, answering "OK purged" or NOTFOUND if none were cached
+func replyPurge(conn *net.Conn, domain string) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		(*conn).Write(NS_NOTFOUND)
+		return
+	}
+	purged, err := purgeDomain(domain)
+	if err != nil {
+		log.Errorf("Could not purge cached policies of %q: %v", domain, err)
+		(*conn).Write(NS_TEMP)
+		return
+	}
+	if !purged {
+		(*conn).Write(NS_NOTFOUND)
+		return
+	}
+	log.Infof("Purged cached policies of %q", domain)
+	(*conn).Write(netstring.Marshal("OK purged"))
+}
 
-	// MTA-STS query
-	go func() {
-		policy, rpt, ttl := checkMtaSts(&ctx, domain)
-		results <- PolicyResult{IsDane: false, Policy: policy, Rpt: rpt, Ttl: ttl}
-	}()
+// Validates a domain of a query, returning its A-label and the port of QUERY domain:port (0 if none)
+func parseQueryDomain(origDomain string) (string, uint16, bool) {
+	if valid.IsIPv4(origDomain) || valid.IsIPv6(origDomain) {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for non-domain: %q", origDomain)
+		return "", 0, false
+	}
+	// QUERY domain:port looks up the TLSA records of another port than dane.port
+	domain, port, ok := splitDanePort(origDomain)
+	if !ok {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for invalid port: %q", origDomain)
+		return "", 0, false
+	}
+	// Internationalized domains are looked up and cached by their A-labels, but logged as queried
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for invalid internationalized domain: %q (%v)", origDomain, err)
+		return "", 0, false
+	}
+	// A fully qualified example.com. is the same domain as example.com
+	domain = strings.TrimSuffix(domain, ".")
+	if strings.HasPrefix(domain, ".") && valid.IsDNSName(domain[1:]) {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for parent domain: %q", origDomain)
+		return "", 0, false
+	}
+	if !isValidDomain(domain) {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for invalid domain name: %q", origDomain)
+		return "", 0, false
+	}
+	if isSpecialUseDomain(domain) {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy for special-use domain: %q", origDomain)
+		return "", 0, false
+	}
+	if domain != origDomain {
+		log.With(log.Fields{"domain": origDomain, "a_label": domain}).Debugf("Using %q for internationalized domain %q", domain, origDomain)
+	}
+	return domain, port, true
+}
+
+// Splits the resolver off a query like "example.com @9.9.9.9", returning it as host:port (empty if none),
+// false if the resolver is invalid
+func splitResolver(query string) (string, string, bool) {
+	fields := strings.Fields(query)
+	i := slices.IndexFunc(fields, func(f string) bool { return strings.HasPrefix(f, "@") })
+	if i < 0 {
+		return query, "", true
+	}
+	addr := withDefaultPort(fields[i][1:], "53")
+	if _, _, err := net.SplitHostPort(addr); err != nil || len(fields[i]) == 1 {
+		return query, "", false
+	}
+	return strings.Join(slices.Delete(fields, i, i+1), " "), addr, true
+}
+
+// Joins a domain and a port to the form of QUERY domain:port
+func withPort(domain string, port uint16) string {
+	if port == 0 {
+		return domain
+	}
+	return domain + ":" + strconv.Itoa(int(port))
+}
+
+// Splits a query of the form "recipient nexthop", the next-hop is the recipient domain if none is given
+func splitNextHop(query string) (string, string) {
+	recipient, nextHop, found := strings.Cut(query, " ")
+	if !found {
+		return query, query
+	}
+	return recipient, nextHop
+}
 
-	policy, report := "", ""
-	var ttl uint32 = CACHE_NOTFOUND_TTL
-	var i uint8 = 0
-	for r := range results {
-		i++
-		if i >= 2 {
-			close(results)
+// Answers a socketmap query for a single domain
+func handleQuery(conn *net.Conn, domain string, mapName string, withTlsRpt bool) {
+	domain, resolver, ok := splitResolver(domain)
+	if !ok {
+		log.With(log.Fields{"domain": domain}).Debugf("Skipping policy for invalid resolver: %q", domain)
+		replyNotFound(conn)
+		return
+	}
+	origDomain := domain
+	// QUERY recipient nexthop evaluates DANE for the next-hop, MTA-STS for the recipient domain
+	recipientPart, nextHopPart := splitNextHop(domain)
+	hasNextHop := nextHopPart != recipientPart
+	domain, port, ok := parseQueryDomain(recipientPart)
+	if ok && hasNextHop && port != 0 {
+		log.With(log.Fields{"domain": origDomain}).Debugf("Skipping policy with a port on the recipient domain: %q", origDomain)
+		ok = false
+	}
+	if !ok {
+		replyNotFound(conn)
+		return
+	}
+	query := withPort(domain, port)
+	if hasNextHop {
+		nextHop, nextHopPort, ok := parseQueryDomain(strings.TrimSpace(nextHopPart))
+		if !ok {
+			replyNotFound(conn)
+			return
 		}
-		if r.Policy == "" {
-			continue
+		if nextHop == domain {
+			query = withPort(domain, nextHopPort)
+		} else {
+			query = domain + " " + withPort(nextHop, nextHopPort)
 		}
-		policy = r.Policy
-		report = r.Rpt
-		ttl = r.Ttl
-		if r.IsDane {
-			break
+		// The next-hop is what gets resolved, so it is held to the lists as well
+		if nextHop != domain && isDomainBlocked(nextHop) {
+			replyNotFound(conn)
+			return
 		}
 	}
 
-	if policy == "" {
-		ttl = CACHE_NOTFOUND_TTL
-	} else if policy == "TEMP" || ttl < CACHE_MIN_TTL {
-		ttl = CACHE_MIN_TTL
+	if policy, matched := checkPolicyLists(domain); matched {
+		if len(policy) == 0 {
+			replyNotFound(conn)
+		} else {
+			replyPolicy(conn, &domain, netstring.Marshal("OK "+policy))
+		}
+		return
 	}
 
-	return policy, report, ttl
-}
+	if len(resolver) != 0 {
+		// Troubleshooting with another resolver, neither answered from nor written to the cache
+		log.With(log.Fields{"domain": origDomain, "resolver": resolver}).Infof("Evaluating %q with resolver %s", origDomain, resolver)
+		release, ok := acquireEvalSlot()
+		if !ok {
+			log.With(log.Fields{"domain": origDomain}).Warnf("Too many concurrent evaluations, deferring %q", origDomain)
+			replyTemp(conn, "busy")
+			return
+		}
+		defer release()
+		res := queryDomainMapWith(withResolver(bgCtx, resolver), &query, mapName)
+		replySocketmap(conn, &origDomain, &res.Policy, &res.Rpt, &res.Ttl, &res.Reason, &withTlsRpt, res.Source())
+		return
+	}
 
-func cacheJsonGet(cacheKey *string) (CacheStruct, uint32, error) {
-	var data CacheStruct
+	cacheKey := getMapCacheKey(&query, mapName)
+	if tryCachedPolicy(conn, &origDomain, &cacheKey, &withTlsRpt) {
+		cacheHits.Add(1)
+		return
+	}
+	cacheMisses.Add(1)
 
-	jsonData, err := (*dbClient).Cache(CACHE_MIN_TTL*time.Second).Get(bgCtx, *cacheKey).Result()
-	if err != nil {
-		return data, 0, err
+	// Only the query that evaluated the domain writes the result to the cache
+	res, memoized := memoGet(cacheKey)
+	if !memoized {
+		var ok bool
+		res, ok, memoized = coalesce(cacheKey, func() (PolicyResult, bool) {
+			release, ok := acquireEvalSlot()
+			if !ok {
+				return PolicyResult{}, false
+			}
+			defer release()
+			res := queryDomainMap(&query, mapName)
+			memoSet(cacheKey, res)
+			return res, true
+		})
+		if !ok {
+			log.With(log.Fields{"domain": origDomain}).Warnf("Too many concurrent evaluations, deferring %q", origDomain)
+			if !tryStalePolicy(conn, &origDomain, &cacheKey, &withTlsRpt) {
+				replyTemp(conn, "busy")
+			}
+			return
+		}
 	}
 
-	ttl, err := (*dbClient).Cache(CACHE_MIN_TTL*time.Second).TTL(bgCtx, *cacheKey).Result()
-	if err != nil {
-		log.Warnf("Error getting TTL: %v", err)
-		return data, 0, err
+	if res.Policy == "TEMP" && tryStalePolicy(conn, &origDomain, &cacheKey, &withTlsRpt) {
+		return
 	}
 
-	return data, uint32(ttl.Seconds()), json.Unmarshal([]byte(jsonData), &data)
+	replySocketmap(conn, &origDomain, &res.Policy, &res.Rpt, &res.Ttl, &res.Reason, &withTlsRpt, res.Source())
+	recordTlsRpt(query, res.Policy, res.Rpt, res.Reason)
+
+	if !memoized {
+		cacheJsonSet(&cacheKey, &CacheStruct{Domain: query, Map: mapName, Result: res.Policy, Report: res.Rpt, Reason: res.Reason, Source: annotatedSource(&res), Ttl: res.Ttl})
+	}
 }
 
-func cacheJsonSet(cacheKey *string, data *CacheStruct) error {
-	jsonData, err := json.Marshal(*data)
-	if err != nil {
-		return fmt.Errorf("Error marshaling JSON: %v", err)
+// Parallel evaluations of a QUERYMANY command
+const QUERYMANY_WORKERS = 16
+
+// Most domains of a QUERYMANY command, so a single command can't queue unbounded work
+const QUERYMANY_MAX_DOMAINS = 1000
+
+// Collects the replies to one domain of a QUERYMANY command
+type replyBuffer struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (b *replyBuffer) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+// Answers QUERYMANY with one reply per domain, in the order of the query, and TEMP for
+// the domains that allow rejects for exceeding the rate limit
+func handleQueryMany(conn *net.Conn, domains []string, allow func() bool) {
+	config := getConfig()
+	if len(domains) == 0 {
+		replyNotFound(conn)
+		return
+	}
+	if len(domains) > QUERYMANY_MAX_DOMAINS {
+		// Rejected as a whole, as a protocol error like replyBadRequest
+		metrics.perm.Add(1)
+		(*conn).Write(netstring.Marshal("PERM too many domains"))
+		return
+	}
+	replies := make([]replyBuffer, len(domains))
+	workers := make(chan struct{}, QUERYMANY_WORKERS)
+	var wg sync.WaitGroup
+	for i, domain := range domains {
+		if !allow() {
+			replies[i].Conn = *conn
+			var c net.Conn = &replies[i]
+			replyTemp(&c, "rate limited")
+			continue
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			replies[i].Conn = *conn
+			var c net.Conn = &replies[i]
+			handleQuery(&c, domain, MapCombined, config.Server.TlsRpt)
+		}()
 	}
+	wg.Wait()
+	for i := range replies {
+		(*conn).Write(replies[i].buf.Bytes())
+	}
+}
+
+// Slots for concurrent evaluations, nil if unlimited
+var evalSlots atomic.Pointer[chan struct{}]
 
-	return (*dbClient).Set(bgCtx, *cacheKey, jsonData, time.Duration(data.Ttl+PREFETCH_MARGIN-rand.Uint32N(60))*time.Second).Err()
+// How long a query waits for a free slot before failing temporarily
+var evalQueueTimeout = time.Second
+
+func setMaxConcurrent(n uint32) {
+	if n == 0 {
+		evalSlots.Store(nil)
+		return
+	}
+	slots := make(chan struct{}, n)
+	evalSlots.Store(&slots)
 }
 
-func purgeDatabase() error {
-	if config.Redis.Disable {
-		return fmt.Errorf("Cache disabled")
+// Waits for a free evaluation slot, returns false if none became free in time
+func acquireEvalSlot() (release func(), ok bool) {
+	slots := evalSlots.Load()
+	if slots == nil {
+		return func() {}, true
 	}
-	keys, err := (*dbClient).Keys(bgCtx, CACHE_KEY_PREFIX+"*").Result()
-	if err != nil {
-		return fmt.Errorf("Error fetching keys: %v", err)
+	release = func() { <-*slots }
+	select {
+	case *slots <- struct{}{}:
+		return release, true
+	default:
 	}
-	for _, key := range keys {
-		(*dbClient).Del(bgCtx, key).Err()
+	timer := time.NewTimer(evalQueueTimeout)
+	defer timer.Stop()
+	select {
+	case *slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
 	}
-	return (*dbClient).Set(bgCtx, CACHE_KEY_PREFIX+"schema", DB_SCHEMA, 0).Err()
 }
 
-func updateDatabase() error {
-	currentSchema, err := (*dbClient).Get(bgCtx, CACHE_KEY_PREFIX+"schema").Result()
-	if err != nil && err != valkey.Nil {
-		return fmt.Errorf("Error getting schema from Valkey (Redis): %v", err)
+type PolicyResult struct {
+	IsDane bool
+	Policy string
+	Rpt    string
+	Ttl    uint32
+	Reason string
+	// Time the evaluations took, zero if not evaluated or not awaited
+	DaneTime   time.Duration
+	MtaStsTime time.Duration
+}
+
+// Mechanism that determined a usable policy, "dane" or "mta-sts", empty otherwise
+func (r *PolicyResult) Source() string {
+	switch {
+	case !isUsablePolicy(r.Policy):
+		return ""
+	case r.IsDane:
+		return "dane"
+	default:
+		return "mta-sts"
 	}
+}
 
-	// Check if the schema matches, else clear the database
-	if currentSchema != DB_SCHEMA {
-		return purgeDatabase()
+// Source of the policy to log and cache, if server.annotate_source is set
+func annotatedSource(r *PolicyResult) string {
+	config := getConfig()
+	if !config.Server.AnnotateSource {
+		return ""
 	}
+	return r.Source()
+}
 
-	return nil
+// Appended to the log line of a policy, e. g. " by DANE"
+func sourceSuffix(source string) string {
+	switch source {
+	case "dane":
+		return " by DANE"
+	case "mta-sts":
+		return " by MTA-STS"
+	}
+	return ""
+}
+
+// Socketmap names (i. e. the command) select which mechanisms are evaluated
+const (
+	MapCombined = ""
+	MapDane     = "dane"
+	MapMtaSts   = "mtasts"
+)
+
+func queryDomain(domain *string) PolicyResult {
+	return queryDomainMap(domain, MapCombined)
+}
+
+func queryDomainMap(domain *string, mapName string) PolicyResult {
+	return queryDomainMapWith(bgCtx, domain, mapName)
+}
+
+// Like queryDomainMap, with the values of parent, e. g. a resolver set by withResolver
+func queryDomainMapWith(parent context.Context, domain *string, mapName string) PolicyResult {
+	config := getConfig()
+	// Buffered for both results, so a query finishing after the timeout doesn't block
+	results := make(chan PolicyResult, 2)
+	// Prefetched policies of QUERY domain:port are cached as domain:port, of QUERY recipient nexthop as "recipient nexthop"
+	recipient, nextHop := splitNextHop(*domain)
+	recipient, _, _ = splitDanePort(recipient)
+	name, port, _ := splitDanePort(nextHop)
+	domain = &name
+	// Every lookup path ends here, so denied domains are never resolved
+	if isDomainBlocked(recipient) || (name != recipient && isDomainBlocked(name)) {
+		metrics.noPolicies.Add(1)
+		return PolicyResult{Ttl: cacheNotFoundTtl()}
+	}
+	ctx, cancel := context.WithTimeout(parent, REQUEST_TIMEOUT)
+	defer cancel()
+	ctx, ev := withEvaluation(withNextHop(withDanePort(ctx, port), name))
+
+	var numQueries uint8 = 0
+
+	// DANE query
+	if mapName != MapMtaSts && config.Dane.Enable {
+		numQueries++
+		go func() {
+			start := time.Now()
+			policy, ttl, err := checkDane(&ctx, domain)
+			results <- PolicyResult{IsDane: true, Policy: policy, Rpt: "", Ttl: ttl, Reason: verdictReason(err), DaneTime: time.Since(start)}
+		}()
+	}
+
+	// MTA-STS query
+	if mapName != MapDane && config.MtaSts.Enable {
+		numQueries++
+		go func() {
+			start := time.Now()
+			policy, rpt, ttl := checkMtaSts(&ctx, &recipient)
+			reason := ""
+			if policy == "TEMP" {
+				reason = REASON_STS_UNAVAILABLE
+			}
+			results <- PolicyResult{IsDane: false, Policy: policy, Rpt: rpt, Ttl: ttl, Reason: reason, MtaStsTime: time.Since(start)}
+		}()
+	}
+
+	preferMtaSts := config.Policy.Prefer == "mtasts"
+	var dane, sts *PolicyResult
+	// Both results are awaited, as the TTL and the disagreement check depend on both. Both checks
+	// honor ctx, so a stalled resolver yields TEMP rather than no result.
+	for i := uint8(0); i < numQueries; i++ {
+		r := <-results
+		if r.IsDane {
+			dane = &r
+		} else {
+			sts = &r
+		}
+	}
+
+	if dane != nil && sts != nil && isUsablePolicy(dane.Policy) && isEnforcedPolicy(sts.Policy) {
+		if d := ev.disagreement(); len(d) != 0 {
+			disagreements.Add(1)
+			log.With(log.Fields{"domain": *domain, "disagreement": d}).Warnf("DANE and MTA-STS disagree for %q: %s", *domain, d)
+		}
+	}
+
+	res := PolicyResult{}
+	switch {
+	case preferMtaSts && sts != nil && isEnforcedPolicy(sts.Policy):
+		res = *sts
+	case dane != nil && dane.Policy != "":
+		res = *dane
+	case sts != nil:
+		res = *sts
+	}
+	if isUsablePolicy(res.Policy) {
+		if res.IsDane {
+			metrics.danePolicies.Add(1)
+		} else {
+			metrics.stsPolicies.Add(1)
+		}
+	} else {
+		metrics.noPolicies.Add(1)
+	}
+	if dane != nil {
+		res.DaneTime = dane.DaneTime
+	}
+	if sts != nil {
+		res.MtaStsTime = sts.MtaStsTime
+	}
+	// The verdict depends on both policies if both were evaluated, so it expires with the first of them
+	if dane != nil && sts != nil && isUsablePolicy(dane.Policy) && isUsablePolicy(sts.Policy) {
+		res.Ttl = min(dane.Ttl, sts.Ttl)
+	}
+	switch {
+	case res.Policy == "" && dane != nil && dane.Policy == "" && dane.Ttl != 0:
+		// The domain or its MX records don't exist, cached like the resolver would (see [RFC 2308, 5])
+		res.Ttl = min(max(dane.Ttl, cacheMinTtl()), cacheNotFoundTtl())
+	case res.Policy == "":
+		res.Ttl = cacheNotFoundTtl()
+	case res.Policy == "TEMP":
+		res.Ttl = cacheTempTtl()
+	case res.Ttl < cacheMinTtl():
+		res.Ttl = cacheMinTtl()
+	}
+
+	return res
 }
@@ -1,20 +1,58 @@
 package tlspol
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/valkey-io/valkey-go/valkeycompat"
+	"golang.org/x/net/idna"
 )
 
 func init() {
-	config = Config{
+	activeConfig.Store(&Config{
 		Server: ServerConfig{},
 		Dns: DnsConfig{
-			Address: "dns.google:53",
+			Address:       "dns.google:53",
+			RequireDnssec: true,
+		},
+		Dane: DaneConfig{
+			Enable: true,
+		},
+		MtaSts: MtaStsConfig{
+			Enable: true,
 		},
 		Redis: RedisConfig{
 			Disable: true,
 		},
-	}
+	})
 }
 
 func TestDaneOverMtaSts(t *testing.T) {
@@ -28,7 +66,7 @@ func TestDaneOverMtaSts(t *testing.T) {
 					t.SkipNow()
 					return
 				}
-				policy, _, _ := queryDomain(&domain)
+				policy := queryDomain(&domain).Policy
 				if policy != "dane-only" {
 					t.Skipf("Expected DANE for %q, but not detected", domain)
 				} else if !passedOnce {
@@ -41,3 +79,1920 @@ func TestDaneOverMtaSts(t *testing.T) {
 		t.Error("All tests failed.")
 	}
 }
+
+// Records everything written to it
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func (c *recordConn) String() string {
+	return c.buf.String()
+}
+
+func (c *recordConn) Reset() {
+	c.buf.Reset()
+}
+
+func TestVerboseVerdicts(t *testing.T) {
+	config := getConfig()
+	rec := &recordConn{}
+	var conn net.Conn = rec
+	prev := config.Server.VerboseVerdicts
+	config.Server.VerboseVerdicts = false
+	replyTemp(&conn, "dns timeout")
+	if rec.String() != "5:TEMP ," {
+		t.Errorf("Expected bare verdict, got %q", rec.String())
+	}
+	rec.Reset()
+	config.Server.VerboseVerdicts = true
+	defer func() { config.Server.VerboseVerdicts = prev }()
+	replyTemp(&conn, verdictReason(errors.New("SERVFAIL")))
+	if rec.String() != "17:TEMP dns servfail," {
+		t.Errorf("Expected verdict with reason, got %q", rec.String())
+	}
+	rec.Reset()
+	replyTemp(&conn, "")
+	if rec.String() != "5:TEMP ," {
+		t.Errorf("Expected bare verdict without reason, got %q", rec.String())
+	}
+}
+
+func TestMapCacheKeys(t *testing.T) {
+	domain := "example.com"
+	combined := getMapCacheKey(&domain, MapCombined)
+	if combined != getCacheKey(&domain) {
+		t.Errorf("Combined map should use the plain cache key")
+	}
+	keys := map[string]bool{combined: true}
+	for _, mapName := range []string{MapDane, MapMtaSts} {
+		key := getMapCacheKey(&domain, mapName)
+		if keys[key] {
+			t.Errorf("Cache key for map %q collides with another map", mapName)
+		}
+		keys[key] = true
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	config := getConfig()
+	prev := config.Server.MemoizeWindow
+	config.Server.MemoizeWindow = 20
+	defer func() { config.Server.MemoizeWindow = prev }()
+	memoSet("memo-test", PolicyResult{Policy: "dane-only", Ttl: 300})
+	res, ok := memoGet("memo-test")
+	if !ok || res.Policy != "dane-only" {
+		t.Fatalf("Expected memoized result, got %+v (%v)", res, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := memoGet("memo-test"); ok {
+		t.Error("Memoized result should expire after the window")
+	}
+}
+
+func TestSocketmapConversation(t *testing.T) {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(&server)
+		close(done)
+	}()
+
+	replies := netstring.NewScanner(client)
+	query := func(q string, expected string) {
+		t.Helper()
+		client.SetDeadline(time.Now().Add(time.Second))
+		if _, err := client.Write(netstring.Marshal(q)); err != nil {
+			t.Fatalf("Could not send %q: %v", q, err)
+		}
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", q, replies.Err())
+		}
+		if reply := replies.Text(); reply != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, q, reply)
+		}
+	}
+
+	// Postfix reuses the connection for many lookups, with idle periods in between
+	query("QUERY 192.0.2.1", "NOTFOUND ")
+	query("QUERY .example.com", "NOTFOUND ")
+	time.Sleep(50 * time.Millisecond)
+	query("QUERY 2001:db8::1", "NOTFOUND ")
+	query("QUERY", "NOTFOUND ")
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Connection handler did not return after the client closed the connection")
+	}
+}
+
+// Connects to handleConnection over a pipe, waiting for the handler to return on cleanup
+func pipeConnection(t *testing.T) net.Conn {
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(&server)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func TestBadCommand(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t, "bad.example. 300 IN MX 0 .")
+	startFakeDns(t, z)
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	requests := []struct {
+		request string
+		reply   string
+	}{
+		{"FROBNICATE bad.example", "PERM unsupported command"},
+		{"\x00\x01 bad.example", "PERM malformed request"},
+		{"", "PERM malformed request"},
+		{"QUERY bad.example", "NOTFOUND "},
+	}
+	for _, r := range requests {
+		client.Write(netstring.Marshal(r.request))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q, the connection was closed: %v", r.request, replies.Err())
+		}
+		if reply := replies.Text(); reply != r.reply {
+			t.Errorf("Expected %q for %q, got %q", r.reply, r.request, reply)
+		}
+	}
+}
+
+func TestMapName(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "mapname.example")
+	startFakeDns(t, z)
+	prev := config.Server.MapName
+	config.Server.MapName = "tlspol"
+	defer func() { config.Server.MapName = prev }()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	requests := []struct {
+		request string
+		reply   string
+	}{
+		{"tlspol mapname.example", "OK dane-only"},
+		{"TLSPOL mapname.example", "OK dane-only"},
+		{"QUERY mapname.example", "OK dane-only"},
+		{"other mapname.example", "PERM unsupported command"},
+	}
+	for _, r := range requests {
+		client.Write(netstring.Marshal(r.request))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", r.request, replies.Err())
+		}
+		if reply := replies.Text(); reply != r.reply {
+			t.Errorf("Expected %q for %q, got %q", r.reply, r.request, reply)
+		}
+	}
+
+	c := Config{Dns: DnsConfig{Address: "127.0.0.1:53"}, Server: ServerConfig{MapName: "tls pol"}}
+	if err := validateConfig(&c); err == nil {
+		t.Error("Expected a server.map_name with spaces to be rejected")
+	}
+}
+
+func TestFqdnQuery(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "fqdn.example")
+	startFakeDns(t, z)
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	long := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 58) + ".example"
+	requests := []struct {
+		request string
+		reply   string
+	}{
+		{"QUERY fqdn.example.", "OK dane-only"},
+		{"QUERY fqdn.example..", "NOTFOUND "},
+		{"QUERY " + long, "NOTFOUND "},
+	}
+	for _, r := range requests {
+		client.Write(netstring.Marshal(r.request))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", r.request, replies.Err())
+		}
+		if reply := replies.Text(); reply != r.reply {
+			t.Errorf("Expected %q for %q, got %q", r.reply, r.request, reply)
+		}
+	}
+	if z.Queries("fqdn.example", dns.TypeMX) != 1 {
+		t.Error("Expected fqdn.example. to be looked up as fqdn.example")
+	}
+	if z.Queries(long, dns.TypeMX) != 0 {
+		t.Errorf("Expected the name of %d octets to be rejected before any lookup", len(long))
+	}
+	if domain, err := normalizeDomain("FQDN.example."); err != nil || domain != "fqdn.example" {
+		t.Errorf("Expected fqdn.example, got %q (%v)", domain, err)
+	}
+}
+
+func TestInternationalizedDomain(t *testing.T) {
+	cases := map[string]string{
+		"münchen.de":     "xn--mnchen-3ya.de",
+		"MÜNCHEN.DE":     "xn--mnchen-3ya.de",
+		"bücher.example": "xn--bcher-kva.example",
+		"例え.テスト":         "xn--r8jz45g.xn--zckzah",
+		"example.com":    "example.com",
+		"mail.例え。テスト":    "mail.xn--r8jz45g.xn--zckzah",
+	}
+	for domain, expected := range cases {
+		if a, err := idna.Lookup.ToASCII(domain); err != nil || a != expected {
+			t.Errorf("Expected %q for %q, got %q (%v)", expected, domain, a, err)
+		}
+	}
+
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write(netstring.Marshal("QUERY münchen.de"))
+	replies := netstring.NewScanner(client)
+	if !replies.Scan() {
+		t.Fatalf("No reply: %v", replies.Err())
+	}
+	if z.Queries("xn--mnchen-3ya.de", dns.TypeMX) == 0 {
+		t.Error("Expected the MX lookup to use the A-label")
+	}
+
+	// Names that are no valid IDNA are not looked up as given
+	client.Write(netstring.Marshal("QUERY ab--c.example"))
+	if !replies.Scan() || replies.Text() != "NOTFOUND " {
+		t.Errorf("Expected NOTFOUND for an invalid internationalized domain, got %q", replies.Text())
+	}
+	if z.Queries("ab--c.example", dns.TypeMX) != 0 {
+		t.Error("Expected no lookup of an invalid internationalized domain")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	config := getConfig()
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 16
+	defer func() { config.Cache.MemoryEntries = prev }()
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for i := 0; i < 2; i++ {
+		client.Write(netstring.Marshal("QUERY memcache.example"))
+		if !replies.Scan() {
+			t.Fatalf("No reply: %v", replies.Err())
+		}
+		if reply := replies.Text(); reply != "NOTFOUND " {
+			t.Errorf("Expected NOTFOUND, got %q", reply)
+		}
+	}
+	if n := z.Queries("memcache.example", dns.TypeMX); n != 1 {
+		t.Errorf("Expected the second query to be served from memory, got %d MX lookups", n)
+	}
+	// Nothing prefetches memory entries, so they are not kept past the TTL of their policy
+	domain := "memcache.example"
+	if _, ttl, ok := memCacheGet(getCacheKey(&domain)); !ok || ttl > cacheNotFoundTtl() {
+		t.Errorf("Expected the memory entry to expire within %d seconds, got %d", cacheNotFoundTtl(), ttl)
+	}
+
+	// Least recently used entries are evicted
+	for i := 0; i < 16; i++ {
+		memCacheSet(fmt.Sprintf("evict%d", i), CacheStruct{}, time.Minute)
+	}
+	if _, _, ok := memCacheGet("evict0"); !ok {
+		t.Error("Expected evict0 to be cached")
+	}
+	memCacheSet("evict16", CacheStruct{}, time.Minute)
+	if _, _, ok := memCacheGet("evict1"); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if _, _, ok := memCacheGet("evict0"); !ok {
+		t.Error("Expected the recently used evict0 to be kept")
+	}
+}
+
+func TestValkeyTls(t *testing.T) {
+	opt, err := valkeyClientOption(&RedisConfig{Address: "redis.example:6380"})
+	if err != nil || opt.TLSConfig != nil {
+		t.Fatalf("Expected no TLSConfig without redis.tls, got %v (%v)", opt.TLSConfig, err)
+	}
+
+	opt, err = valkeyClientOption(&RedisConfig{Address: "redis.example:6380", Tls: true})
+	if err != nil || opt.TLSConfig == nil {
+		t.Fatalf("Expected a TLSConfig with redis.tls (%v)", err)
+	}
+	if opt.TLSConfig.InsecureSkipVerify {
+		t.Errorf("Unexpected TLSConfig %+v", opt.TLSConfig)
+	}
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o600)
+	opt, err = valkeyClientOption(&RedisConfig{Address: "redis.example:6380", Tls: true, TlsCa: ca})
+	if err != nil || opt.TLSConfig.RootCAs == nil {
+		t.Errorf("Expected redis.tls_ca to be loaded (%v)", err)
+	}
+
+	if _, err = valkeyClientOption(&RedisConfig{Address: "redis.example:6380", Tls: true, TlsCa: ca + ".missing"}); err == nil {
+		t.Error("Expected an error for a missing redis.tls_ca")
+	}
+	if _, err = valkeyClientOption(&RedisConfig{Address: "redis.example:6380", Tls: true, TlsCert: ca, TlsKey: ca}); err == nil {
+		t.Error("Expected an error for an invalid redis.tls_key")
+	}
+}
+
+func TestValkeyAddresses(t *testing.T) {
+	opt, err := valkeyClientOption(&RedisConfig{Address: "10.0.0.1:26379, 10.0.0.2:26379,10.0.0.3:26379", SentinelMaster: "mymaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(opt.InitAddress, []string{"10.0.0.1:26379", "10.0.0.2:26379", "10.0.0.3:26379"}) {
+		t.Errorf("Unexpected InitAddress %q", opt.InitAddress)
+	}
+	if opt.Sentinel.MasterSet != "mymaster" {
+		t.Errorf("Expected sentinel master set mymaster, got %q", opt.Sentinel.MasterSet)
+	}
+
+	opt, _ = valkeyClientOption(&RedisConfig{Address: "127.0.0.1:6379"})
+	if !slices.Equal(opt.InitAddress, []string{"127.0.0.1:6379"}) || len(opt.Sentinel.MasterSet) != 0 {
+		t.Errorf("Unexpected options for a single address: %q, %q", opt.InitAddress, opt.Sentinel.MasterSet)
+	}
+}
+
+func TestQueryMany(t *testing.T) {
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	client.Write(netstring.Marshal("QUERYMANY a.com 192.0.2.1\nb.com"))
+	replies := netstring.NewScanner(client)
+	for i := 0; i < 3; i++ {
+		if !replies.Scan() {
+			t.Fatalf("Expected 3 replies, got %d: %v", i, replies.Err())
+		}
+		if reply := replies.Text(); reply != "NOTFOUND " {
+			t.Errorf("Unexpected reply %q", reply)
+		}
+	}
+	if z.Queries("a.com", dns.TypeMX) == 0 || z.Queries("b.com", dns.TypeMX) == 0 {
+		t.Error("Expected both domains to be evaluated")
+	}
+
+	// The connection remains usable for further queries
+	client.Write(netstring.Marshal("QUERY 192.0.2.1"))
+	if !replies.Scan() || replies.Text() != "NOTFOUND " {
+		t.Errorf("Unexpected reply after QUERYMANY: %q (%v)", replies.Text(), replies.Err())
+	}
+
+	// Every command is answered, even without domains
+	client.Write(netstring.Marshal("QUERYMANY  \n"))
+	if !replies.Scan() || replies.Text() != "NOTFOUND " {
+		t.Errorf("Expected NOTFOUND for QUERYMANY without domains, got %q (%v)", replies.Text(), replies.Err())
+	}
+	client.Write(netstring.Marshal("QUERYMANY " + strings.Repeat("192.0.2.1 ", QUERYMANY_MAX_DOMAINS+1)))
+	if !replies.Scan() || replies.Text() != "PERM too many domains" {
+		t.Errorf("Expected PERM for more than %d domains, got %q (%v)", QUERYMANY_MAX_DOMAINS, replies.Text(), replies.Err())
+	}
+}
+
+func TestResolveQuery(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "resolve.example")
+	startFakeDns(t, z)
+
+	var out bytes.Buffer
+	if err := resolveQuery("Resolve.Example", &out); err != nil {
+		t.Fatal(err)
+	}
+	var r Result
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", out.String(), err)
+	}
+	if r.Domain != "resolve.example" || r.Dane.Policy != "dane-only" || r.MtaSts.Policy != "" {
+		t.Errorf("Unexpected result %+v", r)
+	}
+	if z.Queries("resolve.example", dns.TypeMX) == 0 {
+		t.Error("Expected the fake resolver to be queried")
+	}
+
+	if err := resolveQuery("not a domain", &out); err == nil {
+		t.Error("Expected an error for an invalid domain")
+	}
+}
+
+func TestJsonLog(t *testing.T) {
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFormat("json")
+	defer func() {
+		log.SetFormat("text")
+		log.SetOutput(os.Stderr)
+	}()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write(netstring.Marshal("QUERY jsonlog.example"))
+	if !netstring.NewScanner(client).Scan() {
+		t.Fatal("No reply")
+	}
+
+	found := false
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", line, err)
+		}
+		if entry["domain"] == "jsonlog.example" && entry["source"] == "live" && entry["level"] == "info" && len(entry["time"].(string)) != 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a log line with the domain, got %q", out.String())
+	}
+}
+
+func TestAnnotateSource(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "source.example")
+	startFakeDns(t, z)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	prevMemoryEntries, prevAnnotateSource := config.Cache.MemoryEntries, config.Server.AnnotateSource
+	config.Cache.MemoryEntries = 16
+	defer func() {
+		config.Cache.MemoryEntries = prevMemoryEntries
+		config.Server.AnnotateSource = prevAnnotateSource
+		log.SetFormat("text")
+		log.SetOutput(os.Stderr)
+	}()
+
+	domain := "source.example"
+	query := func() {
+		t.Helper()
+		memCacheDelete(getCacheKey(&domain))
+		client := pipeConnection(t)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write(netstring.Marshal("QUERY " + domain))
+		if replies := netstring.NewScanner(client); !replies.Scan() || replies.Text() != "OK dane-only" {
+			t.Fatalf("Expected OK dane-only, got %q", replies.Text())
+		}
+	}
+	// The policy is cached after the reply
+	cached := func() *cacheEntry {
+		t.Helper()
+		for range 100 {
+			if e, _, ok := memCacheGet(getCacheKey(&domain)); ok {
+				return e
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Expected the policy to be cached")
+		return nil
+	}
+
+	log.SetFormat("json")
+	query()
+	log.SetFormat("text")
+	if e := cached(); e.data.Source != "" {
+		t.Errorf("Expected no source without server.annotate_source, got %+v", e)
+	}
+	if strings.Contains(out.String(), "by DANE") {
+		t.Errorf("Expected no source in the log message, got %q", out.String())
+	}
+	// The field is logged regardless
+	if !strings.Contains(out.String(), `"policy_source":"dane"`) {
+		t.Errorf("Expected the policy_source field in the log, got %q", out.String())
+	}
+
+	config.Server.AnnotateSource = true
+	query()
+	if e := cached(); e.data.Source != "dane" {
+		t.Errorf("Expected the source dane in the cache entry, got %+v", e)
+	}
+	if !strings.Contains(out.String(), "dane-only by DANE") {
+		t.Errorf("Expected the source in the log, got %q", out.String())
+	}
+
+	res := PolicyResult{Policy: "secure match=mx.example.com"}
+	if source := res.Source(); source != "mta-sts" {
+		t.Errorf("Expected mta-sts, got %q", source)
+	}
+	res = PolicyResult{IsDane: true, Policy: "TEMP"}
+	if source := res.Source(); source != "" {
+		t.Errorf("Expected no source for TEMP, got %q", source)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer func() {
+		applyLogConfig(&LogConfig{})
+		log.SetOutput(os.Stderr)
+	}()
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	query := func() {
+		t.Helper()
+		client.Write(netstring.Marshal("QUERY 192.0.2.1"))
+		if !replies.Scan() {
+			t.Fatal("No reply")
+		}
+	}
+
+	applyLogConfig(&LogConfig{Level: "warn"})
+	query()
+	log.Warn("warning")
+	if strings.Contains(out.String(), "Skipping policy") || !strings.Contains(out.String(), "warning") {
+		t.Errorf("Expected only warnings at level warn, got %q", out.String())
+	}
+
+	out.Reset()
+	applyLogConfig(&LogConfig{Level: "debug"})
+	query()
+	if !strings.Contains(out.String(), "Skipping policy for non-domain") {
+		t.Errorf("Expected debug lines at level debug, got %q", out.String())
+	}
+}
+
+func TestServerNetwork(t *testing.T) {
+	config := getConfig()
+	old := config.Server
+	defer func() { config.Server = old }()
+
+	listen := func(network string, address string) (net.Listener, error) {
+		t.Helper()
+		config.Server.Network = network
+		config.Server.Address = address
+		l, err := listenServer()
+		if err == nil {
+			t.Cleanup(func() { l.Close() })
+			config.Server.Address = l.Addr().String()
+		}
+		return l, err
+	}
+
+	l, err := listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected tcp4 to listen on 127.0.0.1: %v", err)
+	}
+	if ip := l.Addr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Errorf("Expected an IPv4 listener, got %v", ip)
+	}
+	conn, err := dialDaemon()
+	if err != nil {
+		t.Fatalf("Expected tcp4 to connect to %s: %v", config.Server.Address, err)
+	}
+	conn.Close()
+	config.Server.Network = "tcp6"
+	if conn, err := dialDaemon(); err == nil {
+		conn.Close()
+		t.Errorf("Expected tcp6 not to connect to %s", config.Server.Address)
+	}
+
+	if _, err := listen("tcp6", "127.0.0.1:0"); err == nil {
+		t.Error("Expected tcp6 not to listen on 127.0.0.1")
+	}
+	if l, err := listen("tcp6", "[::1]:0"); err != nil {
+		t.Logf("Skipping IPv6 listener: %v", err)
+	} else if ip := l.Addr().(*net.TCPAddr).IP; ip.To4() != nil {
+		t.Errorf("Expected an IPv6 listener, got %v", ip)
+	}
+
+	if err := validateConfig(&Config{Dns: DnsConfig{Address: "127.0.0.1:53"}, Server: ServerConfig{Network: "udp"}}); err == nil {
+		t.Error("Expected server.network udp to be rejected")
+	}
+}
+
+// Cache whose server is down
+type downCache struct {
+	valkeycompat.Cmdable
+}
+
+func (downCache) Ping(ctx context.Context) *valkeycompat.StatusCmd {
+	cmd := &valkeycompat.StatusCmd{}
+	cmd.SetErr(errors.New("connection refused"))
+	return cmd
+}
+
+// Commands that handleConnection compares the command word with, read from its source
+func dispatchedCommands(t *testing.T) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "server.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	addLit := func(e ast.Expr) {
+		if lit, ok := e.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			cmd, _ := strconv.Unquote(lit.Value)
+			if !slices.Contains(commands, cmd) {
+				commands = append(commands, cmd)
+			}
+		}
+	}
+	isCmd := func(e ast.Expr) bool {
+		ident, ok := e.(*ast.Ident)
+		return ok && ident.Name == "cmd"
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); !ok || fn.Name.Name != "handleConnection" {
+			continue
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.BinaryExpr:
+				if (n.Op == token.EQL || n.Op == token.NEQ) && isCmd(n.X) {
+					addLit(n.Y)
+				}
+			case *ast.SwitchStmt:
+				if isCmd(n.Tag) {
+					for _, stmt := range n.Body.List {
+						for _, e := range stmt.(*ast.CaseClause).List {
+							addLit(e)
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+	if len(commands) == 0 {
+		t.Fatal("No commands found in handleConnection")
+	}
+	return commands
+}
+
+func TestCaps(t *testing.T) {
+	config := getConfig()
+	prev := config.Server.MapName
+	defer func() { config.Server.MapName = prev }()
+	config.Server.MapName = "tlspol"
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	client.Write(netstring.Marshal("CAPS"))
+	if !replies.Scan() {
+		t.Fatalf("No reply: %v", replies.Err())
+	}
+	reply := replies.Text()
+	if !strings.HasPrefix(reply, "OK version="+Version+" commands=") {
+		t.Fatalf("Expected the version and commands, got %q", reply)
+	}
+	commands := strings.Split(reply[strings.LastIndex(reply, "=")+1:], ",")
+	// CAPS lists exactly the commands that are dispatched, and the map name answered like QUERY
+	expected := append(dispatchedCommands(t), "TLSPOL")
+	for _, cmd := range expected {
+		if !slices.Contains(commands, cmd) {
+			t.Errorf("Expected CAPS to list %s, got %v", cmd, commands)
+		}
+	}
+	for _, cmd := range commands {
+		if !slices.Contains(expected, cmd) {
+			t.Errorf("CAPS lists %s, which is not dispatched", cmd)
+		}
+	}
+
+	// Every listed command is understood, STATS replies with a line of JSON instead of a netstring
+	for _, cmd := range commands {
+		if cmd == "STATS" {
+			continue
+		}
+		client.Write(netstring.Marshal(cmd))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %s: %v", cmd, replies.Err())
+		}
+		if reply := replies.Text(); strings.HasPrefix(reply, "PERM") {
+			t.Errorf("Expected %s to be supported, got %q", cmd, reply)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	config := getConfig()
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	ping := func(expected string) {
+		t.Helper()
+		client.Write(netstring.Marshal("PING"))
+		if !replies.Scan() {
+			t.Fatal("No reply")
+		}
+		if reply := replies.Text(); reply != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	}
+
+	queries := metrics.queries.Load()
+	ping("PONG")
+	if metrics.queries.Load() != queries {
+		t.Error("Expected PING not to be counted as a query")
+	}
+
+	var down valkeycompat.Cmdable = downCache{}
+	prev, prevDb := config.Redis.Disable, dbClient.Load()
+	config.Redis.Disable = false
+	dbClient.Store(&down)
+	defer func() {
+		config.Redis.Disable = prev
+		dbClient.Store(prevDb)
+	}()
+	ping("PONG cache unavailable")
+}
+
+// Cache whose server can be taken down, counting writes
+type flakyCache struct {
+	valkeycompat.Cmdable
+	down atomic.Bool
+	sets atomic.Int32
+}
+
+func (c *flakyCache) Set(ctx context.Context, key string, value any, expiration time.Duration) *valkeycompat.StatusCmd {
+	c.sets.Add(1)
+	cmd := &valkeycompat.StatusCmd{}
+	if c.down.Load() {
+		cmd.SetErr(errors.New("connection refused"))
+	}
+	return cmd
+}
+
+func TestValkeyBreaker(t *testing.T) {
+	config := getConfig()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	flaky := &flakyCache{}
+	var cache valkeycompat.Cmdable = flaky
+	prevRedis, prevMemoryEntries, prevDb := config.Redis, config.Cache.MemoryEntries, dbClient.Load()
+	config.Redis.Disable = false
+	config.Redis.BreakerThreshold = 2
+	config.Redis.BreakerWindow = 60
+	config.Redis.BreakerCooldown = 1
+	config.Cache.MemoryEntries = 16
+	dbClient.Store(&cache)
+	defer func() {
+		config.Redis = prevRedis
+		config.Cache.MemoryEntries = prevMemoryEntries
+		dbClient.Store(prevDb)
+		valkeyBreaker.Success()
+		valkeyDown.Store(false)
+		log.SetOutput(os.Stderr)
+	}()
+
+	key := "test-breaker"
+	set := func() {
+		t.Helper()
+		if err := cacheJsonSet(&key, &CacheStruct{Domain: "breaker.example", Result: "secure", Ttl: 3600}); err != nil && !flaky.down.Load() {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	flaky.down.Store(true)
+	for range 4 {
+		set()
+	}
+	if sets := flaky.sets.Load(); sets != 2 {
+		t.Errorf("Expected Valkey to be skipped after 2 errors, got %d writes", sets)
+	}
+	// Reads are answered by the memory cache without touching Valkey
+	if e, _, err := cacheEntryGet(&key); err != nil || e.data.Result != "secure" {
+		t.Errorf("Expected the entry from the memory cache, got %v", err)
+	}
+	if n := strings.Count(out.String(), "Valkey failed"); n != 1 {
+		t.Errorf("Expected the outage to be logged once, got %d times", n)
+	}
+
+	// A failing probe after the cooldown pauses Valkey again right away
+	time.Sleep(1100 * time.Millisecond)
+	set()
+	set()
+	if sets := flaky.sets.Load(); sets != 3 {
+		t.Errorf("Expected a single probe after the cooldown, got %d writes", sets-2)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	flaky.down.Store(false)
+	set()
+	set()
+	if sets := flaky.sets.Load(); sets != 5 || valkeyDown.Load() {
+		t.Errorf("Expected Valkey to be used again after recovering, got %d writes", sets)
+	}
+	if !strings.Contains(out.String(), "Valkey is reachable again") {
+		t.Error("Expected the recovery to be logged")
+	}
+}
+
+// Keeps keys in a map, enough for listing, deleting and setting them
+type keyCache struct {
+	valkeycompat.Cmdable
+	keys map[string]string
+}
+
+func (c *keyCache) Keys(ctx context.Context, pattern string) *valkeycompat.StringSliceCmd {
+	cmd := &valkeycompat.StringSliceCmd{}
+	var keys []string
+	for key := range c.keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	cmd.SetVal(keys)
+	return cmd
+}
+
+func (c *keyCache) Del(ctx context.Context, keys ...string) *valkeycompat.IntCmd {
+	cmd := &valkeycompat.IntCmd{}
+	for _, key := range keys {
+		if _, ok := c.keys[key]; ok {
+			delete(c.keys, key)
+			cmd.SetVal(cmd.Val() + 1)
+		}
+	}
+	return cmd
+}
+
+func (c *keyCache) Set(ctx context.Context, key string, value any, expiration time.Duration) *valkeycompat.StatusCmd {
+	c.keys[key] = fmt.Sprint(value)
+	return &valkeycompat.StatusCmd{}
+}
+
+func TestCacheNamespace(t *testing.T) {
+	config := getConfig()
+	cache := &keyCache{keys: map[string]string{
+		CACHE_KEY_PREFIX + "schema":          DB_SCHEMA,
+		CACHE_KEY_PREFIX + "PROD":            "{}",
+		"dev:" + CACHE_KEY_PREFIX + "schema": DB_SCHEMA,
+		"dev:" + CACHE_KEY_PREFIX + "DEV":    "{}",
+	}}
+	var cmdable valkeycompat.Cmdable = cache
+	prev, prevDb := config.Redis, dbClient.Load()
+	config.Redis.Disable = false
+	dbClient.Store(&cmdable)
+	defer func() {
+		config.Redis = prev
+		dbClient.Store(prevDb)
+	}()
+
+	domain := "example.com"
+	config.Redis.Namespace = "dev"
+	if key := getCacheKey(&domain); !strings.HasPrefix(key, "dev:"+CACHE_KEY_PREFIX) {
+		t.Errorf("Expected the key to be in the dev namespace, got %q", key)
+	}
+	if keys, err := cacheKeys(); err != nil || !slices.Equal(keys, []string{"dev:" + CACHE_KEY_PREFIX + "DEV"}) {
+		t.Errorf("Expected only the key of the dev namespace, got %v (%v)", keys, err)
+	}
+	if err := purgeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.keys["dev:"+CACHE_KEY_PREFIX+"DEV"]; ok {
+		t.Error("Expected the key of the dev namespace to be purged")
+	}
+	if _, ok := cache.keys[CACHE_KEY_PREFIX+"PROD"]; !ok {
+		t.Error("Expected the key without namespace to be kept")
+	}
+
+	// Without a namespace, the keys of other namespaces are left alone
+	config.Redis.Namespace = ""
+	cache.keys["dev:"+CACHE_KEY_PREFIX+"DEV"] = "{}"
+	if key := getCacheKey(&domain); !strings.HasPrefix(key, CACHE_KEY_PREFIX) {
+		t.Errorf("Expected the plain key prefix, got %q", key)
+	}
+	if err := purgeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.keys[CACHE_KEY_PREFIX+"PROD"]; ok {
+		t.Error("Expected the key without namespace to be purged")
+	}
+	if _, ok := cache.keys["dev:"+CACHE_KEY_PREFIX+"DEV"]; !ok {
+		t.Error("Expected the key of the dev namespace to be kept")
+	}
+}
+
+func TestDecodedCacheEntries(t *testing.T) {
+	key := "test-decoded"
+	raw := `{"s":"4","d":"example.com","r":"dane-only","p":"","t":0}`
+	e, _, err := decodeCacheEntry(&key, raw)
+	if err != nil {
+		t.Fatalf("Could not decode entry: %v", err)
+	}
+	if string(e.reply) != "12:OK dane-only," {
+		t.Errorf("Unexpected precomputed reply %q", e.reply)
+	}
+	if again, _, _ := decodeCacheEntry(&key, raw); again != e {
+		t.Errorf("Unchanged entry should not be decoded again")
+	}
+	changed, _, err := decodeCacheEntry(&key, `{"s":"4","d":"example.com","r":"secure","p":"","t":0}`)
+	if err != nil || changed == e || changed.data.Result != "secure" {
+		t.Errorf("Changed entry should be decoded again, got %+v (%v)", changed, err)
+	}
+	unversioned := "test-unversioned"
+	_, migrated, err := decodeCacheEntry(&unversioned, `{"d":"example.com","r":"secure","p":"","t":0}`)
+	if err != nil || !migrated {
+		t.Errorf("Unversioned entry should be migrated, got %v", err)
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	domain := "example.com"
+	key := getCacheKey(&domain)
+	raw := `{"s":"4","d":"example.com","r":"dane-only","p":"rua=mailto:tlsrpt@example.com","t":3600}`
+	conn := &recordConn{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e, _, err := decodeCacheEntry(&key, raw)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Reset()
+		writeCachedReply(conn, &domain, e, 3600, "from cache", true)
+	}
+}
+
+func dialTestServer(t *testing.T, socket string) net.Conn {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Server did not start: %v", err)
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.delay = 200 * time.Millisecond
+	startFakeDns(t, z)
+	socket := filepath.Join(t.TempDir(), "tlspol.sock")
+	prevAddress := config.Server.Address
+	config.Server.Address = "unix:" + socket
+	defer func() {
+		config.Server.Address = prevAddress
+		shuttingDown.Store(false)
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		startServer()
+		close(stopped)
+	}()
+	conn := dialTestServer(t, socket)
+	defer conn.Close()
+	idle, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	conn.Write(netstring.Marshal("QUERY inflight.example"))
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(conn)
+	if !replies.Scan() || replies.Text() != "NOTFOUND " {
+		t.Errorf("Expected the in-flight query to be answered, got %q (%v)", replies.Text(), replies.Err())
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+	if _, err := os.Stat(socket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected socket to be removed, got %v", err)
+	}
+}
+
+func TestConnTimeout(t *testing.T) {
+	config := getConfig()
+	prev := config.Server.ConnTimeout
+	config.Server.ConnTimeout = 1
+	defer func() { config.Server.ConnTimeout = prev }()
+	handle := func() (net.Conn, chan struct{}) {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		done := make(chan struct{})
+		go func() {
+			handleConnection(&server)
+			close(done)
+		}()
+		return client, done
+	}
+
+	// A client that sends nothing
+	idle, done := handle()
+	start := time.Now()
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Connection closed before the timeout, after %v", elapsed)
+	}
+	<-done
+
+	// A client that never reads its reply
+	stuck, done := handle()
+	stuck.Write(netstring.Marshal("PING"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the connection not reading its reply to be closed")
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tlspol.sock")
+	// Leave the socket file behind, as a crashed daemon would
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lc := net.ListenConfig{}
+	listener, err := listenUnix(&lc, socket)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	dialTestServer(t, socket).Close()
+
+	// A socket with a live listener must not be taken over
+	if _, err := listenUnix(&lc, socket); err == nil {
+		t.Error("Expected listening on a live socket to fail")
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	config := getConfig()
+	socket := filepath.Join(t.TempDir(), "tlspol.sock")
+	prevAddress, prevMode, prevGroup := config.Server.Address, config.Server.SocketMode, config.Server.SocketGroup
+	config.Server.Address = "unix:" + socket
+	config.Server.SocketMode = "0600"
+	config.Server.SocketGroup = strconv.Itoa(os.Getgid())
+	defer func() {
+		config.Server.Address, config.Server.SocketMode, config.Server.SocketGroup = prevAddress, prevMode, prevGroup
+	}()
+
+	listener, err := listenServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected socket mode 0600, got %o", info.Mode().Perm())
+	}
+
+	config.Server.Address = "unix:" + filepath.Join(t.TempDir(), "tlspol.sock")
+	config.Server.SocketGroup = "no-such-group-tlspol"
+	if listener, err := listenServer(); err == nil {
+		listener.Close()
+		t.Error("Expected an unknown server.socket_group to be rejected")
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	prevSlots, prevTimeout := evalSlots.Load(), evalQueueTimeout
+	setMaxConcurrent(2)
+	evalQueueTimeout = 100 * time.Millisecond
+	defer func() {
+		evalSlots.Store(prevSlots)
+		evalQueueTimeout = prevTimeout
+	}()
+
+	first, ok1 := acquireEvalSlot()
+	_, ok2 := acquireEvalSlot()
+	if !ok1 || !ok2 {
+		t.Fatal("Expected two free slots")
+	}
+	acquired := make(chan bool)
+	go func() {
+		_, ok := acquireEvalSlot()
+		acquired <- ok
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Third evaluation should wait for a free slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	first()
+	if !<-acquired {
+		t.Error("Third evaluation should get the released slot")
+	}
+	if _, ok := acquireEvalSlot(); ok {
+		t.Error("Expected to time out while all slots are taken")
+	}
+
+	// Commands evaluating a domain outside of QUERY are limited as well
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for _, cmd := range []string{"QUERYVERBOSE busy.example", "JSON busy.example"} {
+		client.Write(netstring.Marshal(cmd))
+		if !replies.Scan() || replies.Text() != "TEMP " {
+			t.Errorf("%s: expected TEMP while all slots are taken, got %q", cmd, replies.Text())
+		}
+	}
+}
+
+func TestQueryDomainNoLeak(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "example.com")
+	z.Add(t,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=noleak;"`,
+	)
+	startFakeDns(t, z)
+	// The MTA-STS result arrives after DANE has already decided
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	before := runtime.NumGoroutine()
+	domain := "example.com"
+	for i := 0; i < 20; i++ {
+		if res := queryDomain(&domain); res.Policy != "dane-only" {
+			t.Fatalf("Expected dane-only, got %q", res.Policy)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutines did not stabilize: %d before, %d after 20 queries", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCombinedTtl(t *testing.T) {
+	z := newFakeZone(true)
+	// DANE takes three lookups, so MTA-STS is evaluated first and both results are available
+	z.delay = 20 * time.Millisecond
+	startFakeDns(t, z)
+	var maxAge atomic.Int32
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: %d\n", maxAge.Load())
+	}))
+
+	tests := []struct {
+		id        string
+		daneTtl   uint32
+		stsMaxAge int32
+		expected  uint32
+	}{
+		{"ttl1", 300, 86400, 300},
+		{"ttl2", 86400, 600, 600},
+	}
+	domain := "example.com"
+	for _, test := range tests {
+		z.Remove(domain, dns.TypeMX)
+		z.Remove("mx.example.com", dns.TypeA)
+		z.Remove("_25._tcp.mx.example.com", dns.TypeTLSA)
+		z.Remove("_mta-sts.example.com", dns.TypeTXT)
+		z.Add(t,
+			fmt.Sprintf("example.com. %d IN MX 10 mx.example.com.", test.daneTtl),
+			fmt.Sprintf("mx.example.com. %d IN A 192.0.2.25", test.daneTtl),
+			fmt.Sprintf("_25._tcp.mx.example.com. %d IN TLSA 3 1 1 "+fakeTlsaDigest, test.daneTtl),
+			`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=`+test.id+`;"`,
+		)
+		maxAge.Store(test.stsMaxAge)
+		res := queryDomain(&domain)
+		if res.Policy != "dane-only" || res.Ttl != test.expected {
+			t.Errorf("Expected dane-only with TTL %d for DANE TTL %d and max_age %d, got %q with TTL %d",
+				test.expected, test.daneTtl, test.stsMaxAge, res.Policy, res.Ttl)
+		}
+	}
+}
+
+func TestCombinedTtlDaneFirst(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "example.com")
+	z.Add(t,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=ttldanefirst;"`,
+	)
+	startFakeDns(t, z)
+	// The policy is served slowly, so DANE is evaluated first and the MTA-STS result must still be awaited
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+
+	domain := "example.com"
+	res := queryDomain(&domain)
+	if res.Policy != "dane-only" || res.Ttl != 300 {
+		t.Errorf("Expected dane-only with TTL 300, got %q with TTL %d", res.Policy, res.Ttl)
+	}
+	if res.MtaStsTime == 0 {
+		t.Error("Expected the MTA-STS result to be awaited")
+	}
+}
+
+func TestDisagreementDaneFirst(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"example.com. 300 IN MX 10 mx1.example.com.",
+		"example.com. 300 IN MX 20 mx2.example.com.",
+		"mx1.example.com. 300 IN A 192.0.2.25",
+		"mx2.example.com. 300 IN A 192.0.2.26",
+		"_25._tcp.mx1.example.com. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		"_25._tcp.mx2.example.com. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=disagreedanefirst;"`,
+	)
+	startFakeDns(t, z)
+	// DANE is decided first, the disagreement is only found once the MTA-STS policy arrived
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx1.example.com\nmax_age: 86400\n")
+	}))
+
+	before := disagreements.Load()
+	domain := "example.com"
+	if res := queryDomain(&domain); res.Policy != "dane-only" {
+		t.Errorf("Expected dane-only, got %q", res.Policy)
+	}
+	if n := disagreements.Load() - before; n != 1 {
+		t.Errorf("Expected one disagreement to be counted, got %d", n)
+	}
+}
+
+func TestStalledResolver(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "stalled.example")
+	z.Drop(100)
+	startFakeDns(t, z)
+
+	// Shorter than REQUEST_TIMEOUT, which the evaluation is still bound to
+	ctx, cancel := context.WithTimeout(bgCtx, 300*time.Millisecond)
+	defer cancel()
+	domain := "stalled.example"
+	res := queryDomainMapWith(ctx, &domain, MapCombined)
+	if res.Policy != "TEMP" || res.Ttl != cacheTempTtl() || res.Reason != "dns timeout" {
+		t.Errorf("Expected TEMP with TTL %d for dns timeout, got %q with TTL %d for %q", cacheTempTtl(), res.Policy, res.Ttl, res.Reason)
+	}
+}
+
+func TestDisableMechanisms(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "example.com")
+	z.Add(t,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=disable1;"`,
+	)
+	startFakeDns(t, z)
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	prevDane, prevMtaSts := config.Dane.Enable, config.MtaSts.Enable
+	defer func() {
+		config.Dane.Enable = prevDane
+		config.MtaSts.Enable = prevMtaSts
+	}()
+
+	tests := []struct {
+		dane, mtaSts bool
+		policy       string
+	}{
+		{true, true, "dane-only"},
+		{false, true, "secure match=mx.example.com servername=hostname"},
+		{true, false, "dane-only"},
+		{false, false, ""},
+	}
+	domain := "example.com"
+	for _, test := range tests {
+		config.Dane.Enable = test.dane
+		config.MtaSts.Enable = test.mtaSts
+		mxBefore := z.Queries(domain, dns.TypeMX)
+		stsBefore := z.Queries("_mta-sts."+domain, dns.TypeTXT)
+		if res := queryDomain(&domain); res.Policy != test.policy {
+			t.Errorf("Expected %q with dane.enable=%v and mtasts.enable=%v, got %q", test.policy, test.dane, test.mtaSts, res.Policy)
+		}
+		if r := resolveDomain(&bgCtx, &domain, false); (len(r.Dane.Policy) != 0) != test.dane || (len(r.MtaSts.Policy) != 0) != test.mtaSts {
+			t.Errorf("Expected only the enabled mechanisms in the JSON result, got %+v", r)
+		}
+		if !test.dane && z.Queries(domain, dns.TypeMX) != mxBefore {
+			t.Error("Expected no MX lookup with DANE disabled")
+		}
+		if !test.mtaSts && z.Queries("_mta-sts."+domain, dns.TypeTXT) != stsBefore {
+			t.Error("Expected no MTA-STS lookup with MTA-STS disabled")
+		}
+	}
+}
+
+func TestPreferPolicy(t *testing.T) {
+	config := getConfig()
+	signed := newFakeZone(true)
+	addDaneDomain(t, signed, "example.com")
+	signed.Add(t,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=prefer1;"`,
+	)
+	startFakeDns(t, signed)
+	mode := "enforce"
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "version: STSv1\nmode: %s\nmx: mx.example.com\nmax_age: 86400\n", mode)
+	}))
+	prev := config.Policy.Prefer
+	defer func() { config.Policy.Prefer = prev }()
+
+	const secure = "secure match=mx.example.com servername=hostname"
+	domain := "example.com"
+	tests := []struct {
+		prefer, policy string
+	}{
+		{"", "dane-only"},
+		{"dane", "dane-only"},
+		{"mtasts", secure},
+	}
+	for _, test := range tests {
+		config.Policy.Prefer = test.prefer
+		if res := queryDomain(&domain); res.Policy != test.policy {
+			t.Errorf("Expected %q with policy.prefer=%q, got %q", test.policy, test.prefer, res.Policy)
+		}
+	}
+
+	// Only an enforced MTA-STS policy takes precedence over DANE
+	mode = "testing"
+	signed.Remove("_mta-sts.example.com", dns.TypeTXT)
+	signed.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=prefer2;"`)
+	if res := queryDomain(&domain); res.Policy != "dane-only" {
+		t.Errorf("Expected DANE to win over MTA-STS in testing mode, got %q", res.Policy)
+	}
+
+	// Without DNSSEC there is no DANE, so MTA-STS applies whichever is preferred
+	mode = "enforce"
+	unsigned := newFakeZone(false)
+	unsigned.Add(t,
+		"example.com. 300 IN MX 10 mx.example.com.",
+		"mx.example.com. 300 IN A 192.0.2.25",
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=prefer3;"`,
+	)
+	startFakeDns(t, unsigned)
+	for _, prefer := range []string{"dane", "mtasts"} {
+		config.Policy.Prefer = prefer
+		if res := queryDomain(&domain); res.Policy != secure {
+			t.Errorf("Expected MTA-STS without DNSSEC with policy.prefer=%q, got %q", prefer, res.Policy)
+		}
+	}
+}
+func TestCacheTtls(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"short.example. 60 IN MX 10 mx.short.example.",
+		"mx.short.example. 60 IN A 192.0.2.25",
+		"_25._tcp.mx.short.example. 60 IN TLSA 3 1 1 "+fakeTlsaDigest,
+	)
+	z.SetRcode("temp.example", dns.TypeMX, dns.RcodeServerFailure)
+	startFakeDns(t, z)
+	prev := config.Cache
+	config.Cache.NotFoundTtl = 1200
+	config.Cache.TempTtl = 30
+	config.Cache.MinTtl = 90
+	defer func() { config.Cache = prev }()
+
+	tests := []struct {
+		domain, policy string
+		ttl            uint32
+	}{
+		{"none.example", "", 1200},
+		{"temp.example", "TEMP", 30},
+		{"short.example", "dane-only", 90},
+	}
+	for _, test := range tests {
+		if res := queryDomainMap(&test.domain, MapDane); res.Policy != test.policy || res.Ttl != test.ttl {
+			t.Errorf("Expected %q with TTL %d for %s, got %q with TTL %d", test.policy, test.ttl, test.domain, res.Policy, res.Ttl)
+		}
+	}
+}
+
+func TestTempCacheTtl(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.SetRcode("cooldown.example", dns.TypeMX, dns.RcodeServerFailure)
+	startFakeDns(t, z)
+	prev := config.Cache
+	config.Cache.TempTtl = 30
+	config.Cache.MemoryEntries = 16
+	defer func() { config.Cache = prev }()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	for range 2 {
+		client.Write(netstring.Marshal("DANE cooldown.example"))
+		if !replies.Scan() {
+			t.Fatalf("No reply: %v", replies.Err())
+		}
+		if reply := replies.Text(); !strings.HasPrefix(reply, "TEMP ") {
+			t.Errorf("Expected TEMP, got %q", reply)
+		}
+	}
+	if n := z.Queries("cooldown.example", dns.TypeMX); n != 1 {
+		t.Errorf("Expected the TEMP verdict to be served from cache, got %d MX lookups", n)
+	}
+
+	// Kept for the full cache.temp_ttl, without the jitter of prefetched policies
+	domain := "cooldown.example"
+	key := getMapCacheKey(&domain, MapDane)
+	data, ttl, err := cacheJsonGet(&key)
+	if err != nil || data.Result != "TEMP" {
+		t.Fatalf("Expected a cached TEMP verdict, got %+v (%v)", data, err)
+	}
+	if remaining := ttl - PREFETCH_MARGIN; remaining < 29 || remaining > 30 {
+		t.Errorf("Expected TEMP to be cached for 30s, got %ds", remaining)
+	}
+}
+
+func TestSoaNegativeTtl(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"neg.example. 3600 IN SOA ns.neg.example. hostmaster.neg.example. 1 3600 600 86400 300",
+		"low.example. 3600 IN SOA ns.low.example. hostmaster.low.example. 1 3600 600 86400 10",
+		"high.example. 7200 IN SOA ns.high.example. hostmaster.high.example. 1 3600 600 86400 7200",
+	)
+	z.SetRcode("nx.neg.example", dns.TypeMX, dns.RcodeNameError)
+	startFakeDns(t, z)
+	prev := config.Cache
+	config.Cache.NotFoundTtl = 1200
+	config.Cache.MinTtl = 90
+	defer func() { config.Cache = prev }()
+
+	tests := []struct {
+		domain string
+		ttl    uint32
+	}{
+		{"neg.example", 300},         // no MX records, SOA minimum
+		{"nx.neg.example", 300},      // NXDOMAIN, SOA of the parent zone
+		{"low.example", 90},          // raised to cache.min_ttl
+		{"high.example", 1200},       // capped at cache.notfound_ttl
+		{"nosoa.example.test", 1200}, // without SOA, cache.notfound_ttl
+	}
+	for _, test := range tests {
+		if res := queryDomainMap(&test.domain, MapDane); res.Policy != "" || res.Ttl != test.ttl {
+			t.Errorf("Expected no policy with TTL %d for %s, got %q with TTL %d", test.ttl, test.domain, res.Policy, res.Ttl)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Rrtype: dns.TypeSOA, Ttl: 120}, Minttl: 300}}
+	if ttl, ok := negativeTtl(m); !ok || ttl != 120 {
+		t.Errorf("Expected the lower of the SOA TTL and minimum, got %d", ttl)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	config := getConfig()
+	resetMemCache := func() {
+		memCache.Lock()
+		memCache.lru.Init()
+		clear(memCache.m)
+		memCache.Unlock()
+	}
+	resetMemCache()
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 100
+	defer func() {
+		config.Cache.MemoryEntries = prev
+		resetMemCache()
+	}()
+	entries := map[string]string{
+		"a.example": "dane-only",
+		"b.example": "dane-only",
+		"c.example": "secure match=mx.c.example servername=hostname",
+		"d.example": "TEMP",
+		"e.example": "",
+	}
+	for domain, result := range entries {
+		memCacheSet(getCacheKey(&domain), CacheStruct{Domain: domain, Result: result, Ttl: 3600}, time.Hour)
+	}
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write(netstring.Marshal("STATS"))
+	var stats CacheStats
+	if err := json.NewDecoder(client).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"dane-only": 2, "secure": 1, "TEMP": 1, "NOTFOUND": 1}
+	if stats.Entries != 5 || !maps.Equal(stats.Results, expected) || stats.Schema != DB_SCHEMA {
+		t.Errorf("Expected 5 entries %v with schema %s, got %+v", expected, DB_SCHEMA, stats)
+	}
+}
+
+func TestPurgeDomain(t *testing.T) {
+	config := getConfig()
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 100
+	defer func() { config.Cache.MemoryEntries = prev }()
+	for _, domain := range []string{"purged.example", "kept.example"} {
+		memCacheSet(getCacheKey(&domain), CacheStruct{Domain: domain, Result: "dane-only", Ttl: 3600}, time.Hour)
+	}
+	domain := "purged.example"
+	memCacheSet(getMapCacheKey(&domain, MapDane), CacheStruct{Domain: domain, Map: MapDane, Result: "dane-only", Ttl: 3600}, time.Hour)
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	purge := func(domain string, expected string) {
+		t.Helper()
+		client.Write(netstring.Marshal("PURGE " + domain))
+		if !replies.Scan() {
+			t.Fatalf("No reply: %v", replies.Err())
+		}
+		if reply := replies.Text(); reply != expected {
+			t.Errorf("PURGE %s: expected %q, got %q", domain, expected, reply)
+		}
+	}
+	purge("Purged.Example", "OK purged")
+	purge("purged.example", "NOTFOUND ")
+	purge("missing.example", "NOTFOUND ")
+
+	for _, key := range []string{getCacheKey(&domain), getMapCacheKey(&domain, MapDane)} {
+		if _, _, ok := memCacheGet(key); ok {
+			t.Errorf("Expected all cached policies of %s to be purged", domain)
+		}
+	}
+	kept := "kept.example"
+	if _, _, ok := memCacheGet(getCacheKey(&kept)); !ok {
+		t.Error("Expected the policy of kept.example to remain cached")
+	}
+}
+
+func TestQueryVerbose(t *testing.T) {
+	z := newFakeZone(true)
+	addDaneDomain(t, z, "verbose.example")
+	startFakeDns(t, z)
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+
+	client.Write(netstring.Marshal("QUERYVERBOSE verbose.example"))
+	if !replies.Scan() {
+		t.Fatalf("No reply: %v", replies.Err())
+	}
+	reply, ok := strings.CutPrefix(replies.Text(), "OK ")
+	if !ok {
+		t.Fatalf("Expected an OK reply, got %q", replies.Text())
+	}
+	var r VerboseResult
+	if err := json.Unmarshal([]byte(reply), &r); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", reply, err)
+	}
+	if r.Policy != "dane-only" || r.Ttl != 300 {
+		t.Errorf("Expected dane-only with TTL 300, got %+v", r)
+	}
+	if d, err := time.ParseDuration(r.DaneTime); err != nil || d <= 0 {
+		t.Errorf("Expected a non-zero DANE time, got %q", r.DaneTime)
+	}
+}
+
+func TestCoalesceQueries(t *testing.T) {
+	z := newFakeZone(true)
+	z.delay = 50 * time.Millisecond
+	addDaneDomain(t, z, "burst.example")
+	startFakeDns(t, z)
+
+	replies := make([]replyBuffer, 10)
+	var wg sync.WaitGroup
+	for i := range replies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var c net.Conn = &replies[i]
+			handleQuery(&c, "burst.example", MapCombined, false)
+		}()
+	}
+	wg.Wait()
+	for i := range replies {
+		if reply := replies[i].buf.String(); reply != string(netstring.Marshal("OK dane-only")) {
+			t.Errorf("Unexpected reply %q", reply)
+		}
+	}
+	if n := z.Queries("burst.example", dns.TypeMX); n != 1 {
+		t.Errorf("Expected concurrent queries to share one evaluation, got %d MX lookups", n)
+	}
+}
+
+func TestMaxReplySize(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t, `_mta-sts.example.com. 300 IN TXT "v=STSv1; id=longreply1;"`)
+	startFakeDns(t, z)
+	var policy strings.Builder
+	policy.WriteString("version: STSv1\nmode: enforce\nmax_age: 86400\n")
+	for i := range 200 {
+		fmt.Fprintf(&policy, "mx: mx%d.example.com\n", i)
+	}
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, policy.String())
+	}))
+	prev := config.Server.MaxReplySize
+	defer func() { config.Server.MaxReplySize = prev }()
+	config.Server.MaxReplySize = 1000
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	query := func() string {
+		client.Write(netstring.Marshal("QUERY example.com"))
+		if !replies.Scan() {
+			t.Fatalf("No reply: %v", replies.Err())
+		}
+		return replies.Text()
+	}
+	if reply := query(); reply != "TEMP " {
+		t.Errorf("Expected TEMP for a reply over %d bytes, got %d bytes", config.Server.MaxReplySize, len(reply))
+	}
+	config.Server.MaxReplySize = 0
+	if reply := query(); !strings.HasPrefix(reply, "OK secure match=mx0.example.com:") || !strings.Contains(reply, "mx199.example.com") {
+		t.Errorf("Expected the full policy within the default limit, got %q", reply)
+	}
+}
+
+func TestCacheExportImport(t *testing.T) {
+	config := getConfig()
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 16
+	defer func() { config.Cache.MemoryEntries = prev }()
+	// Start without the entries of other tests
+	memCache.Lock()
+	memCache.lru.Init()
+	clear(memCache.m)
+	memCache.Unlock()
+	domains := []string{"export1.example", "export2.example"}
+	for _, domain := range domains {
+		key := getCacheKey(&domain)
+		cacheJsonSet(&key, &CacheStruct{Domain: domain, Result: "dane-only", Source: "dane", Ttl: 3600})
+	}
+
+	var dump bytes.Buffer
+	if n, err := exportCache(&dump); err != nil || n != len(domains) {
+		t.Fatalf("Expected %d exported entries, got %d (%v)", len(domains), n, err)
+	}
+	if lines := strings.Count(dump.String(), "\n"); lines != len(domains) {
+		t.Errorf("Expected one line per entry, got %d lines", lines)
+	}
+	for _, domain := range domains {
+		purgeDomain(domain)
+	}
+	if n, _ := exportCache(io.Discard); n != 0 {
+		t.Fatalf("Expected an empty cache after purging, got %d entries", n)
+	}
+
+	if n, err := importCache(bytes.NewReader(dump.Bytes())); err != nil || n != len(domains) {
+		t.Fatalf("Expected %d imported entries, got %d (%v)", len(domains), n, err)
+	}
+	for _, domain := range domains {
+		key := getCacheKey(&domain)
+		data, ttl, err := cacheJsonGet(&key)
+		if err != nil || data.Domain != domain || data.Result != "dane-only" || data.Source != "dane" || data.Ttl != 3600 {
+			t.Errorf("Expected %q to be restored, got %+v (%v)", domain, data, err)
+		}
+		if ttl < 3600 || ttl > 3600+PREFETCH_MARGIN {
+			t.Errorf("Expected the remaining TTL of %q to be kept, got %d", domain, ttl)
+		}
+	}
+
+	// The time since the export is deducted from the remaining TTL
+	expired := `{"key":"` + CACHE_KEY_PREFIX + `EXPIRED","ttl":60,"time":` + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + `,"data":{"d":"expired.example","r":"dane","p":"","t":60}}` + "\n"
+	if n, err := importCache(strings.NewReader(expired)); err != nil || n != 0 {
+		t.Errorf("Expected an entry expired since the export to be skipped, got %d (%v)", n, err)
+	}
+	if _, err := importCache(strings.NewReader(`{"key":"other","ttl":60,"time":0,"data":{}}`)); err == nil {
+		t.Error("Expected an entry without a domain to be rejected")
+	}
+
+	// Entries are stored under the key of their domain and map, whatever key they were exported with
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	other := `{"key":"dev:` + CACHE_KEY_PREFIX + `OTHER","ttl":3600,"time":` + now + `,"data":{"d":"other.example","m":"dane","r":"dane","p":"","t":3600}}` + "\n"
+	if n, err := importCache(strings.NewReader(other)); err != nil || n != 1 {
+		t.Fatalf("Expected the entry of another namespace to be imported, got %d (%v)", n, err)
+	}
+	domain := "other.example"
+	key := getMapCacheKey(&domain, MapDane)
+	if data, _, err := cacheJsonGet(&key); err != nil || data.Result != "dane" {
+		t.Errorf("Expected the entry under the key of its domain and map, got %+v (%v)", data, err)
+	}
+}
+
+func TestJsonErrors(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"ok.jsonerr.example. 300 IN MX 0 .",
+		`_mta-sts.ok.jsonerr.example. 300 IN TXT "v=spf1 -all"`,
+	)
+	z.SetRcode("fail.jsonerr.example", dns.TypeMX, dns.RcodeServerFailure)
+	z.SetRcode("_mta-sts.fail.jsonerr.example", dns.TypeTXT, dns.RcodeServerFailure)
+	startFakeDns(t, z)
+
+	domain := "fail.jsonerr.example"
+	r := resolveDomain(&bgCtx, &domain, false)
+	if r.Dane.Policy != "TEMP" || r.Dane.Error != "MX lookup failed: SERVFAIL from resolver" {
+		t.Errorf("Expected TEMP with the SERVFAIL as error, got %+v", r.Dane)
+	}
+	if r.MtaSts.Policy != "" || r.MtaSts.Error != "TXT lookup for _mta-sts.fail.jsonerr.example failed: SERVFAIL from resolver" {
+		t.Errorf("Expected no MTA-STS policy with the SERVFAIL as error, got %+v", r.MtaSts)
+	}
+
+	// A genuine lack of policies has no error
+	domain = "ok.jsonerr.example"
+	r = resolveDomain(&bgCtx, &domain, false)
+	b, _ := json.Marshal(r)
+	if r.Dane.Error != "" || r.MtaSts.Error != "" || strings.Contains(string(b), `"error"`) {
+		t.Errorf("Expected no error without a failure, got %s", b)
+	}
+}
+
+func TestJsonIndependentPolicies(t *testing.T) {
+	z := newFakeZone(true)
+	z.Add(t,
+		"example.com. 300 IN MX 10 mx1.example.com.",
+		"mx1.example.com. 300 IN A 192.0.2.25",
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=split1;"`,
+	)
+	z.SetRcode("_25._tcp.mx1.example.com", dns.TypeTLSA, dns.RcodeServerFailure)
+	startFakeDns(t, z)
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: *.example.com\nmax_age: 86400\n")
+	}))
+
+	// DANE fails, the MTA-STS policy is still reported as if DANE had not been evaluated
+	domain := "example.com"
+	r := resolveDomain(&bgCtx, &domain, true)
+	if r.Dane.Policy != "TEMP" || len(r.Dane.Error) == 0 {
+		t.Errorf("Expected TEMP for DANE with an error, got %+v", r.Dane)
+	}
+	// The wildcard is expanded to the MX host, so the policy expires with the MX record
+	if r.MtaSts.Policy != "secure match=mx1.example.com servername=hostname" || r.MtaSts.Ttl != 300 || len(r.MtaSts.Error) != 0 ||
+		!strings.HasPrefix(r.MtaSts.Report, "policy_type=sts policy_domain=example.com mx_host_pattern=*.example.com ") {
+		t.Errorf("Expected the MTA-STS policy to be intact, got %+v", r.MtaSts)
+	}
+	if len(r.Disagreement) != 0 {
+		t.Errorf("Expected no disagreement without a usable DANE policy, got %q", r.Disagreement)
+	}
+	for _, step := range r.Explain.MtaSts {
+		if strings.Contains(step, "TLSA") {
+			t.Errorf("Expected no DANE steps in the MTA-STS explanation, got %q", step)
+		}
+	}
+}
+
+func TestNextHopQuery(t *testing.T) {
+	config := getConfig()
+	z := newFakeZone(true)
+	z.Add(t,
+		"relay.example. 300 IN MX 10 mx1.relay.example.",
+		"mx1.relay.example. 300 IN A 192.0.2.25",
+		"_25._tcp.mx1.relay.example. 300 IN TLSA 3 1 1 "+fakeTlsaDigest,
+		`_mta-sts.example.com. 300 IN TXT "v=STSv1; id=nexthop1;"`,
+	)
+	startFakeDns(t, z)
+	startFakeMtaSts(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: *.relay.example\nmax_age: 86400\n")
+	}))
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 16
+	defer func() { config.Cache.MemoryEntries = prev }()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	requests := []struct {
+		request string
+		reply   string
+	}{
+		// DANE applies to the next-hop, the recipient domain itself has no MX hosts
+		{"DANE example.com relay.example", "OK dane-only"},
+		{"DANE example.com", "NOTFOUND "},
+		// The MTA-STS policy of the recipient domain is matched against the MX hosts of the next-hop
+		{"MTASTS example.com relay.example", "OK secure match=mx1.relay.example servername=hostname"},
+		{"MTASTS example.com", "OK secure match=.relay.example servername=hostname"},
+		{"DANE example.com example.com", "NOTFOUND "},
+		{"DANE example.com:25 relay.example", "NOTFOUND "},
+		{"DANE example.com -invalid-", "NOTFOUND "},
+	}
+	for _, r := range requests {
+		client.Write(netstring.Marshal(r.request))
+		if !replies.Scan() {
+			t.Fatalf("No reply to %q: %v", r.request, replies.Err())
+		}
+		if reply := replies.Text(); reply != r.reply {
+			t.Errorf("Expected %q for %q, got %q", r.reply, r.request, reply)
+		}
+	}
+
+	// Cached under both domains, apart from the policy of the recipient domain alone
+	query := "example.com relay.example"
+	key := getMapCacheKey(&query, MapDane)
+	if data, _, err := cacheJsonGet(&key); err != nil || data.Result != "dane-only" || data.Domain != query {
+		t.Errorf("Expected the policy to be cached for %q, got %+v (%v)", query, data, err)
+	}
+	domain := "example.com"
+	key = getMapCacheKey(&domain, MapDane)
+	if data, _, err := cacheJsonGet(&key); err != nil || data.Result != "" {
+		t.Errorf("Expected no policy to be cached for the recipient domain alone, got %+v (%v)", data, err)
+	}
+	// Prefetching evaluates the cached query the same way
+	if res := queryDomainMap(&query, MapDane); res.Policy != "dane-only" {
+		t.Errorf("Expected dane-only when evaluating %q again, got %q", query, res.Policy)
+	}
+}
+
+func TestResolverOverride(t *testing.T) {
+	config := getConfig()
+	other := newFakeZone(true)
+	addDaneDomain(t, other, "override.example")
+	otherAddr := startFakeDns(t, other)
+	z := newFakeZone(true)
+	startFakeDns(t, z)
+	prev := config.Cache.MemoryEntries
+	config.Cache.MemoryEntries = 16
+	defer func() { config.Cache.MemoryEntries = prev }()
+
+	client := pipeConnection(t)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := netstring.NewScanner(client)
+	query := func(q string, expected string) {
+		t.Helper()
+		client.Write(netstring.Marshal(q))
+		if !replies.Scan() || replies.Text() != expected {
+			t.Errorf("%s: expected %q, got %q", q, expected, replies.Text())
+		}
+	}
+
+	query("QUERY override.example @"+otherAddr, "OK dane-only")
+	if other.Queries("override.example", dns.TypeMX) == 0 || z.Queries("override.example", dns.TypeMX) != 0 {
+		t.Error("Expected only the override resolver to be queried")
+	}
+	// Neither the policy nor the DNS answers of the override are cached
+	query("QUERY override.example", "NOTFOUND ")
+	if z.Queries("override.example", dns.TypeMX) == 0 {
+		t.Error("Expected the configured resolver to be queried without an override")
+	}
+	query("QUERY override.example @", "NOTFOUND ")
+
+	// Evaluations with another resolver count against server.max_concurrent like any other
+	prevSlots, prevTimeout := evalSlots.Load(), evalQueueTimeout
+	setMaxConcurrent(1)
+	evalQueueTimeout = 10 * time.Millisecond
+	release, _ := acquireEvalSlot()
+	query("QUERY override.example @"+otherAddr, "TEMP ")
+	release()
+	evalSlots.Store(prevSlots)
+	evalQueueTimeout = prevTimeout
+
+	host, port, _ := net.SplitHostPort(otherAddr)
+	if _, resolver, ok := splitResolver("example.com @" + host); !ok || resolver != host+":53" {
+		t.Errorf("Expected port 53 to be added, got %q", resolver)
+	}
+	jsonClient := pipeConnection(t)
+	jsonClient.SetDeadline(time.Now().Add(5 * time.Second))
+	jsonClient.Write(netstring.Marshal("JSON override.example @" + host + ":" + port))
+	var result Result
+	if raw, err := bufio.NewReader(jsonClient).ReadBytes('\n'); err != nil || json.Unmarshal(raw, &result) != nil || result.Dane.Policy != "dane-only" {
+		t.Errorf("Expected dane-only from the override resolver, got %s (%v)", raw, err)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time to let in-flight queries finish on shutdown
+const SHUTDOWN_TIMEOUT = 2 * REQUEST_TIMEOUT
+
+var shuttingDown atomic.Bool
+
+// Open socketmap connections, to end them on shutdown
+var connections = struct {
+	sync.Mutex
+	wg sync.WaitGroup
+	m  map[net.Conn]struct{}
+}{m: make(map[net.Conn]struct{})}
+
+func trackConnection(conn net.Conn) {
+	connections.Lock()
+	defer connections.Unlock()
+	connections.wg.Add(1)
+	connections.m[conn] = struct{}{}
+}
+
+func untrackConnection(conn net.Conn) {
+	connections.Lock()
+	defer connections.Unlock()
+	delete(connections.m, conn)
+	connections.wg.Done()
+}
+
+// Ends idle connections and waits for in-flight queries to be answered, returns false on timeout
+func drainConnections(timeout time.Duration) bool {
+	shuttingDown.Store(true)
+	connections.Lock()
+	for conn := range connections.m {
+		// Interrupts waiting for the next query, replies can still be written
+		conn.SetReadDeadline(time.Now())
+	}
+	connections.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		connections.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Warnf("Connections still active after %v, shutting down anyway", timeout)
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const TLSRPT_MAX_ENTRIES = 4096
+
+type tlsRptEntry struct {
+	rua     string
+	ttl     uint32
+	expires time.Time
+}
+
+// Parsed TLS-RPT records by domain, kept for the TTL of the TXT record
+var tlsRptCache = struct {
+	sync.Mutex
+	m map[string]tlsRptEntry
+}{m: make(map[string]tlsRptEntry)}
+
+// Parses the rua field of a TLS-RPT TXT record (see [RFC 8460, 3])
+func parseTlsRptRua(record string) string {
+	for _, field := range strings.Split(record, ";") {
+		keyVal := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyVal) == 2 && strings.TrimSpace(keyVal[0]) == "rua" {
+			return strings.TrimSpace(keyVal[1])
+		}
+	}
+	return ""
+}
+
+func lookupTlsRpt(ctx *context.Context, domain *string) (string, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn("_smtp._tls."+(*domain)), dns.TypeTXT)
+	setEdns0(m, false)
+
+	r, err := exchange(ctx, m)
+	if err != nil {
+		return "", 0, err
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return "", 0, errors.New(dns.RcodeToString[r.Rcode])
+	}
+
+	for _, answer := range r.Answer {
+		if txt, ok := answer.(*dns.TXT); ok {
+			txtRecord := strings.Join(txt.Txt, "")
+			if strings.HasPrefix(txtRecord, "v=TLSRPTv1") {
+				return parseTlsRptRua(txtRecord), txt.Hdr.Ttl, nil
+			}
+		}
+	}
+
+	return "", cacheNotFoundTtl(), nil
+}
+
+// Returns the TLS-RPT report target (rua) of a domain, only resolving it again when its TTL expired
+func checkTlsRpt(ctx *context.Context, domain *string) (string, uint32, error) {
+	config := getConfig()
+	now := time.Now()
+	tlsRptCache.Lock()
+	e, ok := tlsRptCache.m[*domain]
+	tlsRptCache.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.rua, uint32(e.expires.Sub(now).Seconds()), nil
+	}
+
+	rua, ttl, err := lookupTlsRpt(ctx, domain)
+	if err != nil {
+		return "", 0, err
+	}
+	if ttl < cacheMinTtl() {
+		ttl = cacheMinTtl()
+	} else if config.TlsRpt.MaxTtl != 0 && ttl > config.TlsRpt.MaxTtl {
+		ttl = config.TlsRpt.MaxTtl
+	}
+
+	tlsRptCache.Lock()
+	defer tlsRptCache.Unlock()
+	if len(tlsRptCache.m) >= TLSRPT_MAX_ENTRIES {
+		for k, e := range tlsRptCache.m {
+			if now.After(e.expires) {
+				delete(tlsRptCache.m, k)
+			}
+		}
+	}
+	if len(tlsRptCache.m) < TLSRPT_MAX_ENTRIES {
+		tlsRptCache.m[*domain] = tlsRptEntry{rua: rua, ttl: ttl, expires: now.Add(time.Duration(ttl) * time.Second)}
+	}
+	return rua, ttl, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2025 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregated policy lookups of a domain, counted in place of sessions, as Postfix
+// looks up the policy once per delivery attempt
+type tlsRptAggregate struct {
+	domain       string
+	policyType   string
+	policyString []string
+	successful   uint64
+	failures     map[string]uint64
+}
+
+// Lookups since the last report, by domain and policy type; dropped counts the
+// lookups of domains that did not fit into the map anymore
+var tlsRptAggregates = struct {
+	sync.Mutex
+	m       map[string]*tlsRptAggregate
+	dropped uint64
+	start   time.Time
+}{m: make(map[string]*tlsRptAggregate), start: time.Now()}
+
+// Report in the JSON format of [RFC 8460, 4.4]
+type TlsRptReport struct {
+	OrganizationName string            `json:"organization-name"`
+	DateRange        TlsRptDateRange   `json:"date-range"`
+	ContactInfo      string            `json:"contact-info,omitempty"`
+	ReportId         string            `json:"report-id"`
+	Policies         []TlsRptPolicySet `json:"policies"`
+}
+
+type TlsRptDateRange struct {
+	Start string `json:"start-datetime"`
+	End   string `json:"end-datetime"`
+}
+
+type TlsRptPolicySet struct {
+	Policy         TlsRptPolicyDesc      `json:"policy"`
+	Summary        TlsRptSummary         `json:"summary"`
+	FailureDetails []TlsRptFailureDetail `json:"failure-details,omitempty"`
+}
+
+type TlsRptPolicyDesc struct {
+	Type   string   `json:"policy-type"`
+	String []string `json:"policy-string,omitempty"`
+	Domain string   `json:"policy-domain"`
+}
+
+type TlsRptSummary struct {
+	Successful uint64 `json:"total-successful-session-count"`
+	Failed     uint64 `json:"total-failure-session-count"`
+}
+
+type TlsRptFailureDetail struct {
+	ResultType string `json:"result-type"`
+	Count      uint64 `json:"failed-session-count"`
+}
+
+// Extracts the policy_string fields of a socketmap report
+func tlsRptPolicyStrings(rpt string) []string {
+	var lines []string
+	for _, part := range strings.Split(rpt, "{ policy_string = ")[1:] {
+		lines = append(lines, strings.TrimSuffix(strings.TrimSpace(part), " }"))
+	}
+	return lines
+}
+
+// Counts a policy answered to Postfix for the next report, the query being the
+// cached form of the domain (see handleQuery); domains without a policy are not reported
+func recordTlsRpt(query string, policy string, rpt string, reason string) {
+	config := getConfig()
+	if len(config.TlsRpt.Endpoint) == 0 || policy == "" {
+		return
+	}
+	recipient, nextHop := splitNextHop(query)
+	isDane := policy == "dane" || policy == "dane-only" || (policy == "TEMP" && reason != REASON_STS_UNAVAILABLE)
+	policyType := "sts"
+	domain, _, _ := splitDanePort(recipient)
+	if isDane {
+		policyType = "tlsa"
+		domain, _, _ = splitDanePort(nextHop)
+	}
+	key := domain + " " + policyType
+	tlsRptAggregates.Lock()
+	defer tlsRptAggregates.Unlock()
+	a, ok := tlsRptAggregates.m[key]
+	if !ok {
+		if len(tlsRptAggregates.m) >= TLSRPT_MAX_ENTRIES {
+			tlsRptAggregates.dropped++
+			return
+		}
+		a = &tlsRptAggregate{domain: domain, policyType: policyType, failures: make(map[string]uint64)}
+		tlsRptAggregates.m[key] = a
+	}
+	if !isDane && len(rpt) != 0 {
+		a.policyString = tlsRptPolicyStrings(rpt)
+	}
+	switch {
+	case policy != "TEMP":
+		a.successful++
+	case !isDane:
+		a.failures["sts-policy-fetch-error"]++
+	case reason == verdictReason(errDnssecNotValidated):
+		a.failures["dnssec-invalid"]++
+	default:
+		a.failures["validation-failure"]++
+	}
+}
+
+// Builds the report of the lookups since the last one and resets the counters
+func takeTlsRptReport(now time.Time) *TlsRptReport {
+	config := getConfig()
+	tlsRptAggregates.Lock()
+	aggregates := tlsRptAggregates.m
+	dropped := tlsRptAggregates.dropped
+	start := tlsRptAggregates.start
+	tlsRptAggregates.m = make(map[string]*tlsRptAggregate)
+	tlsRptAggregates.dropped = 0
+	tlsRptAggregates.start = now
+	tlsRptAggregates.Unlock()
+	if dropped != 0 {
+		log.Warnf("TLS-RPT report is limited to %d domains, dropped %d policy lookups of further domains", TLSRPT_MAX_ENTRIES, dropped)
+	}
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	r := &TlsRptReport{
+		OrganizationName: config.TlsRpt.Organization,
+		DateRange: TlsRptDateRange{
+			Start: start.UTC().Format(time.RFC3339),
+			End:   now.UTC().Format(time.RFC3339),
+		},
+		ContactInfo: config.TlsRpt.Contact,
+		ReportId:    start.UTC().Format("20060102T150405Z") + "@" + hostname,
+	}
+	for _, a := range aggregates {
+		p := TlsRptPolicySet{
+			Policy:  TlsRptPolicyDesc{Type: a.policyType, String: a.policyString, Domain: a.domain},
+			Summary: TlsRptSummary{Successful: a.successful},
+		}
+		for resultType, count := range a.failures {
+			p.Summary.Failed += count
+			p.FailureDetails = append(p.FailureDetails, TlsRptFailureDetail{ResultType: resultType, Count: count})
+		}
+		slices.SortFunc(p.FailureDetails, func(a, b TlsRptFailureDetail) int {
+			return strings.Compare(a.ResultType, b.ResultType)
+		})
+		r.Policies = append(r.Policies, p)
+	}
+	slices.SortFunc(r.Policies, func(a, b TlsRptPolicySet) int {
+		return strings.Compare(a.Policy.Domain+" "+a.Policy.Type, b.Policy.Domain+" "+b.Policy.Type)
+	})
+	return r
+}
+
+// Posts the report of the lookups since the last one to tlsrpt.endpoint
+func sendTlsRptReport() error {
+	config := getConfig()
+	r := takeTlsRptReport(time.Now())
+	if r == nil {
+		return nil
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	c := http.Client{Timeout: REQUEST_TIMEOUT}
+	resp, err := c.Post(config.TlsRpt.Endpoint, "application/tlsrpt+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	log.Debugf("Sent TLS-RPT report %s with %d policies", r.ReportId, len(r.Policies))
+	return nil
+}
+
+func startTlsRptReporter() {
+	config := getConfig()
+	if len(config.TlsRpt.Endpoint) == 0 {
+		return
+	}
+	interval := time.Duration(max(config.TlsRpt.Interval, 60)) * time.Second
+	go func() {
+		for range time.Tick(interval) {
+			if err := sendTlsRptReport(); err != nil {
+				log.Warnf("Could not send TLS-RPT report to %s: %v", getConfig().TlsRpt.Endpoint, err)
+			}
+		}
+	}()
+}
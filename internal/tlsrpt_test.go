@@ -0,0 +1,117 @@
+package tlspol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTlsRptCached(t *testing.T) {
+	z := newFakeZone(false)
+	z.Add(t, `_smtp._tls.rpt.example. 3600 IN TXT "v=TLSRPTv1; rua=mailto:tlsrpt@rpt.example"`)
+	startFakeDns(t, z)
+
+	domain := "rpt.example"
+	for i := 0; i < 3; i++ {
+		rua, ttl, err := checkTlsRpt(&bgCtx, &domain)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if rua != "mailto:tlsrpt@rpt.example" {
+			t.Errorf("Unexpected rua: %q", rua)
+		}
+		if ttl == 0 || ttl > 3600 {
+			t.Errorf("Unexpected TTL: %d", ttl)
+		}
+	}
+	if n := z.Queries("_smtp._tls.rpt.example", dns.TypeTXT); n != 1 {
+		t.Errorf("Expected the TLS-RPT record to be resolved once, got %d queries", n)
+	}
+}
+
+func TestTlsRptReport(t *testing.T) {
+	config := getConfig()
+	reports := make(chan TlsRptReport, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/tlsrpt+json" {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		var report TlsRptReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("Invalid report: %v", err)
+		}
+		reports <- report
+	}))
+	defer ts.Close()
+	prev := config.TlsRpt
+	defer func() { config.TlsRpt = prev }()
+	config.TlsRpt.Endpoint = ts.URL
+	config.TlsRpt.Organization = "test"
+
+	rpt := "policy_type=sts policy_domain=sts.example mx_host_pattern=mx.sts.example { policy_string = version: STSv1 } { policy_string = mode: enforce }"
+	recordTlsRpt("sts.example", "secure match=mx.sts.example servername=hostname", rpt, "")
+	recordTlsRpt("sts.example", "secure match=mx.sts.example servername=hostname", rpt, "")
+	recordTlsRpt("sts.example", "TEMP", "", REASON_STS_UNAVAILABLE)
+	recordTlsRpt("dane.example", "dane-only", "", "")
+	recordTlsRpt("rcpt.example dane.example:25", "TEMP", "", "dnssec not validated")
+	recordTlsRpt("none.example", "", "", "")
+	if err := sendTlsRptReport(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := <-reports
+	if report.OrganizationName != "test" || len(report.Policies) != 2 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	dane, sts := report.Policies[0], report.Policies[1]
+	if dane.Policy.Type != "tlsa" || dane.Policy.Domain != "dane.example" || dane.Summary != (TlsRptSummary{Successful: 1, Failed: 1}) {
+		t.Errorf("Unexpected DANE policy %+v", dane)
+	}
+	if len(dane.FailureDetails) != 1 || dane.FailureDetails[0].ResultType != "dnssec-invalid" {
+		t.Errorf("Unexpected DANE failure details %+v", dane.FailureDetails)
+	}
+	if sts.Policy.Type != "sts" || sts.Summary != (TlsRptSummary{Successful: 2, Failed: 1}) {
+		t.Errorf("Unexpected MTA-STS policy %+v", sts)
+	}
+	if len(sts.Policy.String) != 2 || sts.Policy.String[1] != "mode: enforce" {
+		t.Errorf("Unexpected MTA-STS policy string %q", sts.Policy.String)
+	}
+
+	// The counters start over after a report
+	if err := sendTlsRptReport(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case report := <-reports:
+		t.Errorf("Expected no report without evaluations, got %+v", report)
+	default:
+	}
+}
+
+func TestTlsRptDropped(t *testing.T) {
+	config := getConfig()
+	prev := config.TlsRpt
+	defer func() { config.TlsRpt = prev }()
+	config.TlsRpt.Endpoint = "http://127.0.0.1:0"
+
+	for i := 0; i <= TLSRPT_MAX_ENTRIES; i++ {
+		recordTlsRpt(fmt.Sprintf("d%d.example", i), "dane", "", "")
+	}
+	tlsRptAggregates.Lock()
+	dropped := tlsRptAggregates.dropped
+	tlsRptAggregates.Unlock()
+	if dropped != 1 {
+		t.Errorf("Expected 1 dropped lookup, got %d", dropped)
+	}
+	if r := takeTlsRptReport(time.Now()); r == nil || len(r.Policies) != TLSRPT_MAX_ENTRIES {
+		t.Errorf("Expected a report of %d domains", TLSRPT_MAX_ENTRIES)
+	}
+	if tlsRptAggregates.dropped != 0 {
+		t.Errorf("Expected the dropped lookups to be reset")
+	}
+}
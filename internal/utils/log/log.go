@@ -6,8 +6,11 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -46,13 +49,108 @@ func init() {
 var logMutex sync.Mutex
 
 // output is the writer where logs are written. Defaults to os.Stderr
-var output = os.Stderr
+var output io.Writer = os.Stderr
+
+// SetOutput redirects the logs, e. g. to io.Discard in benchmarks
+func SetOutput(w io.Writer) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	output = w
+}
+
+// minLevel is the lowest level that is logged
+var minLevel LogLevel = DEBUG
+
+// SetLevel drops messages below the level
+func SetLevel(level LogLevel) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	minLevel = level
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error"
+func ParseLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	}
+	return DEBUG, fmt.Errorf("unknown log level %q", s)
+}
+
+// jsonFormat emits one JSON object per line instead of colored text
+var jsonFormat bool = false
+
+// SetFormat selects "text" (default) or "json" output
+func SetFormat(format string) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	jsonFormat = format == "json"
+}
+
+// Fields are structured context of a log message, only emitted in the json format
+type Fields map[string]any
+
+// Entry logs messages with fields
+type Entry struct {
+	fields Fields
+}
+
+// With returns an Entry that attaches the fields to its messages
+func With(fields Fields) Entry {
+	return Entry{fields: fields}
+}
+
+func (e Entry) Debugf(format string, v ...interface{}) {
+	logMessage(DEBUG, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e Entry) Infof(format string, v ...interface{}) {
+	logMessage(INFO, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e Entry) Warnf(format string, v ...interface{}) {
+	logMessage(WARN, fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e Entry) Errorf(format string, v ...interface{}) {
+	logMessage(ERROR, fmt.Sprintf(format, v...), e.fields)
+}
+
+// logJson outputs the log message as a JSON object, along with its fields
+func logJson(level LogLevel, message string, fields Fields) {
+	obj := make(map[string]any, len(fields)+3)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj["time"] = time.Now().Format(time.RFC3339Nano)
+	obj["level"] = [...]string{"debug", "info", "warn", "error"}[level]
+	obj["msg"] = message
+	b, err := json.Marshal(obj)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": "Could not marshal log message: " + err.Error()})
+	}
+	output.Write(append(b, '\n'))
+}
 
 // logMessage formats and outputs the log message with the appropriate color
-func logMessage(level LogLevel, message string) {
+func logMessage(level LogLevel, message string, fields Fields) {
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
+	if level < minLevel {
+		return
+	}
+	if jsonFormat {
+		logJson(level, message, fields)
+		return
+	}
+
 	var levelStr string
 	var color string
 
@@ -83,33 +181,33 @@ func logMessage(level LogLevel, message string) {
 }
 
 func Debug(v ...interface{}) {
-	logMessage(DEBUG, fmt.Sprint(v...))
+	logMessage(DEBUG, fmt.Sprint(v...), nil)
 }
 
 func Debugf(format string, v ...interface{}) {
-	logMessage(DEBUG, fmt.Sprintf(format, v...))
+	logMessage(DEBUG, fmt.Sprintf(format, v...), nil)
 }
 
 func Info(v ...interface{}) {
-	logMessage(INFO, fmt.Sprint(v...))
+	logMessage(INFO, fmt.Sprint(v...), nil)
 }
 
 func Infof(format string, v ...interface{}) {
-	logMessage(INFO, fmt.Sprintf(format, v...))
+	logMessage(INFO, fmt.Sprintf(format, v...), nil)
 }
 
 func Warn(v ...interface{}) {
-	logMessage(WARN, fmt.Sprint(v...))
+	logMessage(WARN, fmt.Sprint(v...), nil)
 }
 
 func Warnf(format string, v ...interface{}) {
-	logMessage(WARN, fmt.Sprintf(format, v...))
+	logMessage(WARN, fmt.Sprintf(format, v...), nil)
 }
 
 func Error(v ...interface{}) {
-	logMessage(ERROR, fmt.Sprint(v...))
+	logMessage(ERROR, fmt.Sprint(v...), nil)
 }
 
 func Errorf(format string, v ...interface{}) {
-	logMessage(ERROR, fmt.Sprintf(format, v...))
+	logMessage(ERROR, fmt.Sprintf(format, v...), nil)
 }
@@ -75,5 +75,9 @@ func splitNetstring(data []byte, atEOF bool) (advance int, token []byte, err err
 }
 
 func Marshal(s string) []byte {
-	return []byte(strconv.Itoa(len(s)) + ":" + s + ",")
+	b := make([]byte, 0, len(s)+12)
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, ',')
 }